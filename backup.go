@@ -0,0 +1,246 @@
+package immersadb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// Backup writes a compacted copy of the current state of the database to dir.
+// Only live segments are copied and all of them end up in a single layer.
+// The directory can be opened with Open.
+// Backup works on a snapshot of the database and does not block writers.
+func (db *DB) Backup(ctx context.Context, dir string) error {
+	bst, err := db.backup(ctx, dir)
+	if err != nil {
+		return err
+	}
+	return bst.Close()
+}
+
+func (db *DB) backup(ctx context.Context, dir string) (store.Store, error) {
+	st, committed, seq, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	defer st.FinishUse()
+
+	created, err := firstMissingDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while creating backup dir %q", dir)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while listing backup dir %q", dir)
+	}
+
+	if len(files) > 0 {
+		return nil, errors.Errorf("backup dir %q is not empty", dir)
+	}
+
+	// on failure, only what was created by the backup is removed
+	cleanup := func() {
+		if created != "" {
+			os.RemoveAll(created)
+			return
+		}
+
+		files, _ := ioutil.ReadDir(dir)
+		for _, f := range files {
+			os.RemoveAll(filepath.Join(dir, f.Name()))
+		}
+	}
+
+	bst, err := store.Open(dir)
+	if err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "while creating backup store")
+	}
+
+	bst.SetFormat(st.Format())
+
+	root, err := st.CopyLive(ctx, committed, bst)
+	if err == nil {
+		err = errors.Wrap(bst.Flush(), "while flushing backup")
+	} else {
+		err = errors.Wrap(err, "while copying live segments")
+	}
+
+	if err == nil {
+		m := bst.Manifest(root)
+		m.Seq = seq
+		m.Keys = keyChecks(bst)
+		err = errors.Wrap(store.WriteManifest(dir, m), "while writing manifest")
+	}
+
+	if err != nil {
+		bst.Close()
+		cleanup()
+		return nil, err
+	}
+
+	return bst, nil
+}
+
+// firstMissingDir returns the outermost dir of the path that does not exist,
+// or an empty string if the path exists.
+func firstMissingDir(path string) (string, error) {
+	missing := ""
+	for {
+		_, err := os.Stat(path)
+		if err == nil {
+			return missing, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "while checking %q", path)
+		}
+
+		missing = path
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return missing, nil
+		}
+		path = parent
+	}
+}
+
+// Backup streams written by BackupTo start with a JSON encoded header line,
+// which holds what RestoreBackup writes to the manifest, followed by the
+// segments of the last layer.
+
+const backupFormat = "immersadb-backup"
+
+const backupVersion = 1
+
+type backupHeader struct {
+	Format  string           `json:"format"`
+	Version int              `json:"version"`
+	Seq     uint64           `json:"seq"`
+	Keys    []store.KeyCheck `json:"keys,omitempty"`
+}
+
+// BackupOptions control how BackupToWithOptions writes a backup.
+type BackupOptions struct {
+	// TempDir is the dir of the temp file the copy is staged in before it is written.
+	// The file grows as large as the backup. The default dir for temp files is used if it is empty.
+	TempDir string
+}
+
+// BackupTo writes a compacted copy of the current state of the database to w.
+// The stream can be turned into a database directory with RestoreBackup.
+// The copy is staged in a temp file in the default dir for temp files,
+// which needs as much space as the backup.
+func (db *DB) BackupTo(ctx context.Context, w io.Writer) error {
+	return db.BackupToWithOptions(ctx, w, BackupOptions{})
+}
+
+// BackupToWithOptions writes a compacted copy of the current state of the database to w like BackupTo.
+func (db *DB) BackupToWithOptions(ctx context.Context, w io.Writer, opts BackupOptions) error {
+	st, committed, seq, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+
+	defer st.FinishUse()
+
+	err = json.NewEncoder(w).Encode(backupHeader{
+		Format:  backupFormat,
+		Version: backupVersion,
+		Seq:     seq,
+		Keys:    keyChecks(st),
+	})
+	if err != nil {
+		return errors.Wrap(err, "while writing backup header")
+	}
+
+	err = st.WriteLive(ctx, committed, w, opts.TempDir)
+	if err != nil {
+		return errors.Wrap(err, "while writing backup")
+	}
+
+	return nil
+}
+
+// RestoreBackup creates a database in dir from a stream written by BackupTo.
+func RestoreBackup(r io.Reader, dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return errors.Wrapf(err, "while creating dir %q", dir)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "while listing dir %q", dir)
+	}
+
+	if len(files) > 0 {
+		return errors.Errorf("dir %q is not empty", dir)
+	}
+
+	dec := json.NewDecoder(r)
+
+	h := backupHeader{}
+	err = dec.Decode(&h)
+	if err != nil {
+		return errors.Wrap(err, "while reading backup header")
+	}
+
+	if h.Format != backupFormat {
+		return errors.Errorf("unsupported format %q", h.Format)
+	}
+
+	if h.Version != backupVersion {
+		return errors.Errorf("unsupported version %d", h.Version)
+	}
+
+	// the decoder may have read the end of the header line and segments following it
+	br := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+
+	nl, err := br.ReadByte()
+	if err != nil || nl != '\n' {
+		return errors.New("backup header is not followed by a new line")
+	}
+
+	err = store.WriteLastLayer(dir, br)
+	if err != nil {
+		return err
+	}
+
+	st, err := store.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "while opening restored store")
+	}
+
+	if st.IsEmpty() {
+		st.Close()
+		return errors.New("backup has no segments")
+	}
+
+	m := st.Manifest(st.Root())
+	m.Seq = h.Seq
+	m.Keys = h.Keys
+
+	err = store.WriteManifest(dir, m)
+	if err != nil {
+		st.Close()
+		return errors.Wrap(err, "while writing manifest")
+	}
+
+	return st.Close()
+}
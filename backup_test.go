@@ -0,0 +1,162 @@
+package immersadb_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("value", []byte{byte(i)})
+		})
+		require.NoError(t, err)
+	}
+
+	bd, cleanupBackup := createTempDir(t)
+	defer cleanupBackup()
+
+	requireBackupContent := func(t *testing.T, dir string) {
+		bdb, err := immersadb.Open(dir)
+		require.NoError(t, err)
+		defer bdb.Close()
+
+		rtx := bdb.NewReadTransaction()
+		defer rtx.Discard()
+
+		d, err := rtx.Get("value")
+		require.NoError(t, err)
+		require.Equal(t, []byte{2}, d)
+	}
+
+	t.Run("when I back up the database to a directory", func(t *testing.T) {
+		err = db.Backup(context.Background(), filepath.Join(bd, "dir"))
+		require.NoError(t, err)
+
+		t.Run("then the backup should be usable as a database", func(t *testing.T) {
+			requireBackupContent(t, filepath.Join(bd, "dir"))
+		})
+
+		t.Run("then the writers should not be blocked", func(t *testing.T) {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put("other", []byte{1})
+			})
+			require.NoError(t, err)
+		})
+	})
+
+	t.Run("when I back up the database to a non empty directory", func(t *testing.T) {
+		err = db.Backup(context.Background(), filepath.Join(bd, "dir"))
+		require.Error(t, err)
+	})
+
+	t.Run("when I back up with a cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = db.Backup(ctx, filepath.Join(bd, "cancelled", "dir"))
+		require.Error(t, err)
+
+		t.Run("then the created dirs should be removed", func(t *testing.T) {
+			_, err = os.Stat(filepath.Join(bd, "cancelled"))
+			require.True(t, os.IsNotExist(err))
+		})
+
+		t.Run("then an existing empty dir should be kept empty", func(t *testing.T) {
+			require.NoError(t, os.Mkdir(filepath.Join(bd, "existing"), 0700))
+
+			err = db.Backup(ctx, filepath.Join(bd, "existing"))
+			require.Error(t, err)
+
+			files, err := ioutil.ReadDir(filepath.Join(bd, "existing"))
+			require.NoError(t, err)
+			require.Empty(t, files)
+		})
+	})
+
+	t.Run("when I back up the database to a stream", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		err = db.BackupTo(context.Background(), buf)
+		require.NoError(t, err)
+
+		t.Run("then the restored backup should be usable as a database", func(t *testing.T) {
+			err = immersadb.RestoreBackup(buf, filepath.Join(bd, "restored"))
+			require.NoError(t, err)
+			requireBackupContent(t, filepath.Join(bd, "restored"))
+		})
+
+		t.Run("then the restored database should have the sequence number of the backup", func(t *testing.T) {
+			rdb, err := immersadb.Open(filepath.Join(bd, "restored"))
+			require.NoError(t, err)
+			defer rdb.Close()
+			require.Equal(t, db.Seq(), rdb.Seq())
+		})
+	})
+}
+
+func TestBackupToEncrypted(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	opts := immersadb.Options{EncryptionKey: []byte("0123456789abcdef")}
+
+	db, err := immersadb.OpenWithOptions(td, opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		return tx.Put("secret", []byte("attack at dawn"))
+	})
+	require.NoError(t, err)
+
+	bd, cleanupBackup := createTempDir(t)
+	defer cleanupBackup()
+
+	t.Run("when I back up to a stream staged in a chosen temp dir", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		err = db.BackupToWithOptions(context.Background(), buf, immersadb.BackupOptions{TempDir: bd})
+		require.NoError(t, err)
+
+		t.Run("then the temp dir should be left empty", func(t *testing.T) {
+			files, err := ioutil.ReadDir(bd)
+			require.NoError(t, err)
+			require.Empty(t, files)
+		})
+
+		restored := filepath.Join(bd, "restored")
+		err = immersadb.RestoreBackup(buf, restored)
+		require.NoError(t, err)
+
+		t.Run("then the restored database should be readable with the key", func(t *testing.T) {
+			rdb, err := immersadb.OpenWithOptions(restored, opts)
+			require.NoError(t, err)
+			defer rdb.Close()
+
+			rtx := rdb.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("secret")
+			require.NoError(t, err)
+			require.Equal(t, []byte("attack at dawn"), d)
+		})
+
+		t.Run("then opening the restored database with another key should fail with ErrWrongKey", func(t *testing.T) {
+			_, err := immersadb.OpenWithOptions(restored, immersadb.Options{EncryptionKey: []byte("fedcba9876543210")})
+			require.Equal(t, immersadb.ErrWrongKey, errors.Cause(err))
+		})
+	})
+}
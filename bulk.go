@@ -0,0 +1,194 @@
+package immersadb
+
+import (
+	"bytes"
+	"io"
+	"math/bits"
+
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+var ErrNotSorted = wbbtree.ErrNotSorted
+
+// KeyValueIterator provides key/value pairs in strictly ascending key order.
+type KeyValueIterator interface {
+	// Next returns the next pair or io.EOF when there are no more pairs.
+	Next() (key string, value []byte, err error)
+}
+
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+type sliceIterator []KeyValue
+
+func (s *sliceIterator) Next() (string, []byte, error) {
+	if len(*s) == 0 {
+		return "", nil, io.EOF
+	}
+	kv := (*s)[0]
+	*s = (*s)[1:]
+	return kv.Key, kv.Value, nil
+}
+
+// NewSliceIterator returns an iterator over already sorted key/value pairs.
+func NewSliceIterator(kvs []KeyValue) KeyValueIterator {
+	it := sliceIterator(kvs)
+	return &it
+}
+
+// PutAll creates a new map at mapPath containing all pairs of the iterator.
+// The map is built bottom-up in one pass, which is much faster than calling
+// Put for every key.
+func (t *Transaction) PutAll(mapPath string, it KeyValueIterator) (err error) {
+	defer t.guard(&err)()
+
+	parts, err := dbpath.Split(mapPath)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", mapPath)
+	}
+
+	keys, values, err := t.storeAll(it)
+	if err != nil {
+		return err
+	}
+
+	return t.write(parts, func(old store.Address) (store.Address, error) {
+		occupied, err := t.occupied(parts, old)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if occupied {
+			return store.NilAddress, ErrAlreadyExists
+		}
+
+		ma, err := wbbtree.BuildSorted(t.st, keys, values)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while building map")
+		}
+
+		return ma, nil
+	})
+}
+
+// MergeAll adds all pairs of the iterator to the existing map at mapPath, replacing values of existing keys.
+// A few pairs are inserted into the map one by one, otherwise the merged map
+// is rebuilt in one pass over the existing and the new pairs.
+func (t *Transaction) MergeAll(mapPath string, it KeyValueIterator) (err error) {
+	defer t.guard(&err)()
+
+	parts, err := dbpath.Split(mapPath)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", mapPath)
+	}
+
+	keys, values, err := t.storeAll(it)
+	if err != nil {
+		return err
+	}
+
+	ma, err := t.pathElementAddress(mapPath)
+	if err != nil {
+		return errors.Wrapf(err, "while looking up map %q", mapPath)
+	}
+
+	n, err := wbbtree.Count(t.st, ma)
+	if err != nil {
+		return err
+	}
+
+	if !rebuildForMerge(n, len(keys)) {
+		for i, k := range keys {
+			v := values[i]
+			err = t.write(append(parts[:len(parts):len(parts)], string(k)), func(store.Address) (store.Address, error) {
+				return v, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	defs, err := t.indexesOf(parts)
+	if err != nil {
+		return err
+	}
+
+	// replaced values are needed only to remove their index entries
+	olds := make([]store.Address, len(keys))
+
+	_, _, err = t.modifyElement(parts, func(ma store.Address) (store.Address, error) {
+		if len(defs) > 0 {
+			for i, k := range keys {
+				va, err := wbbtree.Search(t.st, ma, k)
+				if err == nil {
+					olds[i] = va
+				} else if errors.Cause(err) != wbbtree.ErrNotFound {
+					return store.NilAddress, err
+				}
+			}
+		}
+
+		return wbbtree.MergeSorted(t.st, ma, keys, values)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "while merging into %q", mapPath)
+	}
+
+	for i, k := range keys {
+		err = t.replaced(append(parts[:len(parts):len(parts)], string(k)), olds[i], values[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildForMerge returns true if merging m pairs into a map of n keys is cheaper
+// by rebuilding the map, which writes n+m nodes, than by inserting every pair,
+// which writes about log2(n) nodes per pair.
+func rebuildForMerge(n uint64, m int) bool {
+	return uint64(m)*uint64(bits.Len64(n)) >= n+uint64(m)
+}
+
+// storeAll stores values of the iterator and returns them with their keys.
+// The order of keys is checked before the value of each key is stored.
+func (t *Transaction) storeAll(it KeyValueIterator) ([][]byte, []store.Address, error) {
+	keys := [][]byte{}
+	values := []store.Address{}
+
+	for {
+		err := t.ctx.Err()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		k, v, err := it.Next()
+		if err == io.EOF {
+			return keys, values, nil
+		}
+
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "while getting next key/value pair")
+		}
+
+		if len(keys) > 0 && bytes.Compare(keys[len(keys)-1], []byte(k)) >= 0 {
+			return nil, nil, errors.Wrapf(ErrNotSorted, "key %q follows %q", k, keys[len(keys)-1])
+		}
+
+		va, err := t.storeData(v)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keys = append(keys, []byte(k))
+		values = append(values, va)
+	}
+}
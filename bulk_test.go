@@ -0,0 +1,120 @@
+package immersadb_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutAll(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	kvs := []immersadb.KeyValue{}
+	for i := 0; i < 500; i++ {
+		kvs = append(kvs, immersadb.KeyValue{Key: fmt.Sprintf("key-%04d", i), Value: []byte{byte(i)}})
+	}
+
+	t.Run("when I bulk load sorted pairs into a new map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.PutAll("import", immersadb.NewSliceIterator(kvs))
+		})
+		require.NoError(t, err)
+
+		t.Run("then the map should contain all pairs", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			cnt, err := rtx.Count("import")
+			require.NoError(t, err)
+			require.Equal(t, uint64(500), cnt)
+
+			d, err := rtx.Get("import/key-0123")
+			require.NoError(t, err)
+			require.Equal(t, []byte{123}, d)
+		})
+	})
+
+	t.Run("when I bulk load into an existing map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.PutAll("import", immersadb.NewSliceIterator(kvs))
+		})
+		require.Equal(t, immersadb.ErrAlreadyExists, errors.Cause(err))
+	})
+
+	t.Run("when I merge sorted pairs into the existing map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.MergeAll("import", immersadb.NewSliceIterator([]immersadb.KeyValue{
+				{Key: "key-0001", Value: []byte("replaced")},
+				{Key: "key-9999", Value: []byte("added")},
+			}))
+		})
+		require.NoError(t, err)
+
+		t.Run("then existing values should be replaced and new ones added", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			cnt, err := rtx.Count("import")
+			require.NoError(t, err)
+			require.Equal(t, uint64(501), cnt)
+
+			d, err := rtx.Get("import/key-0001")
+			require.NoError(t, err)
+			require.Equal(t, []byte("replaced"), d)
+
+			d, err = rtx.Get("import/key-9999")
+			require.NoError(t, err)
+			require.Equal(t, []byte("added"), d)
+		})
+	})
+
+	t.Run("when I merge as many pairs as the map has", func(t *testing.T) {
+		merged := []immersadb.KeyValue{}
+		for i := 0; i < 500; i++ {
+			merged = append(merged, immersadb.KeyValue{Key: fmt.Sprintf("key-%04d-m", i), Value: []byte("merged")})
+		}
+
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.MergeAll("import", immersadb.NewSliceIterator(merged))
+		})
+		require.NoError(t, err)
+
+		t.Run("then the map should contain the existing and the new pairs", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			cnt, err := rtx.Count("import")
+			require.NoError(t, err)
+			require.Equal(t, uint64(1001), cnt)
+
+			d, err := rtx.Get("import/key-0001")
+			require.NoError(t, err)
+			require.Equal(t, []byte("replaced"), d)
+
+			d, err = rtx.Get("import/key-0499-m")
+			require.NoError(t, err)
+			require.Equal(t, []byte("merged"), d)
+		})
+	})
+
+	t.Run("when I merge unsorted pairs", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.MergeAll("import", immersadb.NewSliceIterator([]immersadb.KeyValue{
+				{Key: "b", Value: []byte{1}},
+				{Key: "a", Value: []byte{2}},
+			}))
+		})
+
+		t.Run("then it should fail with ErrNotSorted", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrNotSorted, errors.Cause(err))
+		})
+	})
+}
@@ -0,0 +1,84 @@
+package immersadb
+
+import (
+	serrors "errors"
+
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+// ErrVersionMismatch is returned by conditional writes when the element at the path
+// doesn't have the expected Hash.
+var ErrVersionMismatch = serrors.New("version mismatch")
+
+// ErrContentHashesRequired is returned by CompareAndSwap and DeleteIfMatch
+// when the database was opened without Options.ContentHashes.
+var ErrContentHashesRequired = serrors.New("conditional writes require content hashes")
+
+// checkHash returns ErrVersionMismatch unless the element at the path has the expected hash.
+// Without stored hashes, the check would read the whole subtree below the path.
+func (t *Transaction) checkHash(path string, expected Hash) error {
+	if !t.st.Format().Hashes {
+		return ErrContentHashesRequired
+	}
+
+	h, err := t.ReadTransaction.Hash(path)
+	if errors.Cause(err) == wbbtree.ErrNotFound {
+		return ErrVersionMismatch
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if h != expected {
+		return ErrVersionMismatch
+	}
+
+	return nil
+}
+
+// PutIfAbsent stores the value at the path, unless something is already stored there,
+// in which case it returns ErrAlreadyExists.
+func (t *Transaction) PutIfAbsent(path string, d []byte) (err error) {
+	defer t.guard(&err)()
+
+	_, err = t.pathElementAddress(path)
+	if err == nil {
+		return ErrAlreadyExists
+	}
+
+	if errors.Cause(err) != wbbtree.ErrNotFound {
+		return err
+	}
+
+	return t.Put(path, d)
+}
+
+// CompareAndSwap stores the value at the path if the element stored there has the expected Hash.
+// Otherwise, also when nothing is stored at the path, it returns ErrVersionMismatch.
+// It requires Options.ContentHashes.
+func (t *Transaction) CompareAndSwap(path string, expected Hash, d []byte) (err error) {
+	defer t.guard(&err)()
+
+	err = t.checkHash(path, expected)
+	if err != nil {
+		return err
+	}
+
+	return t.Put(path, d)
+}
+
+// DeleteIfMatch deletes the element at the path if it has the expected Hash.
+// Otherwise, also when nothing is stored at the path, it returns ErrVersionMismatch.
+// It requires Options.ContentHashes.
+func (t *Transaction) DeleteIfMatch(path string, expected Hash) (err error) {
+	defer t.guard(&err)()
+
+	err = t.checkHash(path, expected)
+	if err != nil {
+		return err
+	}
+
+	return t.Delete(path)
+}
@@ -0,0 +1,174 @@
+package immersadb_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.OpenWithOptions(td, immersadb.Options{ContentHashes: true})
+	require.NoError(t, err)
+	defer func() {
+		db.Close()
+	}()
+
+	hash := func(t *testing.T, path string) immersadb.Hash {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		v, err := rtx.Hash(path)
+		require.NoError(t, err)
+		return v
+	}
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		err := tx.CreateMap("docs")
+		if err != nil {
+			return err
+		}
+		return tx.Put("docs/a", []byte("one"))
+	})
+	require.NoError(t, err)
+
+	v1 := hash(t, "docs/a")
+
+	t.Run("when I get the hash of an unchanged value after other commits", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put("docs/b", make([]byte, 100000))
+			})
+			require.NoError(t, err)
+		}
+
+		t.Run("then it should be the same", func(t *testing.T) {
+			require.Equal(t, v1, hash(t, "docs/a"))
+		})
+	})
+
+	t.Run("when I parse the string of a hash", func(t *testing.T) {
+		v, err := immersadb.ParseHash(v1.String())
+		require.NoError(t, err)
+
+		t.Run("then I should get the same hash", func(t *testing.T) {
+			require.Equal(t, v1, v)
+		})
+	})
+
+	t.Run("when I put a value if absent", func(t *testing.T) {
+		t.Run("then it should be stored if the path is empty", func(t *testing.T) {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.PutIfAbsent("docs/c", []byte("three"))
+			})
+			require.NoError(t, err)
+		})
+
+		t.Run("then it should fail with ErrAlreadyExists if the path exists", func(t *testing.T) {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.PutIfAbsent("docs/a", []byte("other"))
+			})
+			require.Equal(t, immersadb.ErrAlreadyExists, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I compare and swap with the current hash", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.CompareAndSwap("docs/a", v1, []byte("two"))
+		})
+		require.NoError(t, err)
+
+		t.Run("then the value should be replaced", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			d, err := rtx.Get("docs/a")
+			require.NoError(t, err)
+			require.Equal(t, []byte("two"), d)
+		})
+
+		t.Run("then the hash should change", func(t *testing.T) {
+			require.NotEqual(t, v1, hash(t, "docs/a"))
+		})
+
+		t.Run("then the hash of the parent map should change", func(t *testing.T) {
+			v := hash(t, "docs")
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put("docs/a", []byte("three"))
+			})
+			require.NoError(t, err)
+			require.NotEqual(t, v, hash(t, "docs"))
+		})
+	})
+
+	t.Run("when I compare and swap with an outdated hash", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.CompareAndSwap("docs/a", v1, []byte("four"))
+		})
+
+		t.Run("then it should fail with ErrVersionMismatch", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrVersionMismatch, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I compare and swap a missing path", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.CompareAndSwap("docs/x", v1, []byte("four"))
+		})
+
+		t.Run("then it should fail with ErrVersionMismatch", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrVersionMismatch, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I delete with an outdated hash", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.DeleteIfMatch("docs/c", v1)
+		})
+
+		t.Run("then it should fail with ErrVersionMismatch", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrVersionMismatch, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I delete with the current hash", func(t *testing.T) {
+		vc := hash(t, "docs/c")
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.DeleteIfMatch("docs/c", vc)
+		})
+		require.NoError(t, err)
+
+		t.Run("then the value should be deleted", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			exists, err := rtx.Exists("docs/c")
+			require.NoError(t, err)
+			require.False(t, exists)
+		})
+	})
+
+	t.Run("when I reopen the database without stored hashes", func(t *testing.T) {
+		va := hash(t, "docs/a")
+		require.NoError(t, db.Close())
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+
+		t.Run("then hashes should be the same", func(t *testing.T) {
+			require.Equal(t, va, hash(t, "docs/a"))
+		})
+
+		t.Run("then conditional writes should fail with ErrContentHashesRequired", func(t *testing.T) {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.CompareAndSwap("docs/a", va, []byte("five"))
+			})
+			require.Equal(t, immersadb.ErrContentHashesRequired, errors.Cause(err))
+
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.DeleteIfMatch("docs/a", va)
+			})
+			require.Equal(t, immersadb.ErrContentHashesRequired, errors.Cause(err))
+		})
+	})
+}
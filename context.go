@@ -0,0 +1,20 @@
+package immersadb
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader stops reading with the error of ctx once it is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	err := c.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
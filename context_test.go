@@ -0,0 +1,107 @@
+package immersadb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		for _, k := range []string{"a", "b", "c"} {
+			err := tx.Put(k, []byte(k))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("when the context of a read transaction is cancelled", func(t *testing.T) {
+		rtx := db.NewReadTransactionContext(cancelled)
+		defer rtx.Discard()
+
+		t.Run("then Get should fail with the error of the context", func(t *testing.T) {
+			_, err := rtx.Get("a")
+			require.Equal(t, context.Canceled, errors.Cause(err))
+		})
+
+		t.Run("then ForEach should stop with the error of the context", func(t *testing.T) {
+			keys := []string{}
+			err := rtx.ForEach("", func(key string) error {
+				keys = append(keys, key)
+				return nil
+			})
+			require.Equal(t, context.Canceled, errors.Cause(err))
+			require.Empty(t, keys)
+		})
+	})
+
+	t.Run("when a transaction is committed with a cancelled context", func(t *testing.T) {
+		tx, err := db.NewTransactionContext(cancelled)
+		require.NoError(t, err)
+
+		// an empty value is stored without checking the context
+		require.NoError(t, tx.Put("d", []byte{}))
+
+		err = tx.Commit()
+
+		t.Run("then commit should fail with the error of the context", func(t *testing.T) {
+			require.Equal(t, context.Canceled, errors.Cause(err))
+		})
+
+		t.Run("then the database should stay at the old root", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			ex, err := rtx.Exists("d")
+			require.NoError(t, err)
+			require.False(t, ex)
+		})
+
+		t.Run("then new transactions can be started", func(t *testing.T) {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put("d", []byte{1})
+			})
+			require.NoError(t, err)
+		})
+	})
+
+	t.Run("when I close the database while a read transaction is open", func(t *testing.T) {
+		rtx := db.NewReadTransaction()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err = db.CloseContext(ctx)
+
+		t.Run("then closing should stop when the context is done", func(t *testing.T) {
+			require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+		})
+
+		t.Run("then the database should stay usable", func(t *testing.T) {
+			d, err := rtx.Get("a")
+			require.NoError(t, err)
+			require.Equal(t, []byte("a"), d)
+		})
+
+		t.Run("then closing should succeed after the read transaction is discarded", func(t *testing.T) {
+			rtx.Discard()
+			require.NoError(t, db.Close())
+		})
+	})
+}
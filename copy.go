@@ -0,0 +1,122 @@
+package immersadb
+
+import (
+	serrors "errors"
+
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+var ErrMoveIntoItself = serrors.New("can't move a path into itself")
+
+// Copy makes the map or value at src also available at dst, replacing anything stored at dst.
+// Values that expire under src expire at the same time under dst.
+// Since stored data is immutable, only the reference is copied and the copy
+// takes O(log n) regardless of the size of the copied sub-tree.
+func (t *Transaction) Copy(src, dst string) (err error) {
+	defer t.guard(&err)()
+	sa, err := t.pathElementAddress(src)
+	if err != nil {
+		return errors.Wrapf(err, "while looking up %q", src)
+	}
+
+	dstParts, err := dbpath.Split(dst)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", dst)
+	}
+
+	srcParts, err := dbpath.Split(src)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", src)
+	}
+
+	err = t.write(dstParts, func(store.Address) (store.Address, error) {
+		return sa, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.copyExpiry(srcParts, dstParts)
+}
+
+// Move copies the map or value at src to dst and deletes src.
+// dst can be a map containing src, which is then replaced by the element at src.
+// If moving fails, the transaction is left as it was before.
+func (t *Transaction) Move(src, dst string) (err error) {
+	sp := t.Savepoint()
+	defer func() {
+		if err != nil {
+			t.RollbackTo(sp)
+		}
+	}()
+
+	defer t.guard(&err)()
+
+	srcParts, err := dbpath.Split(src)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", src)
+	}
+
+	dstParts, err := dbpath.Split(dst)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", dst)
+	}
+
+	if isPrefix(srcParts, dstParts) {
+		if len(srcParts) == len(dstParts) {
+			return nil
+		}
+		return ErrMoveIntoItself
+	}
+
+	if isPrefix(dstParts, srcParts) {
+		return t.moveToAncestor(srcParts, dstParts)
+	}
+
+	err = t.Copy(src, dst)
+	if err != nil {
+		return err
+	}
+
+	return t.Delete(src)
+}
+
+// moveToAncestor replaces the map at dst with the element at src under it.
+// Replacing dst deletes src, so src is not deleted separately.
+func (t *Transaction) moveToAncestor(src, dst []string) error {
+	sa, err := t.pathElementAddress(dbpath.Join(src...))
+	if err != nil {
+		return errors.Wrapf(err, "while looking up %q", dbpath.Join(src...))
+	}
+
+	// deadlines under src are cleared when dst is replaced
+	expiries, err := t.expiriesMovedTo(src, dst)
+	if err != nil {
+		return err
+	}
+
+	err = t.write(dst, func(store.Address) (store.Address, error) {
+		return sa, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.setExpiries(expiries)
+}
+
+func isPrefix(prefix, parts []string) bool {
+	if len(prefix) > len(parts) {
+		return false
+	}
+
+	for i, p := range prefix {
+		if parts[i] != p {
+			return false
+		}
+	}
+
+	return true
+}
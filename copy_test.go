@@ -0,0 +1,145 @@
+package immersadb_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyAndMove(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		for _, m := range []string{"staging", "staging/batch", "published"} {
+			err := tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Put("staging/batch/item", []byte{1, 2, 3})
+	})
+	require.NoError(t, err)
+
+	t.Run("when I copy a sub-map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Copy("staging/batch", "published/copy")
+		})
+		require.NoError(t, err)
+
+		t.Run("then the data should be available at both paths", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("published/copy/item")
+			require.NoError(t, err)
+			require.Equal(t, []byte{1, 2, 3}, d)
+
+			d, err = rtx.Get("staging/batch/item")
+			require.NoError(t, err)
+			require.Equal(t, []byte{1, 2, 3}, d)
+		})
+	})
+
+	t.Run("when I move a sub-map to another map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Move("staging/batch", "published/batch")
+		})
+		require.NoError(t, err)
+
+		t.Run("then the data should be available at the new path", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("published/batch/item")
+			require.NoError(t, err)
+			require.Equal(t, []byte{1, 2, 3}, d)
+		})
+
+		t.Run("then the old path should not exist", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			ex, err := rtx.Exists("staging/batch")
+			require.NoError(t, err)
+			require.False(t, ex)
+
+			cnt, err := rtx.Count("staging")
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), cnt)
+		})
+	})
+
+	t.Run("when I move a map into itself", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Move("published", "published/batch/nested")
+		})
+		require.Equal(t, immersadb.ErrMoveIntoItself, err)
+	})
+
+	t.Run("when I delete the last value of a map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Delete("published/copy/item")
+		})
+		require.NoError(t, err)
+
+		t.Run("then the map should still exist and be empty", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			cnt, err := rtx.Count("published/copy")
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), cnt)
+		})
+	})
+
+	t.Run("when I move a sub-map to the map containing it", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Move("published/batch", "published")
+		})
+		require.NoError(t, err)
+
+		t.Run("then the map should be replaced by the sub-map", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("published/item")
+			require.NoError(t, err)
+			require.Equal(t, []byte{1, 2, 3}, d)
+
+			for _, p := range []string{"published/batch", "published/copy"} {
+				ex, err := rtx.Exists(p)
+				require.NoError(t, err)
+				require.False(t, ex)
+			}
+		})
+	})
+
+	t.Run("when a move fails", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			err := tx.Put("published/other", []byte{4})
+			require.NoError(t, err)
+
+			err = tx.Move("published/missing", "published")
+			require.Error(t, err)
+
+			t.Run("then the transaction should be left as it was", func(t *testing.T) {
+				d, err := tx.Get("published/other")
+				require.NoError(t, err)
+				require.Equal(t, []byte{4}, d)
+
+				d, err = tx.Get("published/item")
+				require.NoError(t, err)
+				require.Equal(t, []byte{1, 2, 3}, d)
+			})
+
+			return nil
+		})
+		require.NoError(t, err)
+	})
+}
@@ -103,6 +103,14 @@ type DataWriter struct {
 	buffer []byte
 
 	store store.Store
+
+	leafIndex LeafIndex
+}
+
+// LeafIndex maps digests of data leaves to addresses of already stored leaves.
+type LeafIndex interface {
+	Lookup(digest store.Hash) (store.Address, bool)
+	Add(digest store.Hash, a store.Address)
 }
 
 func NewDataWriter(store store.Store, fragSize, fanout int) *DataWriter {
@@ -114,6 +122,44 @@ func NewDataWriter(store store.Store, fragSize, fanout int) *DataWriter {
 	}
 }
 
+// WithLeafIndex makes the writer reuse already stored leaves with the same content
+// instead of storing a new copy.
+func (dw *DataWriter) WithLeafIndex(idx LeafIndex) *DataWriter {
+	dw.leafIndex = idx
+	return dw
+}
+
+func (dw *DataWriter) storeLeaf() (store.Address, error) {
+	if dw.leafIndex == nil {
+		return dw.storeNewLeaf()
+	}
+
+	h := store.LeafDigest(dw.buffer)
+
+	a, found := dw.leafIndex.Lookup(h)
+	if found {
+		return a, nil
+	}
+
+	a, err := dw.storeNewLeaf()
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	dw.leafIndex.Add(h, a)
+
+	return a, nil
+}
+
+func (dw *DataWriter) storeNewLeaf() (store.Address, error) {
+	sw, err := dw.store.CreateSegment(0, store.TypeDataLeaf, 0, len(dw.buffer))
+	if err != nil {
+		return store.NilAddress, err
+	}
+	copy(sw.Data, dw.buffer)
+	return sw.Address, nil
+}
+
 func (dw *DataWriter) Write(d []byte) (int, error) {
 	written := 0
 	for len(d) > 0 {
@@ -130,12 +176,11 @@ func (dw *DataWriter) Write(d []byte) (int, error) {
 		}
 
 		if len(dw.buffer) == dw.fragSize {
-			sw, err := dw.store.CreateSegment(0, store.TypeDataLeaf, 0, len(dw.buffer))
+			la, err := dw.storeLeaf()
 			if err != nil {
 				return -1, errors.Wrap(err, "while storing data leaf")
 			}
-			copy(sw.Data, dw.buffer)
-			err = dw.parentAggregator.addFragment(sw.Address, uint64(len(dw.buffer)))
+			err = dw.parentAggregator.addFragment(la, uint64(len(dw.buffer)))
 			if err != nil {
 				return -1, errors.Wrap(err, "while adding fragment to leaf's parent")
 			}
@@ -148,14 +193,12 @@ func (dw *DataWriter) Write(d []byte) (int, error) {
 
 func (dw *DataWriter) Finish() (store.Address, error) {
 	if len(dw.buffer) > 0 {
-		sw, err := dw.store.CreateSegment(0, store.TypeDataLeaf, 0, len(dw.buffer))
+		la, err := dw.storeLeaf()
 		if err != nil {
 			return store.NilAddress, errors.Wrap(err, "while storing data leaf")
 		}
 
-		copy(sw.Data, dw.buffer)
-
-		err = dw.parentAggregator.addFragment(sw.Address, uint64(len(dw.buffer)))
+		err = dw.parentAggregator.addFragment(la, uint64(len(dw.buffer)))
 		if err != nil {
 			return store.NilAddress, errors.Wrap(err, "while adding data fragmment to it's aggregator")
 		}
@@ -1,8 +1,13 @@
 package immersadb
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/draganm/immersadb/store"
 	"github.com/draganm/immersadb/wbbtree"
@@ -13,74 +18,508 @@ type DB struct {
 	dataSegmentSize int
 	dataFanout      int
 	root            store.Address
+	userRoot        store.Address
+	systemRoot      store.Address
 	st              store.Store
 	txActive        bool
 	dir             string
+	leafIndex       *leafIndex
+	seq             uint64
+	commitCond      *sync.Cond
+	following       bool
+	readOnly        bool
+	manifest        []byte
+	manifestInfo    os.FileInfo
+	recovery        RecoveryReport
+	closed          bool
+	extractors      map[string]IndexExtractor
+	reapInterval    time.Duration
+	reaper          *reaper
+	reaping         bool
 	mu              sync.Mutex
 }
 
+// Options configure a database when it is opened.
+type Options struct {
+	// EncryptionKey enables AES-GCM encryption of stored values, map keys and lists.
+	// It must be 16, 24 or 32 bytes long.
+	// The segment layout (addresses, lengths and sizes) is not encrypted.
+	// Opening an encrypted database fails with ErrWrongKey if none of the keys
+	// was used for it before.
+	EncryptionKey []byte
+
+	// PreviousEncryptionKeys are used to read values written with older keys.
+	// Such values are re-encrypted with EncryptionKey whenever their layer
+	// is compacted or pushed down during a commit.
+	PreviousEncryptionKeys [][]byte
+
+	// Deduplicate enables reuse of already stored data leaves with identical
+	// content. The content index is kept in memory. It is built by the first
+	// transaction that stores a value, which reads every data leaf, or only
+	// their headers if ContentHashes was on when they were written.
+	Deduplicate bool
+
+	// ContentHashes stores the hash of every new map node, list node and value segment,
+	// so that Hash reads it instead of the whole subtree. It adds 32 bytes to every segment.
+	// Segments written without it get their hash computed when it is needed.
+	// CompareAndSwap and DeleteIfMatch require it, so that checking the hash
+	// of an element costs one segment read instead of reading its subtree.
+	ContentHashes bool
+
+	// ReapInterval is the interval at which values stored with PutWithTTL are deleted
+	// once expired. It defaults to one second. The reaper starts with the first value
+	// stored with PutWithTTL and commits only when a deadline has passed.
+	// A negative interval disables the reaper, expired values can then be deleted with ReapExpired.
+	ReapInterval time.Duration
+
+	// FileBackend selects how layer files are accessed. The default FileBackendMmap
+	// maps each file up to the maximum size of its layer. FileBackendPread reads and
+	// writes segments with pread and pwrite, which works under a strict address space
+	// limit and returns ErrIO instead of crashing with SIGBUS.
+	FileBackend FileBackend
+}
+
+// FileBackend selects how layer files are accessed.
+type FileBackend = store.FileBackend
+
+const (
+	FileBackendMmap  = store.FileBackendMmap
+	FileBackendPread = store.FileBackendPread
+)
+
+// defaultFileBackend is used for databases opened with FileBackendMmap, the zero value
+// of Options.FileBackend. Tests change it to run against both backends.
+var defaultFileBackend = FileBackendMmap
+
+func (o Options) fileBackend() FileBackend {
+	if o.FileBackend == FileBackendMmap {
+		return defaultFileBackend
+	}
+	return o.FileBackend
+}
+
+// ErrWrongKey is returned when the database is encrypted and none of the provided keys was used for it.
+var ErrWrongKey = store.ErrWrongKey
+
+var ErrReadOnly = store.ErrReadOnly
+
+var ErrLocked = store.ErrLocked
+
+var ErrCorrupt = store.ErrCorrupt
+
+var ErrClosed = store.ErrClosed
+
+var ErrInvalidAddress = store.ErrInvalidAddress
+
+// ErrIO is returned when a layer file of a database opened with FileBackendPread can't be read.
+var ErrIO = store.ErrIO
+
+// RecoveryReport describes files and bytes that were cleaned up by Open.
+type RecoveryReport = store.RecoveryReport
+
 //  Database file layout:
-//  root - 8 bytes containing address of the root
+//  root - manifest with the address of the root and names and sizes of the layer files
 //  lx-id - layers 1-3
 //  transaction-id - layer 0
+//  lock, lock.readers - lock files of the writer and read only openers
+//  quarantine - layer files of unfinished commits moved away on open
 
 func Open(path string) (*DB, error) {
+	return OpenWithOptions(path, Options{})
+}
+
+// newCipher creates the cipher for the keys of the options.
+// The keys are checked against the key checks of the manifest.
+func newCipher(opts Options, checks []store.KeyCheck) (store.Cipher, error) {
+	if opts.EncryptionKey == nil {
+		if len(checks) != 0 {
+			return nil, errors.Wrap(ErrWrongKey, "database is encrypted and no key was provided")
+		}
+		return nil, nil
+	}
+
+	c, err := store.NewAESGCMCipher(checks, opts.EncryptionKey, opts.PreviousEncryptionKeys...)
+	if err != nil {
+		return nil, errors.Wrap(err, "while creating cipher")
+	}
+
+	return c, nil
+}
 
-	st, err := store.Open(path)
+// keyChecks returns the key checks of the keys of the store, which are kept in the manifest.
+func keyChecks(st store.Store) []store.KeyCheck {
+	c := st.Format().Cipher
+	if c == nil {
+		return nil
+	}
+	return c.KeyChecks()
+}
+
+func OpenWithOptions(path string, opts Options) (*DB, error) {
+	st, report, err := store.OpenAndRecoverWithBackend(path, opts.fileBackend())
 	if err != nil {
 		return nil, errors.Wrap(err, "while opening store")
 	}
 
+	m, _, err := store.ReadManifest(path)
+	if err != nil && err != store.ErrNoManifest {
+		st.Close()
+		return nil, errors.Wrap(err, "while reading manifest")
+	}
+
+	c, err := newCipher(opts, m.Keys)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	return newDB(st, path, report, c, m.Seq, opts)
+}
+
+// OpenInMemory creates an empty database that keeps all data in memory.
+// Nothing is written to disk and the data is lost when the database is closed.
+func OpenInMemory() (*DB, error) {
+	return OpenInMemoryWithOptions(Options{})
+}
+
+// OpenInMemoryWithOptions creates an empty database in memory with options.
+func OpenInMemoryWithOptions(opts Options) (*DB, error) {
+	c, err := newCipher(opts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDB(store.OpenInMemory(), "", RecoveryReport{}, c, 0, opts)
+}
+
+// newDB creates a database for an opened store, which is closed on failure.
+// Databases in memory have an empty dir. The sequence number is the one of the last commit.
+func newDB(st store.Store, dir string, report RecoveryReport, c store.Cipher, seq uint64, opts Options) (*DB, error) {
+	var err error
 	var root store.Address
+
+	st.SetFormat(store.Format{Cipher: c, Hashes: opts.ContentHashes})
 	if st.IsEmpty() {
 		_, err = wbbtree.CreateEmpty(st[1:])
 		if err != nil {
+			st.Close()
 			return nil, errors.Wrap(err, "while creating empty root")
 		}
+
+		// finishes the empty root, which is not followed by another segment
+		err = st.Flush()
+		if err != nil {
+			st.Close()
+			return nil, errors.Wrap(err, "while flushing empty root")
+		}
 	}
 
 	root = st.Root()
 
-	return &DB{
-		root:            root,
+	var li *leafIndex
+	if opts.Deduplicate {
+		li = newLeafIndex()
+	}
+
+	db := &DB{
 		st:              st,
-		dir:             path,
+		dir:             dir,
 		dataSegmentSize: 256 * 1024,
 		dataFanout:      16,
-	}, nil
+		leafIndex:       li,
+		recovery:        report,
+		seq:             seq,
+		reapInterval:    opts.ReapInterval,
+	}
+
+	db.commitCond = sync.NewCond(&db.mu)
+
+	err = db.setRoot(root)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	err = db.writeManifest()
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	db.mu.Lock()
+	db.startReaper()
+	db.mu.Unlock()
+
+	return db, nil
+}
+
+// RecoveryReport returns what was cleaned up when the database was opened.
+func (db *DB) RecoveryReport() RecoveryReport {
+	return db.recovery
+}
+
+// OpenReadOnly opens a database for reading without modifying any of its files.
+// The database can be written by another process at the same time:
+// every new ReadTransaction sees the last root committed by the writer.
+func OpenReadOnly(path string) (*DB, error) {
+	return OpenReadOnlyWithOptions(path, Options{})
+}
+
+// OpenReadOnlyWithOptions opens a database for reading with options.
+// Only the encryption keys and the file backend of the options are used.
+func OpenReadOnlyWithOptions(path string, opts Options) (*DB, error) {
+	// the manifest is replaced on every commit, a stat taken before
+	// reading it tells if it was replaced since
+	fi, err := os.Stat(filepath.Join(path, store.ManifestFileName))
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading manifest")
+	}
+
+	m, d, err := store.ReadManifest(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading manifest")
+	}
+
+	c, err := newCipher(opts, m.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := store.OpenReadOnlyWithBackend(path, m, opts.fileBackend())
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening store")
+	}
+
+	st.SetFormat(store.Format{Cipher: c, Hashes: opts.ContentHashes})
+
+	db := &DB{
+		st:           st,
+		dir:          path,
+		readOnly:     true,
+		manifest:     d,
+		manifestInfo: fi,
+		seq:          m.Seq,
+	}
+
+	db.commitCond = sync.NewCond(&db.mu)
+
+	err = db.setRoot(m.Root)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// writeManifest writes the manifest of the current root.
+// Databases in memory have no manifest.
+// It must be called with db.mu locked.
+func (db *DB) writeManifest() error {
+	if db.dir == "" {
+		return nil
+	}
+
+	err := db.st.WriteBuffered()
+	if err != nil {
+		return errors.Wrap(err, "while writing layers")
+	}
+
+	m := db.st.Manifest(db.root)
+	m.Seq = db.seq
+	m.Keys = keyChecks(db.st)
+
+	err = store.WriteManifest(db.dir, m)
+	if err != nil {
+		return errors.Wrap(err, "while writing manifest")
+	}
+	return nil
 }
 
+// publish switches the database to the root in the store and writes the manifest
+// with the sequence number, which is the commit point. If that fails, the database
+// is switched back to the previous store and root.
+// It must be called with db.mu locked.
+func (db *DB) publish(ns store.Store, root store.Address, seq uint64) error {
+	old, oldRoot, oldUser, oldSystem, oldSeq := db.st, db.root, db.userRoot, db.systemRoot, db.seq
+
+	db.st = ns
+
+	err := db.setRoot(root)
+	if err == nil {
+		db.seq = seq
+		err = db.writeManifest()
+	}
+
+	if err != nil {
+		db.st = old
+		db.root = oldRoot
+		db.userRoot = oldUser
+		db.systemRoot = oldSystem
+		db.seq = oldSeq
+		return err
+	}
+
+	return nil
+}
+
+// deleteReplaced deletes the layers of old that are not used by ns, once they are not used any more.
+func deleteReplaced(old, ns store.Store) {
+	for i := range old {
+		if old[i] != nil && old[i] != ns[i] {
+			go old[i].CloseAndDelete()
+		}
+	}
+}
+
+// refresh switches a read only database to the root in the manifest,
+// if it was changed by the writer.
+// It must be called with db.mu locked.
+func (db *DB) refresh() error {
+	fi, err := os.Stat(filepath.Join(db.dir, store.ManifestFileName))
+	if err != nil {
+		return errors.Wrap(err, "while reading manifest")
+	}
+
+	if sameManifest(fi, db.manifestInfo) {
+		return nil
+	}
+
+	m, d, err := store.ReadManifest(db.dir)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(d, db.manifest) {
+		db.manifestInfo = fi
+		return nil
+	}
+
+	ns, err := db.st.Refresh(db.dir, m)
+	if err != nil {
+		return err
+	}
+
+	old := db.st
+	db.st = ns
+
+	err = db.setRoot(m.Root)
+	if err != nil {
+		db.st = old
+		for i := range ns {
+			if old[i] != ns[i] {
+				go ns[i].CloseContext(context.Background())
+			}
+		}
+		return err
+	}
+
+	for i := range ns {
+		if old[i] != ns[i] {
+			go old[i].CloseContext(context.Background())
+		}
+	}
+
+	db.manifest = d
+	db.manifestInfo = fi
+	db.seq = m.Seq
+
+	return nil
+}
+
+// sameManifest returns true if the manifest was not replaced between both stats.
+// Modification time and size are compared too, since the file of a replaced
+// manifest can be reused by a later one.
+func sameManifest(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// NewReadTransaction returns a transaction reading the last committed root.
+// If the database is closed, methods of the returned transaction return ErrClosed.
 func (db *DB) NewReadTransaction() *ReadTransaction {
+	return db.NewReadTransactionContext(context.Background())
+}
+
+// NewReadTransactionContext returns a read transaction whose methods
+// stop with the error of ctx once it is done.
+func (db *DB) NewReadTransactionContext(ctx context.Context) *ReadTransaction {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.closed {
+		return &ReadTransaction{
+			ctx:    ctx,
+			closed: true,
+		}
+	}
+
+	if db.readOnly {
+		// on failure, keep reading the last known root
+		db.refresh()
+	}
+
 	db.st.StartUse()
 
 	return &ReadTransaction{
-		db.st,
-		db.root,
+		ctx:    ctx,
+		st:     db.st,
+		root:   db.userRoot,
+		system: db.systemRoot,
 	}
 }
 
 func (db *DB) NewTransaction() (*Transaction, error) {
+	return db.NewTransactionContext(context.Background())
+}
+
+// NewTransactionContext starts a transaction whose methods, including Commit,
+// stop with the error of ctx once it is done.
+// A commit stopped this way leaves the database at the old root.
+func (db *DB) NewTransactionContext(ctx context.Context) (*Transaction, error) {
+	return db.newTransactionContext(ctx, false)
+}
+
+// newTransactionContext starts a transaction.
+// Transactions of the reaper are marked with reaping, other transactions wait for them to finish.
+func (db *DB) newTransactionContext(ctx context.Context, reaping bool) (*Transaction, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+
+	for !reaping && db.txActive && db.reaping {
+		db.commitCond.Wait()
+	}
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	if db.following {
+		return nil, ErrFollowing
+	}
+
 	if db.txActive {
 		// TODO add waiting or optimistic tx here
 		return nil, errors.New("there is already a transaction in progress")
 	}
 
-	tx, err := newTransaction(db.st, db.root, db)
+	tx, err := newTransaction(ctx, db)
 	if err != nil {
 		return nil, errors.Wrap(err, "while creating transaction")
 	}
 
 	db.txActive = true
+	db.reaping = reaping
 
 	return tx, nil
 }
 
-func (db *DB) commit(l0 *store.SegmentFile, newRoot store.Address) error {
+func (db *DB) commit(ctx context.Context, txStore store.Store, newRoot store.Address, txIndex *txLeafIndex) error {
+
+	l0 := txStore[0]
 
 	defer func() {
 		go l0.CloseAndDelete()
@@ -96,40 +535,54 @@ func (db *DB) commit(l0 *store.SegmentFile, newRoot store.Address) error {
 	db.txActive = false
 
 	if newRoot == db.root {
+		txStore.FinishUse()
 		return nil
 	}
 
-	txStore := make(store.Store, len(db.st))
-	copy(txStore, db.st)
-	txStore[0] = l0
+	opts := store.CommitOptions{}
+
+	var updateLeafIndex func(oldStore, newStore store.Store)
+	if db.leafIndex != nil {
+		opts.OnMove, updateLeafIndex = db.leafIndex.commitCollector(txIndex)
+	}
 
-	newDBRoot, ns, err := txStore.Commit(newRoot)
+	newDBRoot, ns, err := txStore.CommitWithContext(ctx, newRoot, opts)
 	if err != nil {
+		txStore.FinishUse()
 		return errors.Wrap(err, "while commiting transaction")
 	}
 
 	// TODO close the old store diff
-	// fmt.Println("new root", newDBRoot)
-	db.root = newDBRoot
+	txStore.FinishUse()
+	ns.FinishUse()
 
-	for i := range ns {
-		if db.st[i] != ns[i] {
-			go db.st[i].CloseAndDelete()
-		}
+	old := db.st
+
+	// the manifest is the commit point, old files can be deleted only after it is written
+	err = db.publish(ns, newDBRoot, db.seq+1)
+	if err != nil {
+		deleteReplaced(ns, old)
+		return err
 	}
 
-	txStore.FinishUse()
-	ns.FinishUse()
+	if updateLeafIndex != nil {
+		updateLeafIndex(txStore, ns)
+	}
 
-	db.st = ns
+	db.commitCond.Broadcast()
 
-	return nil
+	// the first value with a deadline starts the reaper
+	db.startReaper()
 
+	deleteReplaced(old, ns)
+
+	return nil
 }
 
-func (db *DB) rollback(l0 *store.SegmentFile) error {
+func (db *DB) rollback(txStore store.Store) error {
 
-	defer l0.CloseAndDelete()
+	txStore.FinishUse()
+	defer txStore[0].CloseAndDelete()
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -144,13 +597,48 @@ func (db *DB) rollback(l0 *store.SegmentFile) error {
 }
 
 func (db *DB) Close() error {
+	return db.CloseContext(context.Background())
+}
+
+// CloseContext closes the database once all read transactions are discarded.
+// If ctx is done before that, the database stays open and the error of ctx is returned.
+func (db *DB) CloseContext(ctx context.Context) error {
+	reaping := db.stopReaper()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.st.Close()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	err := db.st.CloseContext(ctx)
+	if err != nil {
+		if reaping {
+			db.startReaper()
+		}
+		return err
+	}
+
+	db.closed = true
+
+	// a commit made while closing could have started the reaper again,
+	// it stops with ErrClosed and does not have to be waited for
+	if db.reaper != nil {
+		close(db.reaper.stop)
+		db.reaper = nil
+	}
+
+	return nil
 }
 
 func (db *DB) Transaction(f func(tx *Transaction) error) error {
-	tx, err := db.NewTransaction()
+	return db.TransactionContext(context.Background(), f)
+}
+
+// TransactionContext runs f in a transaction created with NewTransactionContext.
+func (db *DB) TransactionContext(ctx context.Context, f func(tx *Transaction) error) error {
+	tx, err := db.NewTransactionContext(ctx)
 	if err != nil {
 		return errors.Wrap(err, "while creating transaction")
 	}
@@ -158,7 +646,7 @@ func (db *DB) Transaction(f func(tx *Transaction) error) error {
 	err = f(tx)
 	if err != nil {
 		rbErr := tx.Rollback()
-		if err != nil {
+		if rbErr != nil {
 			return errors.Wrap(rbErr, "while rolling back transaction")
 		}
 		return err
@@ -171,12 +659,17 @@ func (db *DB) PrintStats() {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	rs := db.st.GetSegment(db.root)
+	live := db.st.LiveLayerSizes(db.root, store.MaxLayers-1)
+
+	var total uint64
+	for _, l := range live {
+		total += l
+	}
 
-	fmt.Println("total data size", rs.GetTotalTreeSize(), "bytes")
+	fmt.Println("total data size", total, "bytes")
 	for i := 1; i < 4; i++ {
 		ub := db.st[i].UsedBytes()
-		lts := rs.GetLayerTotalSize(i)
+		lts := live[i]
 		garbagePercent := 0.0
 		if ub > 0 {
 			garbagePercent = 100.0 * float64(ub-lts) / float64(ub)
@@ -0,0 +1,69 @@
+package dbpath_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatternMatch(t *testing.T) {
+	cases := []struct {
+		title   string
+		pattern string
+		part    string
+		matches bool
+	}{
+		{title: "literal", pattern: "foo", part: "foo", matches: true},
+		{title: "different literal", pattern: "foo", part: "fo", matches: false},
+		{title: "star", pattern: "*", part: "foo", matches: true},
+		{title: "star matches empty", pattern: "foo*", part: "foo", matches: true},
+		{title: "star in the middle", pattern: "f*o", part: "fooo", matches: true},
+		{title: "star matches slash", pattern: "a*", part: "a/b", matches: true},
+		{title: "question mark", pattern: "f?o", part: "fxo", matches: true},
+		{title: "question mark matches one character", pattern: "f?o", part: "fo", matches: false},
+		{title: "question mark matches unicode character", pattern: "?", part: "ä", matches: true},
+		{title: "class", pattern: "[a-c]x", part: "bx", matches: true},
+		{title: "class not matching", pattern: "[a-c]x", part: "dx", matches: false},
+		{title: "negated class", pattern: "[!a-c]x", part: "dx", matches: true},
+		{title: "escaped star", pattern: "a%2A", part: "a*", matches: true},
+		{title: "escaped star is literal", pattern: "a%2A", part: "ab", matches: false},
+		{title: "escaped slash", pattern: "a%2Fb", part: "a/b", matches: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.title, func(t *testing.T) {
+			pp, err := dbpath.ParsePattern(tc.pattern)
+			require.NoError(t, err)
+			require.Len(t, pp, 1)
+			require.Equal(t, tc.matches, pp[0].Match(tc.part))
+		})
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	t.Run("when I parse a pattern with several parts", func(t *testing.T) {
+		pp, err := dbpath.ParsePattern("/users/**/**/sess*/")
+		require.NoError(t, err)
+
+		t.Run("then empty parts should be dropped and ** merged", func(t *testing.T) {
+			require.Len(t, pp, 3)
+			require.True(t, pp[0].IsLiteral())
+			require.True(t, pp[1].IsAnyDepth())
+			require.False(t, pp[2].IsLiteral())
+		})
+
+		t.Run("then the literal prefix should be known", func(t *testing.T) {
+			require.Equal(t, "users", pp[0].Prefix())
+			require.Equal(t, "sess", pp[2].Prefix())
+		})
+	})
+
+	t.Run("when I parse a pattern with an unterminated class", func(t *testing.T) {
+		_, err := dbpath.ParsePattern("a/[bc")
+
+		t.Run("then it should fail", func(t *testing.T) {
+			require.Error(t, err)
+		})
+	})
+}
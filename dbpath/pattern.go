@@ -0,0 +1,218 @@
+package dbpath
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// PatternPart matches one part of a path, or any number of parts for "**".
+// Within a part, "*" matches any sequence of characters, "?" matches a single character
+// and "[...]" matches a single character of a class such as "[a-z0-9]" or "[!0-9]".
+// Escaped characters, such as "%2A" for "*", are matched literally.
+type PatternPart struct {
+	anyDepth bool
+	elements []patternElement
+}
+
+type elementKind int
+
+const (
+	elementLiteral elementKind = iota
+	elementStar
+	elementQuestion
+	elementClass
+)
+
+type patternElement struct {
+	kind    elementKind
+	literal string
+	ranges  []runeRange
+	negated bool
+}
+
+type runeRange struct {
+	from, to rune
+}
+
+// ParsePattern splits the pattern into its parts.
+// Empty parts are dropped and consecutive "**" parts are merged into one.
+func ParsePattern(pattern string) ([]PatternPart, error) {
+	res := []PatternPart{}
+	for i, p := range strings.Split(pattern, Separator) {
+		if p == "" {
+			continue
+		}
+
+		if p == "**" {
+			if len(res) > 0 && res[len(res)-1].anyDepth {
+				continue
+			}
+			res = append(res, PatternPart{anyDepth: true})
+			continue
+		}
+
+		pp, err := parsePatternPart(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while parsing pattern part at position %d: %q", i, p)
+		}
+		res = append(res, pp)
+	}
+	return res, nil
+}
+
+func parsePatternPart(p string) (PatternPart, error) {
+	elements := []patternElement{}
+	literal := []byte{}
+
+	flushLiteral := func() {
+		if len(literal) > 0 {
+			elements = append(elements, patternElement{kind: elementLiteral, literal: string(literal)})
+			literal = []byte{}
+		}
+	}
+
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '*':
+			flushLiteral()
+			if len(elements) == 0 || elements[len(elements)-1].kind != elementStar {
+				elements = append(elements, patternElement{kind: elementStar})
+			}
+		case '?':
+			flushLiteral()
+			elements = append(elements, patternElement{kind: elementQuestion})
+		case '[':
+			flushLiteral()
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return PatternPart{}, errors.New("unterminated character class")
+			}
+			ce, err := parseClass(p[i+1 : i+1+end])
+			if err != nil {
+				return PatternPart{}, err
+			}
+			elements = append(elements, ce)
+			i += end + 1
+		case '%':
+			if i+2 >= len(p) {
+				return PatternPart{}, errors.Errorf("invalid escape %q", p[i:])
+			}
+			c, err := UnescapePart(p[i : i+3])
+			if err != nil {
+				return PatternPart{}, err
+			}
+			literal = append(literal, c...)
+			i += 2
+		default:
+			literal = append(literal, p[i])
+		}
+	}
+
+	flushLiteral()
+
+	return PatternPart{elements: elements}, nil
+}
+
+func parseClass(c string) (patternElement, error) {
+	e := patternElement{kind: elementClass}
+
+	if strings.HasPrefix(c, "!") || strings.HasPrefix(c, "^") {
+		e.negated = true
+		c = c[1:]
+	}
+
+	uc, err := UnescapePart(c)
+	if err != nil {
+		return e, err
+	}
+
+	runes := []rune(uc)
+	if len(runes) == 0 {
+		return e, errors.New("empty character class")
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runeRange{runes[i], runes[i]}
+		if i+2 < len(runes) && runes[i+1] == '-' {
+			r.to = runes[i+2]
+			i += 2
+		}
+		if r.from > r.to {
+			return e, errors.Errorf("invalid character range %q-%q", r.from, r.to)
+		}
+		e.ranges = append(e.ranges, r)
+	}
+
+	return e, nil
+}
+
+// IsAnyDepth returns true for the "**" part, which matches any number of path parts.
+func (p PatternPart) IsAnyDepth() bool {
+	return p.anyDepth
+}
+
+// IsLiteral returns true if the part matches only the string returned by Prefix.
+func (p PatternPart) IsLiteral() bool {
+	return !p.anyDepth && len(p.elements) == 1 && p.elements[0].kind == elementLiteral
+}
+
+// Prefix returns the literal prefix every part matched by p starts with.
+func (p PatternPart) Prefix() string {
+	if len(p.elements) > 0 && p.elements[0].kind == elementLiteral {
+		return p.elements[0].literal
+	}
+	return ""
+}
+
+// Match returns true if the path part matches p.
+func (p PatternPart) Match(part string) bool {
+	if p.anyDepth {
+		return true
+	}
+	return matchElements(p.elements, part)
+}
+
+func matchElements(elements []patternElement, s string) bool {
+	for len(elements) > 0 {
+		e := elements[0]
+		switch e.kind {
+		case elementLiteral:
+			if !strings.HasPrefix(s, e.literal) {
+				return false
+			}
+			s = s[len(e.literal):]
+		case elementStar:
+			if len(elements) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchElements(elements[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		default:
+			if s == "" {
+				return false
+			}
+			r, size := utf8.DecodeRuneInString(s)
+			if e.kind == elementClass && !e.matchesRune(r) {
+				return false
+			}
+			s = s[size:]
+		}
+		elements = elements[1:]
+	}
+	return s == ""
+}
+
+func (e patternElement) matchesRune(r rune) bool {
+	for _, rr := range e.ranges {
+		if r >= rr.from && r <= rr.to {
+			return !e.negated
+		}
+	}
+	return e.negated
+}
@@ -0,0 +1,162 @@
+package immersadb
+
+import (
+	"sync"
+
+	"github.com/draganm/immersadb/store"
+)
+
+// leafIndex maps digests of committed data leaves to their addresses.
+// It is kept in memory only: it is built from the committed tree by the first
+// transaction that looks up a leaf, and updated after every commit with the
+// leaves of the layers the commit replaced.
+type leafIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	byHash map[store.Hash]store.Address
+	// addresses of indexed leaves with their digests, by layer
+	byLayer []map[store.Address]store.Hash
+}
+
+func newLeafIndex() *leafIndex {
+	li := &leafIndex{}
+	li.reset()
+	return li
+}
+
+func (li *leafIndex) reset() {
+	li.byHash = map[store.Hash]store.Address{}
+	li.byLayer = make([]map[store.Address]store.Hash, store.MaxLayers)
+	for i := range li.byLayer {
+		li.byLayer[i] = map[store.Address]store.Hash{}
+	}
+}
+
+// add must be called with li.mu locked.
+func (li *leafIndex) add(h store.Hash, a store.Address) {
+	li.byHash[h] = a
+	li.byLayer[a.Segment()][a] = h
+}
+
+// load builds the index from the committed tree, unless it was built already.
+// It must be called with li.mu locked.
+func (li *leafIndex) load(st store.Store, root store.Address) {
+	if li.loaded {
+		return
+	}
+
+	li.reset()
+
+	st.ForEachLeaf(root, func(a store.Address, h store.Hash) {
+		li.add(h, a)
+	})
+
+	li.loaded = true
+}
+
+func (li *leafIndex) lookup(st store.Store, root store.Address, h store.Hash) (store.Address, bool) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	li.load(st, root)
+
+	a, found := li.byHash[h]
+	return a, found
+}
+
+// newTransactionIndex creates an index for a transaction that started from the committed root.
+// Leaves stored by the transaction are only visible to it until commit.
+func (li *leafIndex) newTransactionIndex(st store.Store, root store.Address) *txLeafIndex {
+	return &txLeafIndex{
+		committed: li,
+		st:        st,
+		root:      root,
+		added:     map[store.Hash]store.Address{},
+		addedAt:   map[store.Address]bool{},
+	}
+}
+
+// commitCollector returns a function that records moves of indexed leaves
+// during a commit and a function that applies them to the index once the
+// commit has finished.
+func (li *leafIndex) commitCollector(tx *txLeafIndex) (func(from, to store.Address), func(oldStore, newStore store.Store)) {
+	moved := map[store.Address]store.Address{}
+
+	onMove := func(from, to store.Address) {
+		if tx != nil && tx.addedAt[from] {
+			moved[from] = to
+			return
+		}
+
+		li.mu.Lock()
+		_, indexed := li.byLayer[from.Segment()][from]
+		li.mu.Unlock()
+
+		if indexed {
+			moved[from] = to
+		}
+	}
+
+	apply := func(oldStore, newStore store.Store) {
+		li.mu.Lock()
+		defer li.mu.Unlock()
+
+		// an index that was not loaded yet is built from the new tree
+		if !li.loaded {
+			return
+		}
+
+		// leaves of replaced layers were either moved or garbage collected
+		replaced := map[store.Address]store.Hash{}
+		for l := range li.byLayer {
+			if l < len(oldStore) && l < len(newStore) && oldStore[l] == newStore[l] {
+				continue
+			}
+
+			for a, h := range li.byLayer[l] {
+				replaced[a] = h
+				if li.byHash[h] == a {
+					delete(li.byHash, h)
+				}
+			}
+
+			li.byLayer[l] = map[store.Address]store.Hash{}
+		}
+
+		if tx != nil {
+			for h, a := range tx.added {
+				replaced[a] = h
+			}
+		}
+
+		for a, h := range replaced {
+			na, found := moved[a]
+			if found {
+				li.add(h, na)
+			}
+		}
+	}
+
+	return onMove, apply
+}
+
+type txLeafIndex struct {
+	committed *leafIndex
+	st        store.Store
+	root      store.Address
+	added     map[store.Hash]store.Address
+	addedAt   map[store.Address]bool
+}
+
+func (t *txLeafIndex) Lookup(h store.Hash) (store.Address, bool) {
+	a, found := t.added[h]
+	if found {
+		return a, true
+	}
+	return t.committed.lookup(t.st, t.root, h)
+}
+
+func (t *txLeafIndex) Add(h store.Hash, a store.Address) {
+	t.added[h] = a
+	t.addedAt[a] = true
+}
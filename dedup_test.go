@@ -0,0 +1,80 @@
+package immersadb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeduplication(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	db, err := OpenWithOptions(td, Options{Deduplicate: true})
+	require.NoError(t, err)
+
+	blob := []byte("the same blob stored under different paths")
+
+	valueAddress := func(t *testing.T, db *DB, path string) uint64 {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		a, err := rtx.pathElementAddress(path)
+		require.NoError(t, err)
+		return uint64(a)
+	}
+
+	t.Run("when I put the same value twice in a transaction", func(t *testing.T) {
+		err = db.Transaction(func(tx *Transaction) error {
+			err := tx.Put("a", blob)
+			if err != nil {
+				return err
+			}
+			return tx.Put("b", blob)
+		})
+		require.NoError(t, err)
+
+		t.Run("then both paths should share the data", func(t *testing.T) {
+			require.Equal(t, valueAddress(t, db, "a"), valueAddress(t, db, "b"))
+		})
+	})
+
+	t.Run("when I put the same value in another transaction", func(t *testing.T) {
+		err = db.Transaction(func(tx *Transaction) error {
+			return tx.Put("c", blob)
+		})
+		require.NoError(t, err)
+
+		t.Run("then it should share the committed data", func(t *testing.T) {
+			require.Equal(t, valueAddress(t, db, "a"), valueAddress(t, db, "c"))
+		})
+
+		t.Run("then the value should be readable", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			d, err := rtx.Get("c")
+			require.NoError(t, err)
+			require.Equal(t, blob, d)
+		})
+	})
+
+	t.Run("when I reopen the database and put the same value", func(t *testing.T) {
+		err = db.Close()
+		require.NoError(t, err)
+
+		db, err = OpenWithOptions(td, Options{Deduplicate: true})
+		require.NoError(t, err)
+		defer db.Close()
+
+		err = db.Transaction(func(tx *Transaction) error {
+			return tx.Put("d", blob)
+		})
+		require.NoError(t, err)
+
+		t.Run("then it should share the data stored before reopening", func(t *testing.T) {
+			require.Equal(t, valueAddress(t, db, "a"), valueAddress(t, db, "d"))
+		})
+	})
+}
@@ -0,0 +1,194 @@
+package immersadb_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+
+	db, err := immersadb.OpenWithOptions(td, immersadb.Options{EncryptionKey: oldKey})
+	require.NoError(t, err)
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		return tx.Put("secret", []byte("attack at dawn"))
+	})
+	require.NoError(t, err)
+
+	t.Run("then the value should be readable with the key", func(t *testing.T) {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+
+		d, err := rtx.Get("secret")
+		require.NoError(t, err)
+		require.Equal(t, []byte("attack at dawn"), d)
+	})
+
+	err = db.Close()
+	require.NoError(t, err)
+
+	t.Run("when I open the database with a wrong key", func(t *testing.T) {
+		_, err := immersadb.OpenWithOptions(td, immersadb.Options{EncryptionKey: newKey})
+
+		t.Run("then opening should fail with ErrWrongKey", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrWrongKey, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I open the database without a key", func(t *testing.T) {
+		_, err := immersadb.Open(td)
+
+		t.Run("then opening should fail with ErrWrongKey", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrWrongKey, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I open the database with a new key and the old one as previous", func(t *testing.T) {
+		db, err := immersadb.OpenWithOptions(td, immersadb.Options{
+			EncryptionKey:          newKey,
+			PreviousEncryptionKeys: [][]byte{oldKey},
+		})
+		require.NoError(t, err)
+		defer db.Close()
+
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("other", []byte("retreat at dusk"))
+		})
+		require.NoError(t, err)
+
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+
+		d, err := rtx.Get("secret")
+		require.NoError(t, err)
+		require.Equal(t, []byte("attack at dawn"), d)
+
+		d, err = rtx.Get("other")
+		require.NoError(t, err)
+		require.Equal(t, []byte("retreat at dusk"), d)
+
+		t.Run("then a read only opener with the same keys should read both values", func(t *testing.T) {
+			ro, err := immersadb.OpenReadOnlyWithOptions(td, immersadb.Options{
+				EncryptionKey:          newKey,
+				PreviousEncryptionKeys: [][]byte{oldKey},
+			})
+			require.NoError(t, err)
+			defer ro.Close()
+
+			rtx := ro.NewReadTransaction()
+			defer rtx.Discard()
+
+			for k, v := range map[string]string{"secret": "attack at dawn", "other": "retreat at dusk"} {
+				d, err := rtx.Get(k)
+				require.NoError(t, err)
+				require.Equal(t, []byte(v), d)
+			}
+		})
+	})
+}
+
+func TestEncryptionWithPreadFileBackend(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	opts := immersadb.Options{
+		FileBackend:   immersadb.FileBackendPread,
+		EncryptionKey: []byte("0123456789abcdef"),
+	}
+
+	db, err := immersadb.OpenWithOptions(td, opts)
+	require.NoError(t, err)
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		return tx.Put("secret", []byte("attack at dawn"))
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Close())
+
+	t.Run("when the database is reopened with the key", func(t *testing.T) {
+		db, err := immersadb.OpenWithOptions(td, opts)
+		require.NoError(t, err)
+		defer db.Close()
+
+		t.Run("then the value should be readable", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("secret")
+			require.NoError(t, err)
+			require.Equal(t, []byte("attack at dawn"), d)
+		})
+	})
+}
+
+func TestEncryptionKeepsPlaintextOutOfFiles(t *testing.T) {
+	for _, backend := range []immersadb.FileBackend{immersadb.FileBackendMmap, immersadb.FileBackendPread} {
+		t.Run(backend.String(), func(t *testing.T) {
+			td, cleanup := createTempDir(t)
+			defer cleanup()
+
+			db, err := immersadb.OpenWithOptions(td, immersadb.Options{
+				FileBackend:   backend,
+				EncryptionKey: []byte("0123456789abcdef"),
+			})
+			require.NoError(t, err)
+			defer db.Close()
+
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put("KEYSECRETCOMMITTED", []byte("VALUESECRETCOMMITTED"))
+			})
+			require.NoError(t, err)
+
+			t.Run("when a transaction is open", func(t *testing.T) {
+				tx, err := db.NewTransaction()
+				require.NoError(t, err)
+				defer tx.Rollback()
+
+				err = tx.Put("KEYSECRETOPEN", []byte("VALUESECRETOPEN"))
+				require.NoError(t, err)
+
+				t.Run("then no file should contain a key or a value in plaintext", func(t *testing.T) {
+					err := filepath.Walk(td, func(path string, info os.FileInfo, err error) error {
+						// files of committed transactions are deleted in the background
+						if os.IsNotExist(err) {
+							return nil
+						}
+
+						if err != nil || info.IsDir() {
+							return err
+						}
+
+						d, err := ioutil.ReadFile(path)
+						if os.IsNotExist(err) {
+							return nil
+						}
+
+						if err != nil {
+							return err
+						}
+
+						for _, secret := range []string{"KEYSECRET", "VALUESECRET"} {
+							require.False(t, bytes.Contains(d, []byte(secret)), "%s contains %s", info.Name(), secret)
+						}
+
+						return nil
+					})
+					require.NoError(t, err)
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package immersadb_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrors(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		return tx.Put("value", []byte{1})
+	})
+	require.NoError(t, err)
+
+	t.Run("when I use a discarded read transaction", func(t *testing.T) {
+		rtx := db.NewReadTransaction()
+		rtx.Discard()
+
+		_, err := rtx.Get("value")
+		t.Run("then it should fail with ErrClosed", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrClosed, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I use a committed transaction", func(t *testing.T) {
+		tx, err := db.NewTransaction()
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+
+		t.Run("then writing should fail with ErrClosed", func(t *testing.T) {
+			err = tx.Put("value", []byte{2})
+			require.Equal(t, immersadb.ErrClosed, errors.Cause(err))
+		})
+
+		t.Run("then committing again should fail with ErrClosed", func(t *testing.T) {
+			err = tx.Commit()
+			require.Equal(t, immersadb.ErrClosed, errors.Cause(err))
+		})
+	})
+
+	require.NoError(t, db.Close())
+
+	t.Run("when I use a closed database", func(t *testing.T) {
+		t.Run("then read transactions should fail with ErrClosed", func(t *testing.T) {
+			_, err := db.NewReadTransaction().Get("value")
+			require.Equal(t, immersadb.ErrClosed, errors.Cause(err))
+		})
+
+		t.Run("then starting a transaction should fail with ErrClosed", func(t *testing.T) {
+			_, err := db.NewTransaction()
+			require.Equal(t, immersadb.ErrClosed, errors.Cause(err))
+		})
+	})
+
+	t.Run("when a segment of the database points to a not existing address", func(t *testing.T) {
+		m := store.Manifest{}
+		md, err := ioutil.ReadFile(filepath.Join(td, store.ManifestFileName))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(md, &m))
+
+		// overwrite the children of the root map node
+		f, err := os.OpenFile(filepath.Join(td, m.Layers[m.Root.Segment()].Name), os.O_RDWR, 0600)
+		require.NoError(t, err)
+		invalid := make([]byte, 3*8)
+		for i := 0; i < 3; i++ {
+			binary.BigEndian.PutUint64(invalid[i*8:], uint64(store.NewAddress(3, 1<<50)))
+		}
+		_, err = f.WriteAt(invalid, int64(m.Root.Position())+4+1+4*8+1)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+		defer db.Close()
+
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+
+		_, err = rtx.Get("value")
+
+		t.Run("then reading should fail with ErrInvalidAddress", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrInvalidAddress, errors.Cause(err))
+		})
+	})
+}
@@ -0,0 +1,424 @@
+package immersadb
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbblist"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+// Export format is newline delimited JSON.
+// The first line is a header:
+//   {"format":"immersadb-export","version":1}
+// It is followed by one record per map, list and value in pre-order, so
+// every parent precedes its children:
+//   {"path":"users","type":"map"}
+//   {"path":"users/alice%2Fbob","type":"value","text":"hello"}
+//   {"path":"events","type":"list"}
+//   {"path":"events/0","type":"value","data":"AAEC"}
+// Paths are relative to the exported path, with every part escaped with dbpath.EscapePart.
+// The exported element itself has the empty path. Elements of lists are
+// addressed by their index. Values that are valid UTF-8 are written as text,
+// others as base64 encoded data.
+
+const exportFormat = "immersadb-export"
+
+const exportVersion = 1
+
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type exportRecord struct {
+	Path string  `json:"path"`
+	Type string  `json:"type"`
+	Text *string `json:"text,omitempty"`
+	Data []byte  `json:"data,omitempty"`
+}
+
+const (
+	recordTypeMap   = "map"
+	recordTypeList  = "list"
+	recordTypeValue = "value"
+)
+
+// Export writes the map, list or value at the path and everything below it to w.
+// Expired values are left out.
+func (t *ReadTransaction) Export(path string, w io.Writer) (err error) {
+	defer t.guard(&err)()
+	base, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	a, err := t.pathElementAddress(path)
+	if err != nil {
+		return errors.Wrapf(err, "while looking up %q", path)
+	}
+
+	expired, err := t.expiryCheck()
+	if err != nil {
+		return errors.Wrap(err, "while checking expiry")
+	}
+
+	// parts of exported records are relative to the exported path
+	expiredUnder := func(parts []string) (bool, error) {
+		return expired(append(base[:len(base):len(base)], parts...))
+	}
+
+	enc := json.NewEncoder(w)
+
+	err = enc.Encode(exportHeader{Format: exportFormat, Version: exportVersion})
+	if err != nil {
+		return errors.Wrap(err, "while writing header")
+	}
+
+	return t.export(enc, a, nil, expiredUnder)
+}
+
+func (t *ReadTransaction) export(enc *json.Encoder, a store.Address, parts []string, expired func(parts []string) (bool, error)) error {
+	err := t.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	kind, err := t.kindOf(a)
+	if err != nil {
+		return err
+	}
+
+	rec := exportRecord{
+		Path: dbpath.Join(parts...),
+	}
+
+	switch kind {
+	case kindMap:
+		rec.Type = recordTypeMap
+		err = enc.Encode(rec)
+		if err != nil {
+			return errors.Wrapf(err, "while writing record for %q", rec.Path)
+		}
+		return wbbtree.ForEach(t.st, a, func(k []byte, ca store.Address) error {
+			cparts := append(parts[:len(parts):len(parts)], string(k))
+
+			exp, err := expired(cparts)
+			if err != nil || exp {
+				return err
+			}
+
+			return t.export(enc, ca, cparts, expired)
+		})
+	case kindList:
+		rec.Type = recordTypeList
+		err = enc.Encode(rec)
+		if err != nil {
+			return errors.Wrapf(err, "while writing record for %q", rec.Path)
+		}
+		return wbblist.ForEach(t.st, a, func(i uint64, ca store.Address) error {
+			return t.export(enc, ca, append(parts[:len(parts):len(parts)], strconv.FormatUint(i, 10)), expired)
+		})
+	default:
+		d, err := t.readData(a)
+		if err != nil {
+			return errors.Wrapf(err, "while reading value %q", rec.Path)
+		}
+		rec.Type = recordTypeValue
+		if utf8.Valid(d) {
+			text := string(d)
+			rec.Text = &text
+		} else {
+			rec.Data = d
+		}
+		err = enc.Encode(rec)
+		if err != nil {
+			return errors.Wrapf(err, "while writing record for %q", rec.Path)
+		}
+		return nil
+	}
+}
+
+// Import reads data written by Export and stores it at the path.
+// Maps and lists that already exist are merged with the imported ones:
+// existing values and list elements are replaced and new ones are added.
+func (t *Transaction) Import(path string, r io.Reader) (err error) {
+	defer t.guard(&err)()
+	base, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	dec := json.NewDecoder(r)
+
+	h := exportHeader{}
+	err = dec.Decode(&h)
+	if err != nil {
+		return errors.Wrap(err, "while reading header")
+	}
+
+	if h.Format != exportFormat {
+		return errors.Errorf("unsupported format %q", h.Format)
+	}
+
+	if h.Version != exportVersion {
+		return errors.Errorf("unsupported version %d", h.Version)
+	}
+
+	lists := map[string]bool{}
+
+	rr := &recordReader{dec: dec}
+
+	for {
+		err = t.ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		rec, ok, err := rr.read()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return nil
+		}
+
+		err = t.importRecord(base, rec, rr, lists)
+		if err != nil {
+			return errors.Wrapf(err, "while importing %q", rec.Path)
+		}
+	}
+}
+
+// recordReader reads records of an export and lets the next one be looked at before reading it.
+type recordReader struct {
+	dec  *json.Decoder
+	next *exportRecord
+}
+
+// peek returns the next record without reading it. It returns false at the end of the export.
+func (r *recordReader) peek() (exportRecord, bool, error) {
+	if r.next != nil {
+		return *r.next, true, nil
+	}
+
+	rec := exportRecord{}
+	err := r.dec.Decode(&rec)
+	if err == io.EOF {
+		return exportRecord{}, false, nil
+	}
+
+	if err != nil {
+		return exportRecord{}, false, errors.Wrap(err, "while reading record")
+	}
+
+	r.next = &rec
+
+	return rec, true, nil
+}
+
+// read returns the next record. It returns false at the end of the export.
+func (r *recordReader) read() (exportRecord, bool, error) {
+	rec, ok, err := r.peek()
+	r.next = nil
+	return rec, ok, err
+}
+
+func (t *Transaction) importRecord(base []string, rec exportRecord, rr *recordReader, lists map[string]bool) error {
+	parts, err := dbpath.Split(rec.Path)
+	if err != nil {
+		return err
+	}
+
+	fullPath := dbpath.Join(append(base[:len(base):len(base)], parts...)...)
+
+	if len(parts) > 0 && lists[dbpath.Join(parts[:len(parts)-1]...)] {
+		parentPath := dbpath.Join(append(base[:len(base):len(base)], parts[:len(parts)-1]...)...)
+
+		at, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "while parsing list index")
+		}
+
+		// list elements can't be addressed by path, so maps and lists
+		// are built with all records under them before they are stored
+		ea, err := t.importElement(rec, parts, rr)
+		if err != nil {
+			return err
+		}
+
+		return t.setListElement(parentPath, at, ea)
+	}
+
+	switch rec.Type {
+	case recordTypeMap:
+		if len(base)+len(parts) == 0 {
+			return nil
+		}
+		err = t.CreateMap(fullPath)
+		if errors.Cause(err) == ErrAlreadyExists {
+			return nil
+		}
+		return err
+	case recordTypeList:
+		lists[dbpath.Join(parts...)] = true
+		err = t.CreateList(fullPath)
+		if errors.Cause(err) == ErrAlreadyExists {
+			return nil
+		}
+		return err
+	case recordTypeValue:
+		return t.Put(fullPath, rec.value())
+	default:
+		return errors.Errorf("unknown record type %q", rec.Type)
+	}
+}
+
+// importElement stores the element of the record, which is at the path of parts,
+// together with the elements of the records under it that follow it.
+func (t *Transaction) importElement(rec exportRecord, parts []string, rr *recordReader) (store.Address, error) {
+	err := t.ctx.Err()
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	var ea store.Address
+
+	switch rec.Type {
+	case recordTypeValue:
+		return t.storeData(rec.value())
+	case recordTypeMap:
+		ea, err = wbbtree.CreateEmpty(t.st)
+	case recordTypeList:
+		ea, err = wbblist.CreateEmpty(t.st)
+	default:
+		return store.NilAddress, errors.Errorf("unknown record type %q", rec.Type)
+	}
+
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	for {
+		child, ok, err := rr.peek()
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if !ok {
+			return ea, nil
+		}
+
+		cparts, err := dbpath.Split(child.Path)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if len(cparts) != len(parts)+1 || !isPrefix(parts, cparts) {
+			return ea, nil
+		}
+
+		rr.read()
+
+		ca, err := t.importElement(child, cparts, rr)
+		if err != nil {
+			return store.NilAddress, errors.Wrapf(err, "while importing %q", child.Path)
+		}
+
+		key := cparts[len(cparts)-1]
+
+		if rec.Type == recordTypeMap {
+			ea, err = wbbtree.Insert(t.st, ea, []byte(key), ca)
+			if err != nil {
+				return store.NilAddress, err
+			}
+			continue
+		}
+
+		at, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while parsing list index")
+		}
+
+		cnt, err := wbblist.Count(t.st, ea)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if at != cnt {
+			return store.NilAddress, errors.Errorf("element %d does not follow the %d elements of the list", at, cnt)
+		}
+
+		ea, err = wbblist.Insert(t.st, ea, at, ca)
+		if err != nil {
+			return store.NilAddress, err
+		}
+	}
+}
+
+// setListElement replaces the element of the list at the index with the element at ea
+// or appends it, if the index is the length of the list.
+func (t *Transaction) setListElement(path string, at uint64, ea store.Address) error {
+	return t.modifyList(path, func(la store.Address) (store.Address, error) {
+		return setListElement(t.st, la, at, ea)
+	})
+}
+
+// setListElement replaces the element of the list at la like Transaction.setListElement
+// and returns the address of the new list.
+func setListElement(st store.Store, la store.Address, at uint64, ea store.Address) (store.Address, error) {
+	cnt, err := wbblist.Count(st, la)
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	if at > cnt {
+		return store.NilAddress, errors.Errorf("element %d does not follow the %d elements of the list", at, cnt)
+	}
+
+	if at < cnt {
+		la, err = wbblist.Delete(st, la, at)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if la == store.NilAddress {
+			la, err = wbblist.CreateEmpty(st)
+			if err != nil {
+				return store.NilAddress, err
+			}
+		}
+	}
+
+	return wbblist.Insert(st, la, at, ea)
+}
+
+func (r exportRecord) value() []byte {
+	if r.Text != nil {
+		return []byte(*r.Text)
+	}
+
+	if r.Data == nil {
+		return []byte{}
+	}
+
+	return r.Data
+}
+
+func (db *DB) Export(path string, w io.Writer) error {
+	rtx := db.NewReadTransaction()
+	defer rtx.Discard()
+	return rtx.Export(path, w)
+}
+
+func (db *DB) Import(path string, r io.Reader) error {
+	return db.Transaction(func(tx *Transaction) error {
+		return tx.Import(path, r)
+	})
+}
@@ -0,0 +1,6 @@
+package immersadb
+
+// SetDefaultFileBackend changes the backend of databases opened without one.
+func SetDefaultFileBackend(b FileBackend) {
+	defaultFileBackend = b
+}
@@ -0,0 +1,185 @@
+package immersadb_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	srcDir, cleanupSrc := createTempDir(t)
+	defer cleanupSrc()
+
+	dstDir, cleanupDst := createTempDir(t)
+	defer cleanupDst()
+
+	src, err := immersadb.Open(srcDir)
+	require.NoError(t, err)
+	defer src.Close()
+
+	err = src.Transaction(func(tx *immersadb.Transaction) error {
+		for _, m := range []string{"data", "data/users", "data/users/alice%2Fbob"} {
+			err := tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Put("data/users/alice%2Fbob/name", []byte("Alice"))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Put("data/blob", []byte{0xff, 0x00, 0xfe})
+		if err != nil {
+			return err
+		}
+
+		err = tx.CreateList("data/events")
+		if err != nil {
+			return err
+		}
+
+		for _, e := range []string{"first", "second"} {
+			err = tx.Append("data/events", []byte(e))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.PutWithTTL("data/session", []byte("expired"), time.Millisecond)
+	})
+	require.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	buf := &bytes.Buffer{}
+
+	t.Run("when I export a sub-map", func(t *testing.T) {
+		err = src.Export("data", buf)
+		require.NoError(t, err)
+
+		t.Run("then every element should be on its own line", func(t *testing.T) {
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			require.Equal(t, `{"format":"immersadb-export","version":1}`, lines[0])
+			require.Contains(t, lines, `{"path":"users/alice%2Fbob/name","type":"value","text":"Alice"}`)
+			require.Contains(t, lines, `{"path":"blob","type":"value","data":"/wD+"}`)
+			require.Len(t, lines, 9)
+		})
+
+		t.Run("then expired values should be left out", func(t *testing.T) {
+			require.NotContains(t, buf.String(), "session")
+		})
+	})
+
+	t.Run("when I import the export into another database", func(t *testing.T) {
+		dst, err := immersadb.Open(dstDir)
+		require.NoError(t, err)
+		defer dst.Close()
+
+		err = dst.Import("imported", bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		rtx := dst.NewReadTransaction()
+		defer rtx.Discard()
+
+		t.Run("then the values should be imported", func(t *testing.T) {
+			d, err := rtx.Get("imported/users/alice%2Fbob/name")
+			require.NoError(t, err)
+			require.Equal(t, []byte("Alice"), d)
+
+			d, err = rtx.Get("imported/blob")
+			require.NoError(t, err)
+			require.Equal(t, []byte{0xff, 0x00, 0xfe}, d)
+		})
+
+		t.Run("then the lists should be imported in order", func(t *testing.T) {
+			d, err := rtx.GetAt("imported/events", 1)
+			require.NoError(t, err)
+			require.Equal(t, []byte("second"), d)
+		})
+
+		t.Run("then importing it again should replace list elements", func(t *testing.T) {
+			err = dst.Import("imported", bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+
+			rtx := dst.NewReadTransaction()
+			defer rtx.Discard()
+
+			n, err := rtx.Len("imported/events")
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), n)
+		})
+	})
+
+	t.Run("when I import data with an unknown version", func(t *testing.T) {
+		dst, err := immersadb.Open(dstDir)
+		require.NoError(t, err)
+		defer dst.Close()
+
+		err = dst.Import("", strings.NewReader(`{"format":"immersadb-export","version":2}`))
+		require.Error(t, err)
+	})
+}
+
+func TestExportImportJSON(t *testing.T) {
+	srcDir, cleanupSrc := createTempDir(t)
+	defer cleanupSrc()
+
+	dstDir, cleanupDst := createTempDir(t)
+	defer cleanupDst()
+
+	src, err := immersadb.Open(srcDir)
+	require.NoError(t, err)
+	defer src.Close()
+
+	doc := `{"items":[{"a":1,"tags":["x",{"deep":[[],[true,null]]}]},{"b":{"c":[1,2]}},3],"name":"n"}`
+
+	err = src.Transaction(func(tx *immersadb.Transaction) error {
+		err := tx.PutJSON("doc", json.RawMessage(doc))
+		if err != nil {
+			return err
+		}
+		// an existing list gets its elements replaced
+		return tx.PutJSON("old", json.RawMessage(`{"items":[1,[2],{"e":3},4]}`))
+	})
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, src.Export("doc", buf))
+
+	t.Run("when I import a document with nested arrays and objects", func(t *testing.T) {
+		dst, err := immersadb.Open(dstDir)
+		require.NoError(t, err)
+		defer dst.Close()
+
+		err = dst.Import("doc", bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		t.Run("then it should be the same document", func(t *testing.T) {
+			rtx := dst.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.GetJSON("doc")
+			require.NoError(t, err)
+			require.JSONEq(t, doc, string(d))
+		})
+
+		t.Run("then importing it over another document should replace list elements", func(t *testing.T) {
+			err = src.Import("old", bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+
+			rtx := src.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.GetJSON("old/items")
+			require.NoError(t, err)
+			require.JSONEq(t, `[{"a":1,"tags":["x",{"deep":[[],[true,null]]}]},{"b":{"c":[1,2]}},3,4]`, string(d))
+		})
+	})
+}
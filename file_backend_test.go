@@ -0,0 +1,95 @@
+package immersadb_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreadFileBackend(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	opts := immersadb.Options{FileBackend: immersadb.FileBackendPread}
+
+	db, err := immersadb.OpenWithOptions(td, opts)
+	require.NoError(t, err)
+	defer func() {
+		db.Close()
+	}()
+
+	// larger than the write buffer, so that segments are written while a transaction runs
+	value := make([]byte, 64*1024)
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		for i := 0; i < 200; i++ {
+			value[0] = byte(i)
+			err := tx.Put(fmt.Sprintf("v%d", i), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	requireValues := func(t *testing.T, db *immersadb.DB) {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+
+		for i := 0; i < 200; i++ {
+			d, err := rtx.Get(fmt.Sprintf("v%d", i))
+			require.NoError(t, err)
+			require.Len(t, d, len(value))
+			require.Equal(t, byte(i), d[0])
+		}
+	}
+
+	t.Run("when values are committed", func(t *testing.T) {
+		t.Run("then they can be read", func(t *testing.T) {
+			requireValues(t, db)
+		})
+
+		t.Run("then a read only database with the mmap backend sees them", func(t *testing.T) {
+			rdb, err := immersadb.OpenReadOnly(td)
+			require.NoError(t, err)
+			defer rdb.Close()
+			requireValues(t, rdb)
+		})
+	})
+
+	t.Run("when the database is reopened with the mmap backend", func(t *testing.T) {
+		require.NoError(t, db.Close())
+
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+
+		t.Run("then the values can be read", func(t *testing.T) {
+			requireValues(t, db)
+		})
+
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("mmap", []byte{1})
+		})
+		require.NoError(t, err)
+
+		t.Run("when it is reopened with the pread backend", func(t *testing.T) {
+			require.NoError(t, db.Close())
+
+			db, err = immersadb.OpenWithOptions(td, opts)
+			require.NoError(t, err)
+
+			t.Run("then values written by both backends can be read", func(t *testing.T) {
+				requireValues(t, db)
+
+				rtx := db.NewReadTransaction()
+				defer rtx.Discard()
+				d, err := rtx.Get("mmap")
+				require.NoError(t, err)
+				require.Equal(t, []byte{1}, d)
+			})
+		})
+	})
+}
@@ -0,0 +1,142 @@
+package immersadb
+
+import (
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+// Glob calls fn with the path and the value of every value whose path matches the pattern.
+// Parts of the pattern can contain "*", "?" and character classes such as "[a-z]",
+// and a "**" part matches any number of nested maps, so "users/*/sessions/*"
+// matches values of all sessions of all users. See dbpath.PatternPart for the syntax.
+// Maps and lists matching the pattern are skipped, so are elements of lists and expired values.
+// Parts with a literal prefix only visit keys with that prefix.
+func (t *ReadTransaction) Glob(pattern string, fn func(path string, value []byte) error) (err error) {
+	defer t.guard(&err)()
+
+	pp, err := dbpath.ParsePattern(pattern)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing pattern %q", pattern)
+	}
+
+	expired, err := t.expiryCheck()
+	if err != nil {
+		return errors.Wrap(err, "while checking expiry")
+	}
+
+	g := &globber{
+		t:       t,
+		fn:      fn,
+		expired: expired,
+	}
+
+	anyDepth := 0
+	for _, p := range pp {
+		if p.IsAnyDepth() {
+			anyDepth++
+		}
+	}
+
+	// with more than one "**" the same path can be matched in different ways
+	if anyDepth > 1 {
+		g.seen = map[string]bool{}
+	}
+
+	return g.walk(t.root, nil, pp)
+}
+
+type globber struct {
+	t       *ReadTransaction
+	fn      func(path string, value []byte) error
+	expired func(parts []string) (bool, error)
+	seen    map[string]bool
+}
+
+func (g *globber) walk(a store.Address, parts []string, pp []dbpath.PatternPart) error {
+	t := g.t
+
+	err := t.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	kind, err := t.kindOf(a)
+	if err != nil {
+		return err
+	}
+
+	if len(pp) == 0 {
+		if kind != kindValue {
+			return nil
+		}
+		return g.match(a, parts)
+	}
+
+	p := pp[0]
+
+	if p.IsAnyDepth() {
+		err = g.walk(a, parts, pp[1:])
+		if err != nil {
+			return err
+		}
+
+		if kind != kindMap {
+			return nil
+		}
+
+		return wbbtree.ForEach(t.st, a, func(k []byte, ca store.Address) error {
+			return g.walk(ca, append(parts[:len(parts):len(parts)], string(k)), pp)
+		})
+	}
+
+	if kind != kindMap {
+		return nil
+	}
+
+	if p.IsLiteral() {
+		ca, err := wbbtree.Search(t.st, a, []byte(p.Prefix()))
+		if errors.Cause(err) == wbbtree.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return g.walk(ca, append(parts[:len(parts):len(parts)], p.Prefix()), pp[1:])
+	}
+
+	return wbbtree.ForEachWithPrefix(t.st, a, []byte(p.Prefix()), func(k []byte, ca store.Address) error {
+		if !p.Match(string(k)) {
+			return nil
+		}
+		return g.walk(ca, append(parts[:len(parts):len(parts)], string(k)), pp[1:])
+	})
+}
+
+func (g *globber) match(a store.Address, parts []string) error {
+	path := dbpath.Join(parts...)
+
+	expired, err := g.expired(parts)
+	if err != nil {
+		return errors.Wrapf(err, "while checking expiry of %q", path)
+	}
+
+	if expired {
+		return nil
+	}
+
+	if g.seen != nil {
+		if g.seen[path] {
+			return nil
+		}
+		g.seen[path] = true
+	}
+
+	d, err := g.t.readData(a)
+	if err != nil {
+		return errors.Wrapf(err, "while reading value %q", path)
+	}
+
+	return g.fn(path, d)
+}
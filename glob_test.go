@@ -0,0 +1,128 @@
+package immersadb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlob(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		for _, m := range []string{"users", "users/alice", "users/alice/sessions", "users/bob", "users/bob/sessions", "users/a%2Fb", "groups"} {
+			err := tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+
+		for p, v := range map[string]string{
+			"users/alice/name":        "Alice",
+			"users/alice/sessions/s1": "1",
+			"users/alice/sessions/s2": "2",
+			"users/bob/name":          "Bob",
+			"users/bob/sessions/s3":   "3",
+			"users/a%2Fb/name":        "A/B",
+			"groups/admins":           "alice",
+		} {
+			err := tx.Put(p, []byte(v))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.CreateList("users/bob/history")
+	})
+	require.NoError(t, err)
+
+	glob := func(t *testing.T, pattern string) map[string]string {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+
+		res := map[string]string{}
+		err := rtx.Glob(pattern, func(path string, value []byte) error {
+			require.NotContains(t, res, path)
+			res[path] = string(value)
+			return nil
+		})
+		require.NoError(t, err)
+		return res
+	}
+
+	t.Run("when I glob with * parts", func(t *testing.T) {
+		t.Run("then I should get values of all matching paths", func(t *testing.T) {
+			require.Equal(t, map[string]string{
+				"users/alice/sessions/s1": "1",
+				"users/alice/sessions/s2": "2",
+				"users/bob/sessions/s3":   "3",
+			}, glob(t, "users/*/sessions/*"))
+		})
+	})
+
+	t.Run("when I glob with a literal prefix and a class", func(t *testing.T) {
+		t.Run("then I should get only matching values", func(t *testing.T) {
+			require.Equal(t, map[string]string{
+				"users/alice/name": "Alice",
+			}, glob(t, "users/al*/n[a-z]me"))
+		})
+	})
+
+	t.Run("when I glob for keys containing an escaped slash", func(t *testing.T) {
+		t.Run("then I should get the matching value", func(t *testing.T) {
+			require.Equal(t, map[string]string{
+				"users/a%2Fb/name": "A/B",
+			}, glob(t, "users/a%2F*/name"))
+		})
+	})
+
+	t.Run("when I glob with **", func(t *testing.T) {
+		t.Run("then it should match any depth", func(t *testing.T) {
+			require.Equal(t, map[string]string{
+				"users/alice/name": "Alice",
+				"users/bob/name":   "Bob",
+				"users/a%2Fb/name": "A/B",
+			}, glob(t, "**/name"))
+		})
+
+		t.Run("then it should match every value under a map", func(t *testing.T) {
+			require.Len(t, glob(t, "users/**"), 6)
+		})
+
+		t.Run("then paths matched in several ways should be reported once", func(t *testing.T) {
+			require.Len(t, glob(t, "**/sessions/**"), 3)
+		})
+	})
+
+	t.Run("when the pattern matches maps and lists", func(t *testing.T) {
+		t.Run("then they should be skipped", func(t *testing.T) {
+			require.Empty(t, glob(t, "users/*/*s*"))
+		})
+	})
+
+	t.Run("when a matching value has expired", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.PutWithTTL("users/alice/sessions/s4", []byte("4"), time.Millisecond)
+		})
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+
+		t.Run("then it should be skipped", func(t *testing.T) {
+			require.Len(t, glob(t, "users/alice/sessions/*"), 2)
+			require.Empty(t, glob(t, "users/alice/sessions/s4"))
+		})
+	})
+
+	t.Run("when nothing matches", func(t *testing.T) {
+		t.Run("then fn should not be called", func(t *testing.T) {
+			require.Empty(t, glob(t, "users/carol/*"))
+		})
+	})
+}
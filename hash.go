@@ -0,0 +1,49 @@
+package immersadb
+
+import (
+	"encoding/hex"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// Hash identifies the content of a map, list or value.
+// With Options.ContentHashes, hashes are stored in segments, so getting the hash of a path is cheap.
+// Otherwise the hash is computed by reading the whole subtree.
+// Equal hashes of replicas, backups or snapshots of a database mean equal content.
+// Different hashes can be compared key by key, descending only into
+// sub-maps whose hashes differ.
+// Hashes don't depend on the order of writes, maps with the same entries have the same hash.
+// The hex encoding returned by String can be used as an ETag for conditional writes,
+// which require Options.ContentHashes.
+type Hash = store.Hash
+
+// Hash returns the hash of the map, list or value at the path.
+func (t *ReadTransaction) Hash(path string) (h Hash, err error) {
+	defer t.guard(&err)()
+
+	a, err := t.pathElementAddress(path)
+	if err != nil {
+		return h, err
+	}
+
+	return t.st.Hash(a), nil
+}
+
+// ParseHash parses a hash encoded with Hash.String.
+func ParseHash(s string) (Hash, error) {
+	h := Hash{}
+
+	d, err := hex.DecodeString(s)
+	if err != nil {
+		return h, errors.Wrapf(err, "while decoding hash %q", s)
+	}
+
+	if len(d) != len(h) {
+		return h, errors.Errorf("hash %q has %d bytes, expected %d", s, len(d), len(h))
+	}
+
+	copy(h[:], d)
+
+	return h, nil
+}
@@ -0,0 +1,136 @@
+package immersadb_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHash(t *testing.T) {
+	td1, cleanup1 := createTempDir(t)
+	defer cleanup1()
+
+	td2, cleanup2 := createTempDir(t)
+	defer cleanup2()
+
+	bd, cleanupBackup := createTempDir(t)
+	defer cleanupBackup()
+
+	fill := func(t *testing.T, db *immersadb.DB) {
+		err := db.Transaction(func(tx *immersadb.Transaction) error {
+			for _, m := range []string{"a", "b"} {
+				err := tx.CreateMap(m)
+				if err != nil {
+					return err
+				}
+			}
+			err := tx.Put("a/x", []byte("1"))
+			if err != nil {
+				return err
+			}
+			err = tx.Put("b/y", make([]byte, 1000000))
+			if err != nil {
+				return err
+			}
+			return tx.CreateList("c")
+		})
+		require.NoError(t, err)
+	}
+
+	db1, err := immersadb.Open(td1)
+	require.NoError(t, err)
+	defer db1.Close()
+
+	// hashes are the same whether they are stored or computed and whether values are encrypted
+	db2, err := immersadb.OpenWithOptions(td2, immersadb.Options{
+		ContentHashes: true,
+		EncryptionKey: []byte("0123456789abcdef"),
+	})
+	require.NoError(t, err)
+	defer db2.Close()
+
+	hash := func(t *testing.T, db *immersadb.DB, path string) immersadb.Hash {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		h, err := rtx.Hash(path)
+		require.NoError(t, err)
+		return h
+	}
+
+	fill(t, db1)
+	fill(t, db2)
+
+	t.Run("when two databases are written the same way", func(t *testing.T) {
+		t.Run("then their hashes should be equal", func(t *testing.T) {
+			require.Equal(t, hash(t, db1, ""), hash(t, db2, ""))
+		})
+	})
+
+	t.Run("when maps with the same entries are written in a different order", func(t *testing.T) {
+		for _, db := range []*immersadb.DB{db1, db2} {
+			err := db.Transaction(func(tx *immersadb.Transaction) error {
+				err := tx.CreateMap("ordered")
+				if err != nil {
+					return err
+				}
+				for i := 0; i < 50; i++ {
+					k := i
+					if db == db2 {
+						k = 49 - i
+					}
+					err = tx.Put(fmt.Sprintf("ordered/%02d", k), []byte{byte(k)})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		}
+
+		t.Run("then their hashes should be equal", func(t *testing.T) {
+			require.Equal(t, hash(t, db1, "ordered"), hash(t, db2, "ordered"))
+			require.Equal(t, hash(t, db1, ""), hash(t, db2, ""))
+		})
+	})
+
+	t.Run("when I commit more transactions to one database", func(t *testing.T) {
+		before := hash(t, db1, "b")
+		for i := 0; i < 5; i++ {
+			err = db1.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put("a/z", make([]byte, 1000000))
+			})
+			require.NoError(t, err)
+		}
+
+		t.Run("then hashes of unchanged maps should stay the same", func(t *testing.T) {
+			require.Equal(t, before, hash(t, db1, "b"))
+			require.Equal(t, hash(t, db2, "b"), hash(t, db1, "b"))
+		})
+
+		t.Run("then hashes of changed maps should differ", func(t *testing.T) {
+			require.NotEqual(t, hash(t, db2, "a"), hash(t, db1, "a"))
+			require.NotEqual(t, hash(t, db2, ""), hash(t, db1, ""))
+		})
+
+		t.Run("then hashes of unchanged values should stay the same", func(t *testing.T) {
+			require.Equal(t, hash(t, db2, "a/x"), hash(t, db1, "a/x"))
+		})
+	})
+
+	t.Run("when I restore a backup", func(t *testing.T) {
+		require.NoError(t, db1.Backup(context.Background(), filepath.Join(bd, "backup")))
+
+		restored, err := immersadb.Open(filepath.Join(bd, "backup"))
+		require.NoError(t, err)
+		defer restored.Close()
+
+		t.Run("then its hash should match the database", func(t *testing.T) {
+			require.Equal(t, hash(t, db1, ""), hash(t, restored, ""))
+		})
+	})
+}
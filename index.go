@@ -0,0 +1,645 @@
+package immersadb
+
+import (
+	"encoding/json"
+	serrors "errors"
+
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+// IndexExtractor returns the terms a value is indexed under.
+type IndexExtractor func(value []byte) [][]byte
+
+var ErrIndexNotFound = serrors.New("index not found")
+
+var ErrIndexExists = serrors.New("index already exists")
+
+// ErrIndexStale is returned when looking up an index whose map was modified
+// while the index was not registered. Registering the index rebuilds it.
+var ErrIndexStale = serrors.New("index is stale")
+
+// indexesMapKey is the key of the system map holding secondary indexes.
+// Each index is a map of terms, each term a map of primary keys
+// to the addresses of the indexed values.
+const indexesMapKey = "indexes"
+
+// indexDefinitionsMapKey is the key of the system map holding
+// JSON encoded storedIndex values by index name.
+const indexDefinitionsMapKey = "indexDefinitions"
+
+type storedIndex struct {
+	MapPath string `json:"mapPath"`
+	Stale   bool   `json:"stale,omitempty"`
+}
+
+type indexDefinition struct {
+	storedIndex
+	name    string
+	extract IndexExtractor
+}
+
+// RegisterIndex declares a secondary index on values of the map at mapPath
+// and indexes the values already stored there.
+// All modifications of the map keep the index up to date in the same transaction.
+// The definition of the index is kept in the database, but the extractor is not,
+// so indexes have to be registered every time the database is opened.
+// Modifying the map of an index before it is registered marks the index stale,
+// it is rebuilt when it is registered. Read only databases can look up indexes
+// without registering them.
+func (db *DB) RegisterIndex(name, mapPath string, extract IndexExtractor) error {
+	parts, err := dbpath.Split(mapPath)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", mapPath)
+	}
+
+	if name == "" {
+		return errors.New("index name must not be empty")
+	}
+
+	db.mu.Lock()
+
+	_, found := db.extractors[name]
+	if found {
+		db.mu.Unlock()
+		return ErrIndexExists
+	}
+
+	if db.extractors == nil {
+		db.extractors = map[string]IndexExtractor{}
+	}
+
+	// registered before the transaction starts, so that it is used by it
+	db.extractors[name] = extract
+
+	db.mu.Unlock()
+
+	err = db.Transaction(func(tx *Transaction) error {
+		return tx.registerIndex(name, dbpath.Join(parts...))
+	})
+	if err != nil {
+		db.mu.Lock()
+		delete(db.extractors, name)
+		db.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// indexExtractors returns registered extractors of indexes.
+// It must be called with db.mu locked.
+func (db *DB) indexExtractors() map[string]IndexExtractor {
+	extractors := make(map[string]IndexExtractor, len(db.extractors))
+	for n, e := range db.extractors {
+		extractors[n] = e
+	}
+	return extractors
+}
+
+func (t *Transaction) registerIndex(name, mapPath string) (err error) {
+	defer t.guard(&err)()
+
+	def, found, err := t.indexDefinition(name)
+	if err != nil {
+		return err
+	}
+
+	if found && def.MapPath != mapPath {
+		return ErrIndexExists
+	}
+
+	if found && !def.Stale {
+		return nil
+	}
+
+	return t.rebuildIndex(&indexDefinition{
+		storedIndex: storedIndex{MapPath: mapPath},
+		name:        name,
+		extract:     t.extractors[name],
+	})
+}
+
+// DropIndex removes the index and its definition from the database.
+func (db *DB) DropIndex(name string) error {
+	err := db.Transaction(func(tx *Transaction) error {
+		return tx.dropIndex(name)
+	})
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	delete(db.extractors, name)
+	db.mu.Unlock()
+
+	return nil
+}
+
+func (t *Transaction) dropIndex(name string) (err error) {
+	defer t.guard(&err)()
+
+	_, found, err := t.indexDefinition(name)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrIndexNotFound
+	}
+
+	err = t.modifySystemMap([]string{indexDefinitionsMapKey}, func(ma store.Address) (store.Address, error) {
+		return deleteIfExists(t.st, ma, []byte(name))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "while removing definition of index %q", name)
+	}
+
+	return t.dropIndexContent(name)
+}
+
+// RebuildIndex indexes all values of the map of a registered index.
+func (db *DB) RebuildIndex(name string) error {
+	return db.Transaction(func(tx *Transaction) error {
+		return tx.RebuildIndex(name)
+	})
+}
+
+// RebuildIndex drops the content of a registered index and indexes all values of its map.
+func (t *Transaction) RebuildIndex(name string) (err error) {
+	defer t.guard(&err)()
+
+	def, found, err := t.indexDefinition(name)
+	if err != nil {
+		return err
+	}
+
+	if !found || def.extract == nil {
+		return ErrIndexNotFound
+	}
+
+	return t.rebuildIndex(def)
+}
+
+// rebuildIndex stores the definition of the index as not stale and indexes its map.
+func (t *Transaction) rebuildIndex(def *indexDefinition) error {
+	fresh := *def
+	fresh.Stale = false
+
+	err := t.storeIndexDefinition(&fresh)
+	if err != nil {
+		return err
+	}
+
+	return t.indexMap(&fresh)
+}
+
+// indexMap drops the content of the index and indexes all values of its map, if it exists.
+func (t *Transaction) indexMap(def *indexDefinition) error {
+	err := t.dropIndexContent(def.name)
+	if err != nil {
+		return err
+	}
+
+	mapParts, err := dbpath.Split(def.MapPath)
+	if err != nil {
+		return err
+	}
+
+	ma, err := t.lookup(mapParts)
+	if errors.Cause(err) == wbbtree.ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	kind, err := t.kindOf(ma)
+	if err != nil {
+		return err
+	}
+
+	if kind != kindMap {
+		return nil
+	}
+
+	return wbbtree.ForEach(t.st, ma, func(k []byte, va store.Address) error {
+		err := t.ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		d, isValue, err := t.valueAt(va)
+		if err != nil {
+			return err
+		}
+
+		if !isValue {
+			return nil
+		}
+
+		return t.addIndexEntries(def, string(k), d, va)
+	})
+}
+
+// markStale drops the content of an index that can't be updated, because it is not registered.
+func (t *Transaction) markStale(def *indexDefinition) error {
+	if def.Stale {
+		return nil
+	}
+
+	// cached definitions are not changed, since a savepoint can bring them back
+	stale := *def
+	stale.Stale = true
+
+	err := t.storeIndexDefinition(&stale)
+	if err != nil {
+		return err
+	}
+
+	return t.dropIndexContent(def.name)
+}
+
+func (t *Transaction) storeIndexDefinition(def *indexDefinition) error {
+	d, err := json.Marshal(def.storedIndex)
+	if err != nil {
+		return errors.Wrap(err, "while encoding index definition")
+	}
+
+	da, err := t.storeData(d)
+	if err != nil {
+		return err
+	}
+
+	err = t.modifySystemMap([]string{indexDefinitionsMapKey}, func(ma store.Address) (store.Address, error) {
+		return wbbtree.Insert(t.st, ma, []byte(def.name), da)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "while storing definition of index %q", def.name)
+	}
+
+	return nil
+}
+
+func (t *Transaction) dropIndexContent(name string) error {
+	err := t.modifySystemMap([]string{indexesMapKey}, func(ma store.Address) (store.Address, error) {
+		return deleteIfExists(t.st, ma, []byte(name))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "while dropping index %q", name)
+	}
+	return nil
+}
+
+// indexDefinition returns the stored definition of the index.
+func (t *Transaction) indexDefinition(name string) (*indexDefinition, bool, error) {
+	defs, err := t.indexDefinitions()
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, def := range defs {
+		if def.name == name {
+			return def, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// indexDefinitions returns stored definitions of all indexes together with registered extractors.
+// Definitions are parsed again only when the map holding them has changed.
+func (t *Transaction) indexDefinitions() ([]*indexDefinition, error) {
+	da, err := t.systemMap(indexDefinitionsMapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if da == t.indexCache.at && t.indexCache.defs != nil {
+		return t.indexCache.defs, nil
+	}
+
+	defs := []*indexDefinition{}
+
+	if da != store.NilAddress {
+		err = wbbtree.ForEach(t.st, da, func(k []byte, va store.Address) error {
+			si, err := t.readIndexDefinition(va)
+			if err != nil {
+				return errors.Wrapf(err, "while reading definition of index %q", k)
+			}
+
+			defs = append(defs, &indexDefinition{
+				storedIndex: si,
+				name:        string(k),
+				extract:     t.extractors[string(k)],
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.indexCache.at = da
+	t.indexCache.defs = defs
+
+	return defs, nil
+}
+
+func (t *ReadTransaction) readIndexDefinition(va store.Address) (storedIndex, error) {
+	si := storedIndex{}
+
+	d, err := t.readData(va)
+	if err != nil {
+		return si, err
+	}
+
+	err = json.Unmarshal(d, &si)
+	if err != nil {
+		return si, errors.Wrap(err, "while decoding index definition")
+	}
+
+	return si, nil
+}
+
+// systemMap returns the address of the system map with the key or NilAddress if there is none.
+func (t *ReadTransaction) systemMap(key string) (store.Address, error) {
+	if t.system == store.NilAddress {
+		return store.NilAddress, nil
+	}
+
+	ma, err := wbbtree.Search(t.st, t.system, []byte(key))
+	if errors.Cause(err) == wbbtree.ErrNotFound {
+		return store.NilAddress, nil
+	}
+
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	return ma, nil
+}
+
+// LookupIndex returns keys of values in the map of the index that were indexed under the term.
+// Keys of expired values are skipped.
+func (t *ReadTransaction) LookupIndex(name string, term []byte) (keys []string, err error) {
+	defer t.guard(&err)()
+
+	da, err := t.systemMap(indexDefinitionsMapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if da == store.NilAddress {
+		return nil, ErrIndexNotFound
+	}
+
+	va, err := wbbtree.Search(t.st, da, []byte(name))
+	if errors.Cause(err) == wbbtree.ErrNotFound {
+		return nil, ErrIndexNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	si, err := t.readIndexDefinition(va)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading definition of index %q", name)
+	}
+
+	if si.Stale {
+		return nil, ErrIndexStale
+	}
+
+	mapParts, err := dbpath.Split(si.MapPath)
+	if err != nil {
+		return nil, err
+	}
+
+	expired, err := t.expiryCheck()
+	if err != nil {
+		return nil, errors.Wrap(err, "while checking expiry")
+	}
+
+	keys = []string{}
+
+	ta := t.system
+	for _, k := range [][]byte{[]byte(indexesMapKey), []byte(name), term} {
+		ta, err = wbbtree.Search(t.st, ta, k)
+		if errors.Cause(err) == wbbtree.ErrNotFound {
+			return keys, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = wbbtree.ForEach(t.st, ta, func(k []byte, _ store.Address) error {
+		exp, err := expired(append(mapParts[:len(mapParts):len(mapParts)], string(k)))
+		if err != nil || exp {
+			return err
+		}
+		keys = append(keys, string(k))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// indexesOf returns indexes on the map at the path.
+func (t *Transaction) indexesOf(mapParts []string) ([]*indexDefinition, error) {
+	all, err := t.indexDefinitions()
+	if err != nil {
+		return nil, err
+	}
+
+	mapPath := dbpath.Join(mapParts...)
+
+	defs := []*indexDefinition{}
+	for _, def := range all {
+		if def.MapPath == mapPath {
+			defs = append(defs, def)
+		}
+	}
+
+	return defs, nil
+}
+
+// reindexValue replaces index entries of the key for the value at old with entries for the value at na.
+// Either address can be NilAddress and addresses of maps and lists are not indexed.
+func (t *Transaction) reindexValue(def *indexDefinition, key string, old, na store.Address) error {
+	if def.extract == nil {
+		return t.markStale(def)
+	}
+
+	d, isValue, err := t.valueAt(old)
+	if err != nil {
+		return errors.Wrap(err, "while reading indexed value")
+	}
+
+	if isValue {
+		err = t.removeIndexEntries(def, key, d)
+		if err != nil {
+			return err
+		}
+	}
+
+	d, isValue, err = t.valueAt(na)
+	if err != nil {
+		return errors.Wrap(err, "while reading indexed value")
+	}
+
+	if !isValue {
+		return nil
+	}
+
+	return t.addIndexEntries(def, key, d, na)
+}
+
+// valueAt returns the data of the value at the address, if there is a value.
+func (t *Transaction) valueAt(a store.Address) ([]byte, bool, error) {
+	if a == store.NilAddress {
+		return nil, false, nil
+	}
+
+	kind, err := t.kindOf(a)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if kind != kindValue {
+		return nil, false, nil
+	}
+
+	d, err := t.readData(a)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return d, true, nil
+}
+
+// reindexUnder indexes again maps of indexes at or under the path.
+func (t *Transaction) reindexUnder(parts []string) error {
+	defs, err := t.indexDefinitions()
+	if err != nil {
+		return err
+	}
+
+	for _, def := range defs {
+		mapParts, err := dbpath.Split(def.MapPath)
+		if err != nil {
+			return err
+		}
+
+		if !isPrefix(parts, mapParts) {
+			continue
+		}
+
+		if def.extract == nil {
+			err = t.markStale(def)
+		} else {
+			err = t.indexMap(def)
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "while indexing %q again", def.name)
+		}
+	}
+
+	return nil
+}
+
+func uniqueTerms(terms [][]byte) [][]byte {
+	seen := map[string]bool{}
+	unique := [][]byte{}
+	for _, t := range terms {
+		if !seen[string(t)] {
+			seen[string(t)] = true
+			unique = append(unique, t)
+		}
+	}
+	return unique
+}
+
+func (t *Transaction) addIndexEntries(def *indexDefinition, key string, d []byte, va store.Address) error {
+	for _, term := range uniqueTerms(def.extract(d)) {
+		err := t.modifySystemMap([]string{indexesMapKey, def.name, string(term)}, func(ma store.Address) (store.Address, error) {
+			return wbbtree.Insert(t.st, ma, []byte(key), va)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "while adding %q to index %q", key, def.name)
+		}
+	}
+	return nil
+}
+
+func (t *Transaction) removeIndexEntries(def *indexDefinition, key string, d []byte) error {
+	for _, term := range uniqueTerms(def.extract(d)) {
+		err := t.modifySystemMap([]string{indexesMapKey, def.name, string(term)}, func(ma store.Address) (store.Address, error) {
+			return deleteIfExists(t.st, ma, []byte(key))
+		})
+		if err != nil {
+			return errors.Wrapf(err, "while removing %q from index %q", key, def.name)
+		}
+	}
+	return nil
+}
+
+// modifySystemMap applies f to the system map at the path.
+// Missing maps are passed to f as NilAddress and maps that end up empty are removed.
+func (t *Transaction) modifySystemMap(path []string, f func(ma store.Address) (store.Address, error)) error {
+	ns, err := modifyMapCreating(t.st, t.system, path, f)
+	if err != nil {
+		return err
+	}
+	t.system = ns
+	return nil
+}
+
+func modifyMapCreating(st store.Store, ma store.Address, path []string, f func(ma store.Address) (store.Address, error)) (store.Address, error) {
+	if len(path) == 0 {
+		return f(ma)
+	}
+
+	key := []byte(path[0])
+
+	ca, err := wbbtree.Search(st, ma, key)
+	if errors.Cause(err) == wbbtree.ErrNotFound {
+		ca = store.NilAddress
+	} else if err != nil {
+		return store.NilAddress, err
+	}
+
+	nca, err := modifyMapCreating(st, ca, path[1:], f)
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	if nca == ca {
+		return ma, nil
+	}
+
+	if nca == store.NilAddress {
+		return wbbtree.Delete(st, ma, key)
+	}
+
+	return wbbtree.Insert(st, ma, key, nca)
+}
+
+// deleteIfExists deletes the key from the map, returning NilAddress for an empty map.
+func deleteIfExists(st store.Store, ma store.Address, key []byte) (store.Address, error) {
+	na, err := wbbtree.Delete(st, ma, key)
+	if errors.Cause(err) == wbbtree.ErrNotFound {
+		return ma, nil
+	}
+	return na, err
+}
@@ -0,0 +1,288 @@
+package immersadb_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// values are "name,city"
+func cityOf(value []byte) [][]byte {
+	parts := bytes.SplitN(value, []byte(","), 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	return [][]byte{parts[1]}
+}
+
+func nameOf(value []byte) [][]byte {
+	return [][]byte{bytes.SplitN(value, []byte(","), 2)[0]}
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer func() {
+		db.Close()
+	}()
+
+	require.NoError(t, db.RegisterIndex("byCity", "users", cityOf))
+
+	lookup := func(t *testing.T, name, term string) []string {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		keys, err := rtx.LookupIndex(name, []byte(term))
+		require.NoError(t, err)
+		return keys
+	}
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		err := tx.CreateMap("users")
+		if err != nil {
+			return err
+		}
+		for k, v := range map[string]string{"u1": "ann,berlin", "u2": "bob,paris", "u3": "cid,berlin"} {
+			err = tx.Put("users/"+k, []byte(v))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	t.Run("when I put values into an indexed map", func(t *testing.T) {
+		t.Run("then I should find their keys by term", func(t *testing.T) {
+			require.Equal(t, []string{"u1", "u3"}, lookup(t, "byCity", "berlin"))
+			require.Equal(t, []string{"u2"}, lookup(t, "byCity", "paris"))
+		})
+
+		t.Run("then the index should not be visible in the database", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			cnt, err := rtx.Count("")
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), cnt)
+		})
+	})
+
+	t.Run("when I update a value", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("users/u1", []byte("ann,paris"))
+		})
+		require.NoError(t, err)
+
+		t.Run("then the old term should not find it any more", func(t *testing.T) {
+			require.Equal(t, []string{"u3"}, lookup(t, "byCity", "berlin"))
+		})
+
+		t.Run("then the new term should find it", func(t *testing.T) {
+			require.Equal(t, []string{"u1", "u2"}, lookup(t, "byCity", "paris"))
+		})
+	})
+
+	t.Run("when I delete a value", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Delete("users/u3")
+		})
+		require.NoError(t, err)
+
+		t.Run("then it should be removed from the index", func(t *testing.T) {
+			require.Empty(t, lookup(t, "byCity", "berlin"))
+		})
+	})
+
+	t.Run("when I roll back a transaction to a savepoint", func(t *testing.T) {
+		tx, err := db.NewTransaction()
+		require.NoError(t, err)
+		defer tx.Rollback()
+
+		sp := tx.Savepoint()
+		require.NoError(t, tx.Put("users/u4", []byte("dan,rome")))
+		require.NoError(t, tx.RollbackTo(sp))
+
+		t.Run("then the index should be rolled back too", func(t *testing.T) {
+			keys, err := tx.LookupIndex("byCity", []byte("rome"))
+			require.NoError(t, err)
+			require.Empty(t, keys)
+		})
+	})
+
+	t.Run("when I put a JSON value into an indexed map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.PutJSON("users/u5", "eve,oslo")
+		})
+		require.NoError(t, err)
+
+		t.Run("then it should be indexed like a value stored with Put", func(t *testing.T) {
+			require.Equal(t, []string{"u5"}, lookup(t, "byCity", `oslo"`))
+		})
+	})
+
+	t.Run("when I look up an index that is not registered", func(t *testing.T) {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		_, err := rtx.LookupIndex("byAge", []byte("42"))
+
+		t.Run("then it should fail with ErrIndexNotFound", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrIndexNotFound, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I register an index over existing data", func(t *testing.T) {
+		require.NoError(t, db.RegisterIndex("byName", "users", nameOf))
+
+		t.Run("then it should find existing values", func(t *testing.T) {
+			require.Equal(t, []string{"u2"}, lookup(t, "byName", "bob"))
+		})
+
+		t.Run("then it should find existing values after it is rebuilt", func(t *testing.T) {
+			require.NoError(t, db.RebuildIndex("byName"))
+			require.Equal(t, []string{"u2"}, lookup(t, "byName", "bob"))
+		})
+	})
+
+	t.Run("when I reopen the database and register the index again", func(t *testing.T) {
+		require.NoError(t, db.Close())
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+		require.NoError(t, db.RegisterIndex("byCity", "users", cityOf))
+
+		t.Run("then the index should be kept", func(t *testing.T) {
+			require.Equal(t, []string{"u1", "u2"}, lookup(t, "byCity", "paris"))
+		})
+	})
+
+	t.Run("when I register an index with a used name for another map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.CreateMap("other")
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, db.Close())
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+		require.NoError(t, db.RegisterIndex("byCity", "users", cityOf))
+
+		err = db.RegisterIndex("byName", "other", nameOf)
+
+		t.Run("then it should fail with ErrIndexExists", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrIndexExists, errors.Cause(err))
+		})
+
+		t.Run("then the index should be kept without registering it", func(t *testing.T) {
+			require.Equal(t, []string{"u2"}, lookup(t, "byName", "bob"))
+		})
+
+		require.NoError(t, db.RegisterIndex("byName", "users", nameOf))
+	})
+
+	t.Run("when I copy, move and bulk load values into an indexed map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			err := tx.Put("other/o1", []byte("fay,lima"))
+			if err != nil {
+				return err
+			}
+			err = tx.Put("other/o2", []byte("gus,lima"))
+			if err != nil {
+				return err
+			}
+			err = tx.Copy("other/o1", "users/c1")
+			if err != nil {
+				return err
+			}
+			err = tx.Move("other/o2", "users/m1")
+			if err != nil {
+				return err
+			}
+			return tx.MergeAll("users", immersadb.NewSliceIterator([]immersadb.KeyValue{
+				{Key: "b1", Value: []byte("hal,lima")},
+				{Key: "u2", Value: []byte("bob,rome")},
+			}))
+		})
+		require.NoError(t, err)
+
+		t.Run("then they should be indexed", func(t *testing.T) {
+			require.Equal(t, []string{"b1", "c1", "m1"}, lookup(t, "byCity", "lima"))
+		})
+
+		t.Run("then merged values should be indexed again", func(t *testing.T) {
+			require.Equal(t, []string{"u2"}, lookup(t, "byCity", "rome"))
+			require.NotContains(t, lookup(t, "byCity", "paris"), "u2")
+		})
+	})
+
+	t.Run("when I replace the indexed map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			err := tx.Delete("users")
+			if err != nil {
+				return err
+			}
+			return tx.PutAll("users", immersadb.NewSliceIterator([]immersadb.KeyValue{
+				{Key: "p1", Value: []byte("ida,lima")},
+			}))
+		})
+		require.NoError(t, err)
+
+		t.Run("then the index should contain only values of the new map", func(t *testing.T) {
+			require.Equal(t, []string{"p1"}, lookup(t, "byCity", "lima"))
+			require.Empty(t, lookup(t, "byCity", "paris"))
+		})
+	})
+
+	t.Run("when I modify an indexed map before registering the index", func(t *testing.T) {
+		require.NoError(t, db.Close())
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("users/p2", []byte("jon,lima"))
+		})
+		require.NoError(t, err)
+
+		t.Run("then looking up the index should fail with ErrIndexStale", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			_, err := rtx.LookupIndex("byCity", []byte("lima"))
+			require.Equal(t, immersadb.ErrIndexStale, errors.Cause(err))
+		})
+
+		t.Run("then registering the index should rebuild it", func(t *testing.T) {
+			require.NoError(t, db.RegisterIndex("byCity", "users", cityOf))
+			require.Equal(t, []string{"p1", "p2"}, lookup(t, "byCity", "lima"))
+		})
+	})
+
+	t.Run("when I drop an index", func(t *testing.T) {
+		require.NoError(t, db.DropIndex("byName"))
+
+		t.Run("then looking it up should fail with ErrIndexNotFound", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			_, err := rtx.LookupIndex("byName", []byte("ida"))
+			require.Equal(t, immersadb.ErrIndexNotFound, errors.Cause(err))
+		})
+
+		t.Run("then it can be registered again", func(t *testing.T) {
+			require.NoError(t, db.RegisterIndex("byName", "users", nameOf))
+			require.Equal(t, []string{"p1"}, lookup(t, "byName", "ida"))
+		})
+	})
+
+	t.Run("when I delete the indexed map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Delete("users")
+		})
+		require.NoError(t, err)
+
+		t.Run("then the index should be empty", func(t *testing.T) {
+			require.Empty(t, lookup(t, "byCity", "paris"))
+		})
+	})
+}
@@ -0,0 +1,206 @@
+package immersadb
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbblist"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+// JSON documents are stored decomposed:
+// objects become maps with one key per member, arrays become lists
+// and every other JSON value (string, number, boolean or null) becomes
+// a value holding its JSON encoding, so
+//   {"name":"alice","tags":["a","b"],"age":42}
+// is stored as a map with the values `"alice"` and `42` and a list with the values `"a"` and `"b"`.
+// Single fields of a stored document can then be read and changed with Get and Put,
+// as long as the values stay valid JSON.
+
+// PutJSON stores v, encoded with encoding/json, as a document at the path, replacing anything stored there.
+// Already encoded JSON can be passed as json.RawMessage.
+func (t *Transaction) PutJSON(path string, v interface{}) (err error) {
+	defer t.guard(&err)()
+
+	d, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "while encoding JSON")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+
+	var doc interface{}
+	err = dec.Decode(&doc)
+	if err != nil {
+		return errors.Wrap(err, "while decoding JSON")
+	}
+
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	return t.write(parts, func(store.Address) (store.Address, error) {
+		return t.storeJSON(doc)
+	})
+}
+
+func (t *Transaction) storeJSON(doc interface{}) (store.Address, error) {
+	err := t.ctx.Err()
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		bkeys := make([][]byte, len(keys))
+		values := make([]store.Address, len(keys))
+		for i, k := range keys {
+			bkeys[i] = []byte(k)
+			values[i], err = t.storeJSON(v[k])
+			if err != nil {
+				return store.NilAddress, err
+			}
+		}
+
+		return wbbtree.BuildSorted(t.st, bkeys, values)
+	case []interface{}:
+		la, err := wbblist.CreateEmpty(t.st)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating empty list")
+		}
+
+		for i, e := range v {
+			ea, err := t.storeJSON(e)
+			if err != nil {
+				return store.NilAddress, err
+			}
+
+			la, err = wbblist.Insert(t.st, la, uint64(i), ea)
+			if err != nil {
+				return store.NilAddress, err
+			}
+		}
+
+		return la, nil
+	default:
+		d, err := json.Marshal(v)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while encoding JSON value")
+		}
+		return t.storeData(d)
+	}
+}
+
+// GetJSON reassembles the document stored at the path, leaving out expired values.
+// It fails if a value of the document is not valid JSON.
+func (t *ReadTransaction) GetJSON(path string) (d []byte, err error) {
+	defer t.guard(&err)()
+
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	a, err := t.pathElementAddress(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while looking up %q", path)
+	}
+
+	expired, err := t.expiryCheck()
+	if err != nil {
+		return nil, errors.Wrap(err, "while checking expiry")
+	}
+
+	buf := &bytes.Buffer{}
+
+	err = t.writeJSON(buf, a, parts, expired)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeJSON writes the element at a, which is stored at the path of parts.
+func (t *ReadTransaction) writeJSON(buf *bytes.Buffer, a store.Address, parts []string, expired func(parts []string) (bool, error)) error {
+	err := t.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	kind, err := t.kindOf(a)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case kindMap:
+		buf.WriteByte('{')
+		first := true
+		err = wbbtree.ForEach(t.st, a, func(k []byte, ca store.Address) error {
+			cparts := append(parts[:len(parts):len(parts)], string(k))
+
+			exp, err := expired(cparts)
+			if err != nil || exp {
+				return err
+			}
+
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+
+			kd, err := json.Marshal(string(k))
+			if err != nil {
+				return errors.Wrapf(err, "while encoding key %q", k)
+			}
+			buf.Write(kd)
+			buf.WriteByte(':')
+
+			return t.writeJSON(buf, ca, cparts, expired)
+		})
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+		return nil
+	case kindList:
+		buf.WriteByte('[')
+		err = wbblist.ForEach(t.st, a, func(i uint64, ca store.Address) error {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			return t.writeJSON(buf, ca, append(parts[:len(parts):len(parts)], strconv.FormatUint(i, 10)), expired)
+		})
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(']')
+		return nil
+	default:
+		d, err := t.readData(a)
+		if err != nil {
+			return errors.Wrap(err, "while reading value")
+		}
+
+		if !json.Valid(d) {
+			return errors.Errorf("value %q is not valid JSON", dbpath.Join(parts...))
+		}
+
+		buf.Write(d)
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package immersadb_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSON(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	getJSON := func(t *testing.T, path string) string {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		d, err := rtx.GetJSON(path)
+		require.NoError(t, err)
+		return string(d)
+	}
+
+	t.Run("when I put a JSON document", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.PutJSON("doc", map[string]interface{}{
+				"name":    "alice",
+				"age":     42,
+				"admin":   false,
+				"manager": nil,
+				"tags":    []string{"a", "b"},
+				"address": map[string]interface{}{"city": "berlin", "zip": "10115"},
+				"empty":   map[string]interface{}{},
+			})
+		})
+		require.NoError(t, err)
+
+		t.Run("then objects should be stored as maps", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			cnt, err := rtx.Count("doc/address")
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), cnt)
+		})
+
+		t.Run("then arrays should be stored as lists", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			d, err := rtx.GetAt("doc/tags", 1)
+			require.NoError(t, err)
+			require.Equal(t, `"b"`, string(d))
+		})
+
+		t.Run("then scalars should be stored as their JSON encoding", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			d, err := rtx.Get("doc/age")
+			require.NoError(t, err)
+			require.Equal(t, "42", string(d))
+		})
+
+		t.Run("then I should get the document back", func(t *testing.T) {
+			require.JSONEq(t, `{"name":"alice","age":42,"admin":false,"manager":null,"tags":["a","b"],"address":{"city":"berlin","zip":"10115"},"empty":{}}`, getJSON(t, "doc"))
+		})
+	})
+
+	t.Run("when I change a single field of the document", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.PutJSON("doc/address/city", "paris")
+		})
+		require.NoError(t, err)
+
+		t.Run("then the document should contain the new value", func(t *testing.T) {
+			require.JSONEq(t, `{"name":"alice","age":42,"admin":false,"manager":null,"tags":["a","b"],"address":{"city":"paris","zip":"10115"},"empty":{}}`, getJSON(t, "doc"))
+		})
+	})
+
+	t.Run("when I put raw JSON", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.PutJSON("raw", json.RawMessage(`[1, [2, 3], {"a/b": 12345678901234567890}]`))
+		})
+		require.NoError(t, err)
+
+		t.Run("then numbers and keys should be kept exactly", func(t *testing.T) {
+			require.Equal(t, `[1,[2,3],{"a/b":12345678901234567890}]`, getJSON(t, "raw"))
+		})
+	})
+
+	t.Run("when I get a document containing a value that is not JSON", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("doc/name", []byte("alice"))
+		})
+		require.NoError(t, err)
+
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		_, err := rtx.GetJSON("doc")
+
+		t.Run("then it should fail", func(t *testing.T) {
+			require.Error(t, err)
+		})
+	})
+}
@@ -0,0 +1,176 @@
+package immersadb
+
+import (
+	"io/ioutil"
+
+	"github.com/draganm/immersadb/data"
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbblist"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+var ErrNotAList = wbblist.ErrNotAList
+
+var ErrIndexOutOfRange = wbblist.ErrIndexOutOfRange
+
+// CreateList creates an empty ordered list at the path.
+func (t *Transaction) CreateList(path string) (err error) {
+	defer t.guard(&err)()
+
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	return t.write(parts, func(old store.Address) (store.Address, error) {
+		occupied, err := t.occupied(parts, old)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if occupied {
+			return store.NilAddress, ErrAlreadyExists
+		}
+
+		ea, err := wbblist.CreateEmpty(t.st)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating empty list")
+		}
+
+		return ea, nil
+	})
+}
+
+// Append adds the value to the end of the list.
+func (t *Transaction) Append(path string, d []byte) (err error) {
+	defer t.guard(&err)()
+	return t.modifyList(path, func(la store.Address) (store.Address, error) {
+		cnt, err := wbblist.Count(t.st, la)
+		if err != nil {
+			return store.NilAddress, err
+		}
+		return t.insertIntoList(la, cnt, d)
+	})
+}
+
+// Insert inserts the value at the index of the list, shifting following elements by one.
+func (t *Transaction) Insert(path string, at uint64, d []byte) (err error) {
+	defer t.guard(&err)()
+	return t.modifyList(path, func(la store.Address) (store.Address, error) {
+		return t.insertIntoList(la, at, d)
+	})
+}
+
+// Remove removes the element at the index of the list.
+func (t *Transaction) Remove(path string, at uint64) (err error) {
+	defer t.guard(&err)()
+	return t.modifyList(path, func(la store.Address) (store.Address, error) {
+		nla, err := wbblist.Delete(t.st, la, at)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if nla == store.NilAddress {
+			return wbblist.CreateEmpty(t.st)
+		}
+
+		return nla, nil
+	})
+}
+
+func (t *Transaction) insertIntoList(la store.Address, at uint64, d []byte) (store.Address, error) {
+	da, err := t.storeData(d)
+	if err != nil {
+		return store.NilAddress, err
+	}
+	return wbblist.Insert(t.st, la, at, da)
+}
+
+// modifyList replaces the list at the path with the result of f, which is passed the list.
+// Like write, it keeps index entries up to date, but the list keeps its expiry.
+func (t *Transaction) modifyList(path string, f func(la store.Address) (store.Address, error)) error {
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	old, na, err := t.modifyElement(parts, func(la store.Address) (store.Address, error) {
+		occupied, err := t.occupied(parts, la)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if !occupied {
+			return store.NilAddress, errors.Wrapf(wbbtree.ErrNotFound, "list %q", path)
+		}
+
+		return f(la)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(parts) == 0 {
+		return nil
+	}
+
+	return t.modified(parts, old, na)
+}
+
+// Len returns the number of elements of the list.
+func (t *ReadTransaction) Len(path string) (n uint64, err error) {
+	defer t.guard(&err)()
+	la, err := t.pathElementAddress(path)
+	if err != nil {
+		return 0, err
+	}
+	return wbblist.Count(t.st, la)
+}
+
+// GetAt returns the value at the index of the list.
+func (t *ReadTransaction) GetAt(path string, i uint64) (d []byte, err error) {
+	defer t.guard(&err)()
+	la, err := t.pathElementAddress(path)
+	if err != nil {
+		return nil, err
+	}
+
+	va, err := wbblist.Get(t.st, la, i)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.readData(va)
+}
+
+// ForEachItem calls f with the index and the value of every element of the list in order.
+func (t *ReadTransaction) ForEachItem(path string, f func(i uint64, value []byte) error) (err error) {
+	defer t.guard(&err)()
+	la, err := t.pathElementAddress(path)
+	if err != nil {
+		return err
+	}
+
+	return wbblist.ForEach(t.st, la, func(i uint64, va store.Address) error {
+		err := t.ctx.Err()
+		if err != nil {
+			return err
+		}
+		d, err := t.readData(va)
+		if err != nil {
+			return err
+		}
+		return f(i, d)
+	})
+}
+
+func (t *ReadTransaction) readData(a store.Address) ([]byte, error) {
+	r, err := data.NewReader(a, t.st)
+	if err != nil {
+		return nil, errors.Wrap(err, "while creating reader")
+	}
+
+	return ioutil.ReadAll(contextReader{ctx: t.ctx, r: r})
+}
@@ -0,0 +1,138 @@
+package immersadb_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLists(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	t.Run("when I create a list and modify it", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			err := tx.CreateList("events")
+			if err != nil {
+				return err
+			}
+
+			for _, e := range []string{"b", "d", "e"} {
+				err = tx.Append("events", []byte(e))
+				if err != nil {
+					return err
+				}
+			}
+
+			err = tx.Insert("events", 0, []byte("a"))
+			if err != nil {
+				return err
+			}
+
+			err = tx.Insert("events", 2, []byte("c"))
+			if err != nil {
+				return err
+			}
+
+			return tx.Remove("events", 4)
+		})
+		require.NoError(t, err)
+
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+
+		t.Run("then the list should have the expected length", func(t *testing.T) {
+			l, err := rtx.Len("events")
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), l)
+		})
+
+		t.Run("then I should be able to get elements by index", func(t *testing.T) {
+			d, err := rtx.GetAt("events", 2)
+			require.NoError(t, err)
+			require.Equal(t, []byte("c"), d)
+		})
+
+		t.Run("then iterating should return elements in order", func(t *testing.T) {
+			items := []string{}
+			err := rtx.ForEachItem("events", func(i uint64, v []byte) error {
+				require.Equal(t, uint64(len(items)), i)
+				items = append(items, string(v))
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{"a", "b", "c", "d"}, items)
+		})
+
+		t.Run("then getting an element past the end should fail", func(t *testing.T) {
+			_, err := rtx.GetAt("events", 4)
+			require.Equal(t, immersadb.ErrIndexOutOfRange, errors.Cause(err))
+		})
+
+		t.Run("then iterating over the root map should return the list key", func(t *testing.T) {
+			keys := []string{}
+			err := rtx.ForEach("", func(k string) error {
+				keys = append(keys, k)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{"events"}, keys)
+		})
+	})
+
+	t.Run("when I append to a map", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Append("", []byte("x"))
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestListInIndexedMap(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+
+	require.NoError(t, db.RegisterIndex("byCity", "users", cityOf))
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		err := tx.CreateMap("users")
+		if err != nil {
+			return err
+		}
+		err = tx.Put("users/u1", []byte("ann,berlin"))
+		if err != nil {
+			return err
+		}
+		return tx.CreateList("users/log")
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Close())
+
+	db, err = immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	t.Run("when I append to a list in the map before registering the index", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Append("users/log", []byte("x"))
+		})
+		require.NoError(t, err)
+
+		t.Run("then looking up the index should fail with ErrIndexStale", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			_, err := rtx.LookupIndex("byCity", []byte("berlin"))
+			require.Equal(t, immersadb.ErrIndexStale, errors.Cause(err))
+		})
+	})
+}
@@ -0,0 +1,86 @@
+package immersadb_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+
+	t.Run("when I open the database for writing a second time", func(t *testing.T) {
+		_, err := immersadb.Open(td)
+		t.Run("then it should fail with ErrLocked", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrLocked, errors.Cause(err))
+		})
+	})
+
+	t.Run("when I open the database read only while it is opened for writing", func(t *testing.T) {
+		rdb1, err := immersadb.OpenReadOnly(td)
+		require.NoError(t, err)
+		defer rdb1.Close()
+
+		t.Run("then other read only openers should not be blocked", func(t *testing.T) {
+			rdb2, err := immersadb.OpenReadOnly(td)
+			require.NoError(t, err)
+			require.NoError(t, rdb2.Close())
+		})
+	})
+
+	t.Run("when the writer closes the database", func(t *testing.T) {
+		require.NoError(t, db.Close())
+
+		t.Run("then the database can be opened for writing again", func(t *testing.T) {
+			db, err = immersadb.Open(td)
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+		})
+	})
+
+	t.Run("when the readers lock file is missing", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(td, "lock.readers")))
+
+		t.Run("then the database can be opened read only", func(t *testing.T) {
+			rdb, err := immersadb.OpenReadOnly(td)
+			require.NoError(t, err)
+			require.NoError(t, rdb.Close())
+		})
+	})
+
+	t.Run("when old layer files have to be deleted while the database is opened read only", func(t *testing.T) {
+		rdb, err := immersadb.OpenReadOnly(td)
+		require.NoError(t, err)
+
+		old := filepath.Join(td, "l1-000000000000000000000000000")
+		require.NoError(t, ioutil.WriteFile(old, []byte{}, 0600))
+
+		_, err = immersadb.Open(td)
+
+		t.Run("then opening for writing should fail with ErrLocked", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrLocked, errors.Cause(err))
+		})
+
+		t.Run("then the old layer file should be kept", func(t *testing.T) {
+			_, err = os.Stat(old)
+			require.NoError(t, err)
+		})
+
+		require.NoError(t, rdb.Close())
+
+		t.Run("then the database can be opened for writing once the reader is closed", func(t *testing.T) {
+			db, err = immersadb.Open(td)
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+		})
+	})
+}
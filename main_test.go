@@ -0,0 +1,21 @@
+package immersadb_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/draganm/immersadb"
+)
+
+// TestMain runs all tests with each file backend.
+func TestMain(m *testing.M) {
+	code := 0
+	for _, b := range []immersadb.FileBackend{immersadb.FileBackendMmap, immersadb.FileBackendPread} {
+		immersadb.SetDefaultFileBackend(b)
+		c := m.Run()
+		if c != 0 {
+			code = c
+		}
+	}
+	os.Exit(code)
+}
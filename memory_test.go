@@ -0,0 +1,85 @@
+package immersadb_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenInMemory(t *testing.T) {
+	db, err := immersadb.OpenInMemory()
+	require.NoError(t, err)
+	defer db.Close()
+
+	t.Run("when values are put in several transactions", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put(fmt.Sprintf("v%d", i), make([]byte, 10*1024+i))
+			})
+			require.NoError(t, err)
+		}
+
+		t.Run("then all values can be read", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			for i := 0; i < 100; i++ {
+				d, err := rtx.Get(fmt.Sprintf("v%d", i))
+				require.NoError(t, err)
+				require.Len(t, d, 10*1024+i)
+			}
+
+			n, err := rtx.Count("")
+			require.NoError(t, err)
+			require.Equal(t, uint64(100), n)
+		})
+
+		t.Run("then the database can be backed up to disk", func(t *testing.T) {
+			td, cleanup := createTempDir(t)
+			defer cleanup()
+
+			bd := filepath.Join(td, "backup")
+			err = db.Backup(context.Background(), bd)
+			require.NoError(t, err)
+
+			bdb, err := immersadb.Open(bd)
+			require.NoError(t, err)
+			defer bdb.Close()
+
+			rtx := bdb.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("v99")
+			require.NoError(t, err)
+			require.Len(t, d, 10*1024+99)
+		})
+	})
+
+	t.Run("when a transaction is rolled back", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			err := tx.Put("rolled-back", []byte{1})
+			require.NoError(t, err)
+			return fmt.Errorf("rollback")
+		})
+		require.Error(t, err)
+
+		t.Run("then the value is not stored", func(t *testing.T) {
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			ex, err := rtx.Exists("rolled-back")
+			require.NoError(t, err)
+			require.False(t, ex)
+		})
+	})
+
+	t.Run("when the database is following", func(t *testing.T) {
+		err = db.Follow(context.Background(), nil)
+		t.Run("then an error is returned", func(t *testing.T) {
+			require.Error(t, err)
+		})
+	})
+}
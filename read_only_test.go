@@ -0,0 +1,73 @@
+package immersadb_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	t.Run("when the database was never opened for writing", func(t *testing.T) {
+		_, err := immersadb.OpenReadOnly(td)
+		t.Run("then opening it read only should fail", func(t *testing.T) {
+			require.Error(t, err)
+		})
+	})
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	put := func(t *testing.T, value []byte) {
+		err := db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("value", value)
+		})
+		require.NoError(t, err)
+	}
+
+	put(t, []byte{1})
+
+	t.Run("when I open the database read only", func(t *testing.T) {
+		rdb, err := immersadb.OpenReadOnly(td)
+		require.NoError(t, err)
+		defer rdb.Close()
+
+		rtx := rdb.NewReadTransaction()
+		defer rtx.Discard()
+
+		t.Run("then I should be able to read committed values", func(t *testing.T) {
+			d, err := rtx.Get("value")
+			require.NoError(t, err)
+			require.Equal(t, []byte{1}, d)
+		})
+
+		t.Run("then starting a transaction should fail", func(t *testing.T) {
+			_, err := rdb.NewTransaction()
+			require.Equal(t, immersadb.ErrReadOnly, errors.Cause(err))
+		})
+
+		t.Run("when the writer commits a new value", func(t *testing.T) {
+			put(t, []byte{2})
+
+			t.Run("then a new read transaction should see it", func(t *testing.T) {
+				rtx2 := rdb.NewReadTransaction()
+				defer rtx2.Discard()
+
+				d, err := rtx2.Get("value")
+				require.NoError(t, err)
+				require.Equal(t, []byte{2}, d)
+			})
+
+			t.Run("then the existing read transaction should see the old value", func(t *testing.T) {
+				d, err := rtx.Get("value")
+				require.NoError(t, err)
+				require.Equal(t, []byte{1}, d)
+			})
+		})
+	})
+}
@@ -1,9 +1,9 @@
 package immersadb
 
 import (
-	"io/ioutil"
+	"context"
+	"runtime/debug"
 
-	"github.com/draganm/immersadb/data"
 	"github.com/draganm/immersadb/dbpath"
 	"github.com/draganm/immersadb/store"
 	"github.com/draganm/immersadb/wbbtree"
@@ -11,11 +11,17 @@ import (
 )
 
 type ReadTransaction struct {
-	st   store.Store
-	root store.Address
+	ctx    context.Context
+	st     store.Store
+	root   store.Address
+	system store.Address
+	closed bool
 }
 
-func (t *ReadTransaction) Count(path string) (uint64, error) {
+// Count returns the number of keys of the map at the path.
+// Expired values are counted until they are deleted by the reaper.
+func (t *ReadTransaction) Count(path string) (n uint64, err error) {
+	defer t.guard(&err)()
 	pa, err := t.pathElementAddress(path)
 	if err != nil {
 		return 0, err
@@ -29,9 +35,31 @@ func (t *ReadTransaction) pathElementAddress(path string) (store.Address, error)
 		return store.NilAddress, err
 	}
 
+	ad, err := t.lookup(parts)
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	if len(parts) > 0 {
+		expired, err := t.expired(parts)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while checking expiry")
+		}
+
+		if expired {
+			return store.NilAddress, wbbtree.ErrNotFound
+		}
+	}
+
+	return ad, nil
+}
+
+// lookup returns the address of the element at the path, without checking its expiry.
+func (t *ReadTransaction) lookup(parts []string) (store.Address, error) {
 	ad := t.root
 
-	for _, p := range parts[:len(parts)] {
+	for _, p := range parts {
+		var err error
 		ad, err = wbbtree.Search(t.st, ad, []byte(p))
 		if err != nil {
 			return store.NilAddress, err
@@ -41,23 +69,21 @@ func (t *ReadTransaction) pathElementAddress(path string) (store.Address, error)
 	return ad, nil
 }
 
-func (t *ReadTransaction) Get(path string) ([]byte, error) {
+func (t *ReadTransaction) Get(path string) (d []byte, err error) {
+	defer t.guard(&err)()
 	pa, err := t.pathElementAddress(path)
 	if err != nil {
 		return nil, err
 	}
-	r, err := data.NewReader(pa, t.st)
-	if err != nil {
-		return nil, errors.Wrap(err, "while creating reader")
-	}
 
-	return ioutil.ReadAll(r)
+	return t.readData(pa)
 
 }
 
-func (t *ReadTransaction) Exists(path string) (bool, error) {
+func (t *ReadTransaction) Exists(path string) (exists bool, err error) {
+	defer t.guard(&err)()
 
-	_, err := t.pathElementAddress(path)
+	_, err = t.pathElementAddress(path)
 	if errors.Cause(err) == wbbtree.ErrNotFound {
 		return false, nil
 	}
@@ -69,6 +95,93 @@ func (t *ReadTransaction) Exists(path string) (bool, error) {
 	return true, nil
 }
 
+// ForEach calls f with every key of the map in ascending order, skipping expired values.
+func (t *ReadTransaction) ForEach(path string, f func(key string) error) (err error) {
+	defer t.guard(&err)()
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return err
+	}
+
+	ma, err := t.pathElementAddress(path)
+	if err != nil {
+		return err
+	}
+
+	expired, err := t.expiryCheck()
+	if err != nil {
+		return errors.Wrap(err, "while checking expiry")
+	}
+
+	return wbbtree.ForEach(t.st, ma, func(k []byte, _ store.Address) error {
+		err := t.ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		exp, err := expired(append(parts[:len(parts):len(parts)], string(k)))
+		if err != nil || exp {
+			return err
+		}
+
+		return f(string(k))
+	})
+}
+
 func (t *ReadTransaction) Discard() {
+	if t.closed {
+		return
+	}
 	t.st.FinishUse()
+	t.close()
+}
+
+// close makes the transaction unusable, so that methods called later
+// return ErrClosed instead of reading released layers.
+func (t *ReadTransaction) close() {
+	t.closed = true
+	t.st = nil
+}
+
+type elementKind int
+
+const (
+	kindMap elementKind = iota
+	kindList
+	kindValue
+)
+
+func (t *ReadTransaction) kindOf(a store.Address) (elementKind, error) {
+	tp := t.st.GetSegment(a).Type()
+	switch tp {
+	case store.TypeWBBTreeNode:
+		return kindMap, nil
+	case store.TypeListNode:
+		return kindList, nil
+	case store.TypeDataLeaf, store.TypeDataNode:
+		return kindValue, nil
+	default:
+		return 0, errors.Errorf("unexpected segment type %s at %s", tp, a)
+	}
+}
+
+// guard turns panics caused by a corrupt store, an invalid address or
+// a use after the transaction has finished into errors.
+// Public methods defer the returned function first.
+func (t *ReadTransaction) guard(err *error) func() {
+	old := debug.SetPanicOnFault(true)
+	return func() {
+		debug.SetPanicOnFault(old)
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		if t.closed {
+			*err = ErrClosed
+			return
+		}
+
+		*err = store.PanicToError(r)
+	}
 }
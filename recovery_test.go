@@ -0,0 +1,264 @@
+package immersadb_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/draganm/immersadb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryOnOpen(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+
+	t.Run("when the database is opened for the first time", func(t *testing.T) {
+		t.Run("then nothing should be cleaned", func(t *testing.T) {
+			require.True(t, db.RecoveryReport().IsEmpty())
+		})
+	})
+
+	put := func(t *testing.T, value []byte) {
+		err := db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("value", value)
+		})
+		require.NoError(t, err)
+	}
+
+	put(t, []byte{1})
+
+	manifest, err := ioutil.ReadFile(filepath.Join(td, "root"))
+	require.NoError(t, err)
+
+	put(t, []byte{2})
+
+	require.NoError(t, db.Close())
+
+	t.Run("when the database is left with abandoned files after a crash", func(t *testing.T) {
+		// the second commit did not finish writing the manifest
+		err = ioutil.WriteFile(filepath.Join(td, "root"), manifest, 0600)
+		require.NoError(t, err)
+
+		abandoned := []string{
+			"transaction-1Xq3aDOCnmKFGW1ka3cGLEpRvf8",
+			"l1-000000000000000000000000000",
+			"l2-zzzzzzzzzzzzzzzzzzzzzzzzzzz",
+			"root.tmp",
+		}
+
+		for _, f := range abandoned {
+			err = ioutil.WriteFile(filepath.Join(td, f), []byte{}, 0600)
+			require.NoError(t, err)
+		}
+
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+		defer func() {
+			db.Close()
+		}()
+
+		report := db.RecoveryReport()
+
+		t.Run("then abandoned transaction files and older layer files should be deleted", func(t *testing.T) {
+			// transaction files of the commits are deleted in the background and can be reported too
+			require.Subset(t, report.DeletedFiles, []string{
+				"transaction-1Xq3aDOCnmKFGW1ka3cGLEpRvf8",
+				"l1-000000000000000000000000000",
+				"root.tmp",
+			})
+
+			for _, f := range report.DeletedFiles {
+				_, err = os.Stat(filepath.Join(td, f))
+				require.True(t, os.IsNotExist(err))
+			}
+		})
+
+		t.Run("then newer layer files should be quarantined", func(t *testing.T) {
+			require.Equal(t, []string{"l2-zzzzzzzzzzzzzzzzzzzzzzzzzzz"}, report.QuarantinedFiles)
+			_, err = os.Stat(filepath.Join(td, "quarantine", "l2-zzzzzzzzzzzzzzzzzzzzzzzzzzz"))
+			require.NoError(t, err)
+		})
+
+		t.Run("then the segments written after the manifest should be discarded", func(t *testing.T) {
+			require.NotZero(t, report.DiscardedBytes[1])
+
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("value")
+			require.NoError(t, err)
+			require.Equal(t, []byte{1}, d)
+		})
+
+		t.Run("then new commits should be readable after reopening", func(t *testing.T) {
+			put(t, []byte{3})
+			require.NoError(t, db.Close())
+
+			db, err = immersadb.Open(td)
+			require.NoError(t, err)
+
+			require.Empty(t, db.RecoveryReport().QuarantinedFiles)
+			require.Equal(t, []uint64{0, 0, 0, 0}, db.RecoveryReport().DiscardedBytes)
+
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("value")
+			require.NoError(t, err)
+			require.Equal(t, []byte{3}, d)
+		})
+	})
+}
+
+func TestRecoveryQuarantine(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		return tx.Put("value", []byte{1})
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	abandon := func(t *testing.T, names ...string) {
+		for _, f := range names {
+			err := ioutil.WriteFile(filepath.Join(td, f), []byte{}, 0600)
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("when layer files have to be quarantined while the database is opened read only", func(t *testing.T) {
+		rdb, err := immersadb.OpenReadOnly(td)
+		require.NoError(t, err)
+
+		abandon(t, "l2-zzzzzzzzzzzzzzzzzzzzzzzzzz0")
+
+		_, err = immersadb.Open(td)
+
+		t.Run("then opening for writing should fail with ErrLocked", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrLocked, errors.Cause(err))
+		})
+
+		t.Run("then the layer file should not be quarantined", func(t *testing.T) {
+			_, err = os.Stat(filepath.Join(td, "l2-zzzzzzzzzzzzzzzzzzzzzzzzzz0"))
+			require.NoError(t, err)
+		})
+
+		require.NoError(t, rdb.Close())
+	})
+
+	t.Run("when more layer files are quarantined than the quarantine keeps", func(t *testing.T) {
+		abandon(t,
+			"l2-zzzzzzzzzzzzzzzzzzzzzzzzzz1",
+			"l2-zzzzzzzzzzzzzzzzzzzzzzzzzz2",
+			"l2-zzzzzzzzzzzzzzzzzzzzzzzzzz3",
+			"l2-zzzzzzzzzzzzzzzzzzzzzzzzzz4",
+			"l3-zzzzzzzzzzzzzzzzzzzzzzzzzz5",
+			"l3-zzzzzzzzzzzzzzzzzzzzzzzzzz6",
+			"l3-zzzzzzzzzzzzzzzzzzzzzzzzzz7",
+			"l3-zzzzzzzzzzzzzzzzzzzzzzzzzz8",
+			"l3-zzzzzzzzzzzzzzzzzzzzzzzzzz9",
+		)
+
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+		defer db.Close()
+
+		t.Run("then the oldest quarantined files should be deleted", func(t *testing.T) {
+			require.Len(t, db.RecoveryReport().QuarantinedFiles, 10)
+			require.Subset(t, db.RecoveryReport().DeletedFiles, []string{
+				filepath.Join("quarantine", "l2-zzzzzzzzzzzzzzzzzzzzzzzzzz0"),
+				filepath.Join("quarantine", "l2-zzzzzzzzzzzzzzzzzzzzzzzzzz1"),
+			})
+
+			files, err := ioutil.ReadDir(filepath.Join(td, "quarantine"))
+			require.NoError(t, err)
+			require.Len(t, files, 8)
+		})
+	})
+}
+
+func TestCommitWhenManifestCantBeWritten(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer func() {
+		db.Close()
+	}()
+
+	put := func(value []byte) error {
+		return db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put("value", value)
+		})
+	}
+
+	require.NoError(t, put([]byte{1}))
+
+	layers, err := filepath.Glob(filepath.Join(td, "l*"))
+	require.NoError(t, err)
+	seq := db.Seq()
+
+	tmp := filepath.Join(td, "root.tmp")
+	require.NoError(t, os.Mkdir(tmp, 0700))
+
+	t.Run("when I commit", func(t *testing.T) {
+		err := put([]byte{2})
+
+		t.Run("then the commit should fail", func(t *testing.T) {
+			require.Error(t, err)
+		})
+
+		t.Run("then the layer files of the previous commit should be kept", func(t *testing.T) {
+			// replaced layer files are deleted in the background
+			time.Sleep(100 * time.Millisecond)
+
+			current, err := filepath.Glob(filepath.Join(td, "l*"))
+			require.NoError(t, err)
+			require.Equal(t, layers, current)
+		})
+
+		t.Run("then the database should keep the previous commit", func(t *testing.T) {
+			require.Equal(t, seq, db.Seq())
+
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("value")
+			require.NoError(t, err)
+			require.Equal(t, []byte{1}, d)
+		})
+	})
+
+	require.NoError(t, os.Remove(tmp))
+
+	t.Run("when I commit after the manifest can be written again", func(t *testing.T) {
+		require.NoError(t, put([]byte{3}))
+		require.NoError(t, db.Close())
+
+		db, err = immersadb.Open(td)
+		require.NoError(t, err)
+
+		t.Run("then the commit should survive reopening", func(t *testing.T) {
+			require.Equal(t, seq+1, db.Seq())
+
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("value")
+			require.NoError(t, err)
+			require.Equal(t, []byte{3}, d)
+		})
+	})
+}
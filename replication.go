@@ -0,0 +1,382 @@
+package immersadb
+
+import (
+	"context"
+	"encoding/gob"
+	serrors "errors"
+	"io"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// Replication protocol
+//
+// A follower connects and sends a replicationHello with the sequence number
+// of the last commit it applied and the name and size of each of its layer files.
+// The primary answers with a replicationUpdate for every commit (several commits
+// can be folded into one update), each followed by the replicationChunks of the layers.
+// Since layer files are append only, a layer with the same file name on both sides
+// is brought up to date by shipping the appended segments only. Layers that were
+// compacted or pushed down into a new file are shipped completely.
+//
+// A follower resumes from the name and size of its layer files, not from Seq,
+// so an update that was only partly applied is completed by the next one.
+// The sequence number and the layer sizes are written together in the manifest
+// once an update is applied, which makes them survive restarts of both sides.
+// Segments are appended after the used part of the layer files, which neither
+// read transactions of the follower nor read only openers of its dir read
+// before the manifest listing them is written.
+
+// ErrFollowing is returned when a transaction is started on a database that follows a primary.
+var ErrFollowing = serrors.New("database is following a primary")
+
+const replicationChunkSize = 1024 * 1024
+
+type replicationHello struct {
+	Seq    uint64
+	Layers []store.LayerState
+}
+
+type replicationUpdate struct {
+	Seq    uint64
+	Root   store.Address
+	Layers []replicatedLayer
+}
+
+type replicatedLayer struct {
+	Layer  int
+	Name   string
+	Offset uint64
+	Length uint64
+}
+
+type replicationChunk struct {
+	Data []byte
+}
+
+// Seq returns the sequence number of the last commit, which is kept in the manifest.
+// On a follower it is the sequence number of the last commit replicated from the primary.
+func (db *DB) Seq() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.seq
+}
+
+// closeOnDone closes conn when ctx is done, if conn can be closed.
+// The returned function stops the watching.
+func closeOnDone(ctx context.Context, conn io.ReadWriter) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c, isCloser := conn.(io.Closer)
+			if isCloser {
+				c.Close()
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// ServeReplication streams commits to a follower connected through conn.
+// It returns when ctx is cancelled or the connection fails.
+// If conn implements io.Closer, it is closed when ctx is cancelled.
+func (db *DB) ServeReplication(ctx context.Context, conn io.ReadWriter) error {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	hello := replicationHello{}
+	err := dec.Decode(&hello)
+	if err != nil {
+		return errors.Wrap(err, "while reading hello from follower")
+	}
+
+	followerLayers := make([]store.LayerState, store.MaxLayers)
+	copy(followerLayers, hello.Layers)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.mu.Lock()
+			db.commitCond.Broadcast()
+			db.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	sent := hello.Seq
+	first := true
+
+	for {
+		db.mu.Lock()
+		for !first && db.seq == sent && ctx.Err() == nil {
+			db.commitCond.Wait()
+		}
+
+		if ctx.Err() != nil {
+			db.mu.Unlock()
+			return ctx.Err()
+		}
+
+		st := db.st
+		st.StartUse()
+		root := db.root
+		seq := db.seq
+		states := st.LayerStates()
+		db.mu.Unlock()
+
+		err = sendReplicationUpdate(enc, st, root, seq, followerLayers, states)
+		st.FinishUse()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrapf(err, "while sending update %d", seq)
+		}
+
+		followerLayers = states
+		sent = seq
+		first = false
+	}
+}
+
+func sendReplicationUpdate(enc *gob.Encoder, st store.Store, root store.Address, seq uint64, followerLayers, states []store.LayerState) error {
+	u := replicationUpdate{
+		Seq:  seq,
+		Root: root,
+	}
+
+	for i := 1; i < len(states); i++ {
+		fl := followerLayers[i]
+		pl := states[i]
+
+		if fl.Name != pl.Name {
+			u.Layers = append(u.Layers, replicatedLayer{
+				Layer:  i,
+				Name:   pl.Name,
+				Offset: 0,
+				Length: pl.Size,
+			})
+			continue
+		}
+
+		if fl.Size > pl.Size {
+			return errors.Errorf("follower has %d bytes of layer %d, primary only %d", fl.Size, i, pl.Size)
+		}
+
+		if fl.Size == pl.Size {
+			continue
+		}
+
+		u.Layers = append(u.Layers, replicatedLayer{
+			Layer:  i,
+			Name:   pl.Name,
+			Offset: fl.Size,
+			Length: pl.Size - fl.Size,
+		})
+	}
+
+	err := enc.Encode(u)
+	if err != nil {
+		return errors.Wrap(err, "while sending update")
+	}
+
+	for _, l := range u.Layers {
+		end := l.Offset + l.Length
+		for offset := l.Offset; offset < end; {
+			d, err := st.ReadSegments(l.Layer, offset, end, replicationChunkSize)
+			if err != nil {
+				return errors.Wrapf(err, "while reading layer %d", l.Layer)
+			}
+
+			err = enc.Encode(replicationChunk{Data: d})
+			if err != nil {
+				return errors.Wrap(err, "while sending chunk")
+			}
+
+			offset += uint64(len(d))
+		}
+	}
+
+	return nil
+}
+
+// Follow replicates commits of a primary connected through conn, which
+// has to be served by ServeReplication on the primary side.
+// While following, read transactions see the last replicated commit and
+// NewTransaction returns ErrFollowing.
+// Follow returns when ctx is cancelled or the connection fails, after which
+// it can be called again with a new connection to resume the replication.
+// If conn implements io.Closer, it is closed when ctx is cancelled.
+func (db *DB) Follow(ctx context.Context, conn io.ReadWriter) error {
+	db.mu.Lock()
+
+	if db.readOnly {
+		db.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	if db.dir == "" {
+		db.mu.Unlock()
+		return errors.New("databases in memory can't follow")
+	}
+
+	for db.txActive && db.reaping {
+		db.commitCond.Wait()
+	}
+
+	if db.txActive {
+		db.mu.Unlock()
+		return errors.New("cannot follow, there is a transaction in progress")
+	}
+
+	if db.following {
+		db.mu.Unlock()
+		return ErrFollowing
+	}
+
+	db.following = true
+
+	hello := replicationHello{
+		Seq:    db.seq,
+		Layers: db.st.LayerStates(),
+	}
+
+	db.mu.Unlock()
+
+	defer db.stopFollowing()
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	err := enc.Encode(hello)
+	if err != nil {
+		return errors.Wrap(err, "while sending hello to primary")
+	}
+
+	for {
+		u := replicationUpdate{}
+		err = dec.Decode(&u)
+		if err == nil {
+			err = db.applyReplicationUpdate(dec, u)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "while replicating")
+		}
+	}
+}
+
+func (db *DB) stopFollowing() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.following = false
+
+	// replicated commits did not update the index
+	if db.leafIndex != nil {
+		db.leafIndex = newLeafIndex()
+	}
+}
+
+func (db *DB) applyReplicationUpdate(dec *gob.Decoder, u replicationUpdate) (err error) {
+	db.mu.Lock()
+	ns := make(store.Store, len(db.st))
+	copy(ns, db.st)
+	db.mu.Unlock()
+
+	created := []*store.SegmentFile{}
+
+	defer func() {
+		if err != nil {
+			for _, sf := range created {
+				go sf.CloseAndDelete()
+			}
+		}
+	}()
+
+	for _, l := range u.Layers {
+		if l.Layer < 1 || l.Layer >= len(ns) {
+			return errors.Errorf("invalid layer %d", l.Layer)
+		}
+
+		sf, isFile := ns[l.Layer].(*store.SegmentFile)
+		if !isFile {
+			return errors.Errorf("layer %d is not stored in a file", l.Layer)
+		}
+
+		if sf.Name() != l.Name {
+			if l.Offset != 0 {
+				return errors.Errorf("layer %d is in file %q, primary is appending to %q", l.Layer, sf.Name(), l.Name)
+			}
+
+			sf, err = store.CreateLayerFile(db.dir, l.Layer, l.Name, sf.Backend())
+			if err != nil {
+				return errors.Wrapf(err, "while creating file for layer %d", l.Layer)
+			}
+
+			created = append(created, sf)
+			ns[l.Layer] = sf
+		}
+
+		offset := l.Offset
+		end := l.Offset + l.Length
+
+		for offset < end {
+			c := replicationChunk{}
+			err = dec.Decode(&c)
+			if err != nil {
+				return errors.Wrap(err, "while reading chunk")
+			}
+
+			if len(c.Data) == 0 || offset+uint64(len(c.Data)) > end {
+				return errors.Errorf("unexpected chunk of %d bytes for layer %d", len(c.Data), l.Layer)
+			}
+
+			err = sf.AppendSegments(offset, c.Data)
+			if err != nil {
+				return errors.Wrapf(err, "while appending to layer %d", l.Layer)
+			}
+
+			offset += uint64(len(c.Data))
+		}
+	}
+
+	// new files are sealed with the keys of the follower, like the ones they replace
+	ns.SetFormat(db.st.Format())
+
+	if u.Root == store.NilAddress || u.Root.Segment() == 0 || u.Root.Position() >= ns[u.Root.Segment()].UsedBytes() {
+		return errors.Errorf("invalid root %s", u.Root)
+	}
+
+	db.mu.Lock()
+	old := db.st
+	err = db.publish(ns, u.Root, u.Seq)
+	db.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	created = nil
+
+	deleteReplaced(old, ns)
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package immersadb_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/draganm/immersadb"
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	pd, cleanupPrimary := createTempDir(t)
+	defer cleanupPrimary()
+
+	fd, cleanupFollower := createTempDir(t)
+	defer cleanupFollower()
+
+	primary, err := immersadb.Open(pd)
+	require.NoError(t, err)
+	defer primary.Close()
+
+	follower, err := immersadb.Open(fd)
+	require.NoError(t, err)
+	defer func() {
+		follower.Close()
+	}()
+
+	put := func(t *testing.T, key string, value []byte) {
+		err := primary.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.Put(key, value)
+		})
+		require.NoError(t, err)
+	}
+
+	requireReplicated := func(t *testing.T, key string, value []byte) {
+		require.Eventually(t, func() bool {
+			rtx := follower.NewReadTransaction()
+			defer rtx.Discard()
+			d, err := rtx.Get(key)
+			return err == nil && string(d) == string(value)
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	connect := func() (context.CancelFunc, chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		pc, fc := net.Pipe()
+		errs := make(chan error, 2)
+		go func() {
+			errs <- primary.ServeReplication(ctx, pc)
+		}()
+		go func() {
+			errs <- follower.Follow(ctx, fc)
+		}()
+		return cancel, errs
+	}
+
+	disconnect := func(t *testing.T, cancel context.CancelFunc, errs chan error) {
+		cancel()
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errs:
+				require.Equal(t, context.Canceled, errors.Cause(err))
+			case <-time.After(5 * time.Second):
+				require.Fail(t, "replication did not stop")
+			}
+		}
+	}
+
+	put(t, "before", []byte{1})
+
+	t.Run("when the follower connects to the primary", func(t *testing.T) {
+		cancel, errs := connect()
+
+		t.Run("then the follower should receive existing data", func(t *testing.T) {
+			requireReplicated(t, "before", []byte{1})
+		})
+
+		t.Run("when I commit to the primary", func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				put(t, fmt.Sprintf("k%d", i), []byte{byte(i)})
+			}
+
+			t.Run("then the follower should receive the commits", func(t *testing.T) {
+				requireReplicated(t, "k9", []byte{9})
+				require.Eventually(t, func() bool {
+					return follower.Seq() == primary.Seq()
+				}, 5*time.Second, 10*time.Millisecond)
+			})
+		})
+
+		t.Run("then transactions on the follower should fail", func(t *testing.T) {
+			_, err := follower.NewTransaction()
+			require.Equal(t, immersadb.ErrFollowing, errors.Cause(err))
+		})
+
+		disconnect(t, cancel, errs)
+	})
+
+	t.Run("when I commit while the follower is disconnected", func(t *testing.T) {
+		seq := follower.Seq()
+		put(t, "offline", []byte{2})
+
+		t.Run("and the follower reconnects", func(t *testing.T) {
+			cancel, errs := connect()
+
+			t.Run("then it should resume from its sequence number", func(t *testing.T) {
+				requireReplicated(t, "offline", []byte{2})
+				require.Equal(t, seq+1, follower.Seq())
+			})
+
+			disconnect(t, cancel, errs)
+		})
+	})
+
+	t.Run("when the follower can't write its manifest", func(t *testing.T) {
+		seq := follower.Seq()
+		tmp := filepath.Join(fd, store.ManifestFileName+".tmp")
+		require.NoError(t, os.Mkdir(tmp, 0700))
+		put(t, "unpublished", []byte{4})
+
+		cancel, errs := connect()
+
+		t.Run("then following should fail", func(t *testing.T) {
+			select {
+			case err := <-errs:
+				require.Error(t, err)
+			case <-time.After(5 * time.Second):
+				require.Fail(t, "replication did not fail")
+			}
+		})
+
+		cancel()
+		<-errs
+
+		t.Run("then the follower should keep its previous state", func(t *testing.T) {
+			require.Equal(t, seq, follower.Seq())
+
+			rtx := follower.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("offline")
+			require.NoError(t, err)
+			require.Equal(t, []byte{2}, d)
+		})
+
+		require.NoError(t, os.Remove(tmp))
+
+		t.Run("and the follower reconnects", func(t *testing.T) {
+			cancel, errs := connect()
+
+			t.Run("then it should receive the update", func(t *testing.T) {
+				requireReplicated(t, "unpublished", []byte{4})
+				require.Equal(t, seq+1, follower.Seq())
+			})
+
+			disconnect(t, cancel, errs)
+		})
+	})
+
+	t.Run("when the follower stops following", func(t *testing.T) {
+		t.Run("then it should accept transactions", func(t *testing.T) {
+			err = follower.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put("promoted", []byte{3})
+			})
+			require.NoError(t, err)
+		})
+
+		t.Run("then the data should survive reopening the follower", func(t *testing.T) {
+			seq := follower.Seq()
+			require.NoError(t, follower.Close())
+			follower, err = immersadb.Open(fd)
+			require.NoError(t, err)
+
+			require.Equal(t, seq, follower.Seq())
+
+			rtx := follower.NewReadTransaction()
+			defer rtx.Discard()
+
+			d, err := rtx.Get("k5")
+			require.NoError(t, err)
+			require.Equal(t, []byte{5}, d)
+
+			d, err = rtx.Get("promoted")
+			require.NoError(t, err)
+			require.Equal(t, []byte{3}, d)
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package immersadb
+
+import (
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+	"runtime/debug"
+)
+
+// A committed root is a TypeCommit segment with two children:
+// the root map visible to users and the root of hidden system maps,
+// such as secondary indexes.
+// Without system maps, the user root map is committed directly,
+// which is also the format of databases created before system maps existed.
+
+// splitRoot returns the user and the system root of a committed root.
+func splitRoot(st store.Store, a store.Address) (user, system store.Address, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r != nil {
+			user, system, err = store.NilAddress, store.NilAddress, store.PanicToError(r)
+		}
+	}()
+
+	sr := st.GetSegment(a)
+	if sr.Type() != store.TypeCommit {
+		return a, store.NilAddress, nil
+	}
+
+	if sr.NumberOfChildren() != 2 {
+		return store.NilAddress, store.NilAddress, errors.Wrapf(store.ErrCorrupt, "commit segment at %s has %d children", a, sr.NumberOfChildren())
+	}
+
+	return sr.GetChildAddress(0), sr.GetChildAddress(1), nil
+}
+
+// joinRoot creates the committed root for the user and the system root.
+func joinRoot(st store.Store, user, system store.Address) (store.Address, error) {
+	if system == store.NilAddress {
+		return user, nil
+	}
+
+	sw, err := st.CreateSegment(0, store.TypeCommit, 2, 0)
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while creating commit segment")
+	}
+
+	sw.SetChild(0, user)
+	sw.SetChild(1, system)
+
+	return sw.Address, nil
+}
+
+// setRoot switches the database to a committed root.
+// It must be called with db.mu locked.
+func (db *DB) setRoot(a store.Address) error {
+	user, system, err := splitRoot(db.st, a)
+	if err != nil {
+		return errors.Wrap(err, "while reading root")
+	}
+
+	db.root = a
+	db.userRoot = user
+	db.systemRoot = system
+
+	return nil
+}
+
+// snapshot returns the store, the committed root and its sequence number.
+// The store is marked as used and has to be released with FinishUse.
+func (db *DB) snapshot() (store.Store, store.Address, uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, store.NilAddress, 0, ErrClosed
+	}
+
+	db.st.StartUse()
+
+	return db.st, db.root, db.seq, nil
+}
@@ -0,0 +1,39 @@
+package immersadb
+
+import (
+	serrors "errors"
+
+	"github.com/draganm/immersadb/store"
+)
+
+var ErrInvalidSavepoint = serrors.New("savepoint does not belong to the transaction")
+
+// Savepoint is a token for the state of a transaction at some point.
+type Savepoint struct {
+	tx     *Transaction
+	root   store.Address
+	system store.Address
+}
+
+// Savepoint returns a token for the current state of the transaction.
+// Taking a savepoint is cheap, since the state of a transaction is its root.
+func (t *Transaction) Savepoint() Savepoint {
+	return Savepoint{
+		tx:     t,
+		root:   t.root,
+		system: t.system,
+	}
+}
+
+// RollbackTo undoes all changes made after the savepoint was taken.
+// The transaction stays active and the savepoint can be used again.
+func (t *Transaction) RollbackTo(sp Savepoint) error {
+	if sp.tx != t {
+		return ErrInvalidSavepoint
+	}
+
+	t.root = sp.root
+	t.system = sp.system
+
+	return nil
+}
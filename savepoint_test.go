@@ -0,0 +1,74 @@
+package immersadb_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSavepoints(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.Open(td)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx, err := db.NewTransaction()
+	require.NoError(t, err)
+
+	require.NoError(t, tx.Put("good1", []byte{1}))
+
+	sp := tx.Savepoint()
+
+	t.Run("when I roll back to a savepoint", func(t *testing.T) {
+		require.NoError(t, tx.Put("bad", []byte{2}))
+		require.NoError(t, tx.Delete("good1"))
+
+		err = tx.RollbackTo(sp)
+		require.NoError(t, err)
+
+		t.Run("then changes after the savepoint should be undone", func(t *testing.T) {
+			ex, err := tx.Exists("bad")
+			require.NoError(t, err)
+			require.False(t, ex)
+		})
+
+		t.Run("then changes before the savepoint should be kept", func(t *testing.T) {
+			d, err := tx.Get("good1")
+			require.NoError(t, err)
+			require.Equal(t, []byte{1}, d)
+		})
+
+		t.Run("when I continue and commit the transaction", func(t *testing.T) {
+			require.NoError(t, tx.Put("good2", []byte{3}))
+			require.NoError(t, tx.Commit())
+
+			t.Run("then the committed state should contain only the good writes", func(t *testing.T) {
+				rtx := db.NewReadTransaction()
+				defer rtx.Discard()
+
+				cnt, err := rtx.Count("")
+				require.NoError(t, err)
+				require.Equal(t, uint64(2), cnt)
+
+				d, err := rtx.Get("good2")
+				require.NoError(t, err)
+				require.Equal(t, []byte{3}, d)
+			})
+		})
+	})
+
+	t.Run("when I roll back to a savepoint of another transaction", func(t *testing.T) {
+		tx2, err := db.NewTransaction()
+		require.NoError(t, err)
+		defer tx2.Rollback()
+
+		err = tx2.RollbackTo(sp)
+
+		t.Run("then it should fail", func(t *testing.T) {
+			require.Equal(t, immersadb.ErrInvalidSavepoint, err)
+		})
+	})
+}
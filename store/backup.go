@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+)
+
+// CopyLive copies all segments reachable from the root into the last layer of dst.
+// Children are copied before their parents, so the copied root is the last
+// segment of the layer, which makes dst a valid store on its own.
+func (s Store) CopyLive(ctx context.Context, root Address, dst Store) (na Address, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r != nil {
+			na, err = NilAddress, PanicToError(r)
+		}
+	}()
+
+	plan := newGCPlan([]LayerGCPlanStep{Flatten, Flatten, Flatten, Flatten}, CommitOptions{})
+	plan.ctx = ctx
+	return executeGCPlan(s, dst, root, plan)
+}
+
+// WriteLive writes the segments reachable from the root to w, in the format of
+// the last layer written by CopyLive, which WriteLastLayer restores.
+// Copying a segment reads the segments copied before it, so they are staged in
+// a temp file in tempDir, or the default dir for temp files if tempDir is empty.
+// The temp file grows as large as the copy and is deleted afterwards.
+func (s Store) WriteLive(ctx context.Context, root Address, w io.Writer, tempDir string) error {
+	f, err := ioutil.TempFile(tempDir, "immersadb-backup-")
+	if err != nil {
+		return errors.Wrap(err, "while creating temp file")
+	}
+
+	fileName := f.Name()
+	defer os.Remove(fileName)
+
+	err = f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "while closing %q", fileName)
+	}
+
+	sf, err := OpenOrCreateSegmentFileWithBackend(fileName, layers[len(layers)-1].maxSize, FileBackendPread)
+	if err != nil {
+		return err
+	}
+
+	defer sf.Close()
+
+	dst := make(Store, MaxLayers)
+	dst[MaxLayers-1] = sf
+	dst.SetFormat(s.Format())
+
+	_, err = s.CopyLive(ctx, root, dst)
+	if err != nil {
+		return errors.Wrap(err, "while copying live segments")
+	}
+
+	_, err = sf.WriteTo(w)
+	if err != nil {
+		return errors.Wrap(err, "while writing live segments")
+	}
+
+	return nil
+}
+
+// WriteLastLayer creates a file for the last layer in dir with the content read from r.
+// It is used to restore a store from a stream created from the last layer of a backup.
+func WriteLastLayer(dir string, r io.Reader) error {
+	fileName := filepath.Join(dir, fmt.Sprintf("%s-%s", layers[len(layers)-1].prefix, ksuid.New().String()))
+
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "while creating %q", fileName)
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "while writing %q", fileName)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "while syncing %q", fileName)
+	}
+
+	return f.Close()
+}
+
+// WriteTo writes the used part of the segment file to w.
+func (s *SegmentFile) WriteTo(w io.Writer) (int64, error) {
+	s.mu.Lock()
+	s.ensureNotClosed()
+	used := s.nextFreeByte
+	s.mu.Unlock()
+
+	if s.backend == FileBackendMmap && s.pendingSegment() == nil {
+		n, err := w.Write(s.mmap()[:used])
+		return int64(n), err
+	}
+
+	return io.Copy(w, io.NewSectionReader(s, 0, used))
+}
@@ -0,0 +1,259 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	serrors "errors"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWrongKey is returned when encrypted segments can't be read with the provided keys,
+// either because no key was provided or because none of the keys was used to seal them.
+var ErrWrongKey = serrors.New("wrong encryption key")
+
+// ErrDecryptionFailed is returned when a sealed payload was modified or is not at its address.
+var ErrDecryptionFailed = serrors.New("decryption failed")
+
+// Cipher seals payloads of segments.
+// Segment headers (length, type, layer sizes, children and hash) are never encrypted.
+type Cipher interface {
+	// Overhead is the number of bytes Seal adds to the plaintext.
+	Overhead() int
+	// Seal encrypts plaintext into dst, which must be len(plaintext)+Overhead() bytes long.
+	// The additional data is authenticated, but not stored.
+	Seal(dst, plaintext, additionalData []byte) error
+	// Open decrypts a payload created by Seal with the same additional data.
+	Open(sealed, additionalData []byte) ([]byte, error)
+	// KeyChecks returns the key checks of all keys known to the cipher.
+	KeyChecks() []KeyCheck
+}
+
+// KeyCheck identifies an encryption key by the id stored in payloads sealed with it.
+// Check is a constant sealed with the key, which tells if a key has the id without
+// revealing anything about the key. Key checks are kept in the manifest.
+type KeyCheck struct {
+	ID    uint32 `json:"id"`
+	Check []byte `json:"check"`
+}
+
+// sealed payload layout
+// key id: 4 bytes
+// nonce: 12 bytes
+// ciphertext with GCM tag
+
+const keyIDLength = 4
+
+var keyCheckPlaintext = make([]byte, 16)
+
+type aesGCMCipher struct {
+	currentID uint32
+	keys      []cipher.AEAD
+	checks    []KeyCheck
+
+	mu    sync.RWMutex
+	aeads map[uint32]cipher.AEAD
+}
+
+// NewAESGCMCipher creates a Cipher that seals with the current key.
+// Payloads sealed with any of the previous keys can still be opened.
+// Keys are identified by the key checks, a current key without a key check gets a new random id.
+// ErrWrongKey is returned if there are key checks and none of them matches one of the keys.
+func NewAESGCMCipher(checks []KeyCheck, current []byte, previous ...[]byte) (Cipher, error) {
+	c := &aesGCMCipher{
+		checks: append([]KeyCheck{}, checks...),
+		aeads:  map[uint32]cipher.AEAD{},
+	}
+
+	matched := false
+
+	for i, k := range append([][]byte{current}, previous...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while creating AES cipher for key %d", i)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while creating GCM for key %d", i)
+		}
+
+		c.keys = append(c.keys, aead)
+
+		id, found := identifyKey(aead, checks)
+		if found {
+			matched = true
+			c.aeads[id] = aead
+		}
+
+		if i != 0 {
+			continue
+		}
+
+		if !found {
+			kc, err := c.newKeyCheck(aead)
+			if err != nil {
+				return nil, err
+			}
+			c.checks = append(c.checks, kc)
+			id = kc.ID
+			c.aeads[id] = aead
+		}
+
+		c.currentID = id
+	}
+
+	if len(checks) != 0 && !matched {
+		return nil, ErrWrongKey
+	}
+
+	return c, nil
+}
+
+// keyCheckData is the additional data of a key check, which binds the check to the id.
+func keyCheckData(id uint32) []byte {
+	d := make([]byte, keyIDLength)
+	binary.BigEndian.PutUint32(d, id)
+	return append([]byte("key check "), d...)
+}
+
+func identifyKey(aead cipher.AEAD, checks []KeyCheck) (uint32, bool) {
+	for _, kc := range checks {
+		if len(kc.Check) < aead.NonceSize() {
+			continue
+		}
+
+		_, err := aead.Open(nil, kc.Check[:aead.NonceSize()], kc.Check[aead.NonceSize():], keyCheckData(kc.ID))
+		if err == nil {
+			return kc.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// newKeyCheck creates a key check with a random id that is not used by another key.
+func (c *aesGCMCipher) newKeyCheck(aead cipher.AEAD) (KeyCheck, error) {
+	idBytes := make([]byte, keyIDLength)
+
+	for {
+		_, err := io.ReadFull(rand.Reader, idBytes)
+		if err != nil {
+			return KeyCheck{}, errors.Wrap(err, "while generating key id")
+		}
+
+		id := binary.BigEndian.Uint32(idBytes)
+
+		if c.hasID(id) {
+			continue
+		}
+
+		nonce := make([]byte, aead.NonceSize())
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return KeyCheck{}, errors.Wrap(err, "while generating nonce")
+		}
+
+		return KeyCheck{
+			ID:    id,
+			Check: aead.Seal(nonce, nonce, keyCheckPlaintext, keyCheckData(id)),
+		}, nil
+	}
+}
+
+func (c *aesGCMCipher) hasID(id uint32) bool {
+	for _, kc := range c.checks {
+		if kc.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *aesGCMCipher) current() cipher.AEAD {
+	return c.keys[0]
+}
+
+func (c *aesGCMCipher) Overhead() int {
+	aead := c.current()
+	return keyIDLength + aead.NonceSize() + aead.Overhead()
+}
+
+func (c *aesGCMCipher) KeyChecks() []KeyCheck {
+	return append([]KeyCheck{}, c.checks...)
+}
+
+func (c *aesGCMCipher) Seal(dst, plaintext, additionalData []byte) error {
+	if len(dst) != len(plaintext)+c.Overhead() {
+		return errors.Errorf("destination has %d bytes, expected %d", len(dst), len(plaintext)+c.Overhead())
+	}
+
+	aead := c.current()
+
+	binary.BigEndian.PutUint32(dst, c.currentID)
+
+	nonce := dst[keyIDLength : keyIDLength+aead.NonceSize()]
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return errors.Wrap(err, "while generating nonce")
+	}
+
+	aead.Seal(dst[:keyIDLength+aead.NonceSize()], nonce, plaintext, additionalData)
+
+	return nil
+}
+
+// Open decrypts the payload with the key of its id.
+// Payloads with an id without a key check, such as those of a restored backup,
+// are opened by trying every key. The key that succeeds is then used for the id.
+func (c *aesGCMCipher) Open(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < keyIDLength {
+		return nil, ErrDecryptionFailed
+	}
+
+	id := binary.BigEndian.Uint32(sealed)
+
+	c.mu.RLock()
+	aead, found := c.aeads[id]
+	c.mu.RUnlock()
+
+	if found {
+		return open(aead, sealed, additionalData)
+	}
+
+	for _, aead := range c.keys {
+		plaintext, err := open(aead, sealed, additionalData)
+		if err != nil {
+			continue
+		}
+
+		if !c.hasID(id) {
+			c.mu.Lock()
+			c.aeads[id] = aead
+			c.mu.Unlock()
+		}
+
+		return plaintext, nil
+	}
+
+	return nil, ErrWrongKey
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < keyIDLength+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDecryptionFailed
+	}
+
+	nonce := sealed[keyIDLength : keyIDLength+aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, sealed[keyIDLength+aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,154 @@
+package store_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/draganm/immersadb/data"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAESGCMCipher(t *testing.T) {
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+
+	oldCipher, err := store.NewAESGCMCipher(nil, oldKey)
+	require.NoError(t, err)
+
+	ad := []byte("address")
+
+	sealed := make([]byte, 3+oldCipher.Overhead())
+	err = oldCipher.Seal(sealed, []byte{1, 2, 3}, ad)
+	require.NoError(t, err)
+
+	t.Run("when I open the payload with the same key", func(t *testing.T) {
+		d, err := oldCipher.Open(sealed, ad)
+		require.NoError(t, err)
+		require.Equal(t, []byte{1, 2, 3}, d)
+	})
+
+	t.Run("when I open the payload with other additional data", func(t *testing.T) {
+		_, err := oldCipher.Open(sealed, []byte("other address"))
+		require.Equal(t, store.ErrDecryptionFailed, err)
+	})
+
+	t.Run("when I open the payload with a different key", func(t *testing.T) {
+		c, err := store.NewAESGCMCipher(nil, newKey)
+		require.NoError(t, err)
+		_, err = c.Open(sealed, ad)
+		require.Equal(t, store.ErrWrongKey, err)
+	})
+
+	t.Run("when I create a cipher with a key that doesn't match the key checks", func(t *testing.T) {
+		_, err := store.NewAESGCMCipher(oldCipher.KeyChecks(), newKey)
+		require.Equal(t, store.ErrWrongKey, err)
+	})
+
+	t.Run("when I open the payload with the key as a previous key", func(t *testing.T) {
+		c, err := store.NewAESGCMCipher(oldCipher.KeyChecks(), newKey, oldKey)
+		require.NoError(t, err)
+		d, err := c.Open(sealed, ad)
+		require.NoError(t, err)
+		require.Equal(t, []byte{1, 2, 3}, d)
+
+		t.Run("then the new key should get a key check with a new id", func(t *testing.T) {
+			checks := c.KeyChecks()
+			require.Len(t, checks, 2)
+			require.Equal(t, oldCipher.KeyChecks()[0], checks[0])
+			require.NotEqual(t, checks[0].ID, checks[1].ID)
+		})
+	})
+
+	t.Run("when I open the payload with a key without a key check", func(t *testing.T) {
+		c, err := store.NewAESGCMCipher(nil, oldKey)
+		require.NoError(t, err)
+		d, err := c.Open(sealed, ad)
+		require.NoError(t, err)
+		require.Equal(t, []byte{1, 2, 3}, d)
+	})
+
+	t.Run("when the payload is tampered with", func(t *testing.T) {
+		tampered := append([]byte{}, sealed...)
+		tampered[len(tampered)-1] ^= 0xff
+		_, err := oldCipher.Open(tampered, ad)
+		require.Equal(t, store.ErrDecryptionFailed, err)
+	})
+}
+
+func TestEncryptedCommit(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	st, err := store.Open(td)
+	require.NoError(t, err)
+	defer st.Close()
+
+	c, err := store.NewAESGCMCipher(nil, []byte("0123456789abcdef"))
+	require.NoError(t, err)
+
+	st.SetFormat(store.Format{Cipher: c})
+
+	_, err = wbbtree.CreateEmpty(st[1:])
+	require.NoError(t, err)
+
+	txStore, err := st.WithTransaction()
+	require.NoError(t, err)
+
+	dw := data.NewDataWriter(txStore, 1024, 4)
+	_, err = dw.Write([]byte("attack at dawn"))
+	require.NoError(t, err)
+
+	da, err := dw.Finish()
+	require.NoError(t, err)
+
+	root, err := wbbtree.Insert(txStore, st.Root(), []byte("secret key"), da)
+	require.NoError(t, err)
+
+	newRoot, ns, err := txStore.Commit(root)
+	require.NoError(t, err)
+
+	defer ns.FinishUse()
+	defer txStore[0].CloseAndDelete()
+
+	t.Run("then keys and values should not be stored in plain text", func(t *testing.T) {
+		d, err := ns.ReadSegments(1, 0, ns[1].UsedBytes(), 1<<20)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(d, []byte("secret key")))
+		require.False(t, bytes.Contains(d, []byte("attack at dawn")))
+	})
+
+	t.Run("then keys and values should be readable with the key", func(t *testing.T) {
+		va, err := wbbtree.Search(ns, newRoot, []byte("secret key"))
+		require.NoError(t, err)
+
+		r, err := data.NewReader(va, ns)
+		require.NoError(t, err)
+
+		d, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("attack at dawn"), d)
+	})
+
+	t.Run("when I read the segments without the key", func(t *testing.T) {
+		ns.SetFormat(store.Format{})
+		defer ns.SetFormat(store.Format{Cipher: c})
+
+		t.Run("then reading should fail with ErrWrongKey", func(t *testing.T) {
+			err := func() (err error) {
+				defer func() {
+					r := recover()
+					if r != nil {
+						err = store.PanicToError(r)
+					}
+				}()
+				_, err = wbbtree.Search(ns, newRoot, []byte("secret key"))
+				return err
+			}()
+			require.Equal(t, store.ErrWrongKey, errors.Cause(err))
+		})
+	})
+}
@@ -1,6 +1,9 @@
 package store
 
 import (
+	"context"
+	"runtime/debug"
+
 	"github.com/pkg/errors"
 )
 
@@ -11,6 +14,11 @@ const (
 	Keep
 	PushDown
 	Compact
+	// Flatten copies segments to the last layer
+	Flatten
+	// MergeDown copies segments to the first deeper layer that is not merged down.
+	// It is used when the live bytes of shallower layers don't fit into the next layer.
+	MergeDown
 )
 
 func (s Store) newStoreFromPlan(steps []LayerGCPlanStep) (Store, error) {
@@ -21,7 +29,7 @@ func (s Store) newStoreFromPlan(steps []LayerGCPlanStep) (Store, error) {
 		case UnknownGCPlan, Keep:
 			ns[i] = s[i]
 			continue
-		case PushDown, Compact:
+		case PushDown, Compact, MergeDown:
 			nsf, err := s[i].CreateEmptySibling()
 			if err != nil {
 				return nil, errors.Wrap(err, "while creating new empty sibling")
@@ -33,149 +41,271 @@ func (s Store) newStoreFromPlan(steps []LayerGCPlanStep) (Store, error) {
 	return ns, nil
 }
 
+// discardNewLayers releases ns after a failed commit and deletes the layer files created for it.
+func (s Store) discardNewLayers(ns Store) {
+	ns.FinishUse()
+	for i := range ns {
+		if ns[i] != nil && ns[i] != s[i] {
+			ns[i].CloseAndDelete()
+		}
+	}
+}
+
+// garbageBytes returns the number of unreachable bytes in a layer.
+func (s Store) garbageBytes(layer int, live []uint64) uint64 {
+	return s[layer].UsedBytes() - live[layer]
+}
+
+// CommitOptions control how segments are rewritten while committing.
+// Payloads of copied segments are sealed with the cipher of their new layer.
+type CommitOptions struct {
+	// OnMove, if set, is called once for every segment that was copied
+	// to a new address.
+	OnMove func(from, to Address)
+}
+
 func (s Store) Commit(root Address) (Address, Store, error) {
+	return s.CommitWithOptions(root, CommitOptions{})
+}
+
+func (s Store) CommitWithOptions(root Address, opts CommitOptions) (Address, Store, error) {
+	return s.CommitWithContext(context.Background(), root, opts)
+}
+
+// CommitWithContext commits the transaction layer and stops copying segments once ctx is done.
+// A cancelled commit leaves s unchanged, apart from unreachable bytes appended to kept layers,
+// and deletes layer files created for the new store.
+func (s Store) CommitWithContext(ctx context.Context, root Address, opts CommitOptions) (newRoot Address, ns Store, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r != nil {
+			if ns != nil {
+				s.discardNewLayers(ns)
+			}
+			newRoot, ns, err = NilAddress, nil, PanicToError(r)
+		}
+	}()
 
 	if root.Segment() != 0 {
 		return NilAddress, nil, errors.New("root is not in layer 0")
 	}
 
-	plan := []LayerGCPlanStep{
-		PushDown,
-		Keep,
-		Keep,
-		Keep,
+	err = s.finishSegment(0)
+	if err != nil {
+		return NilAddress, nil, err
 	}
 
-	sr := s.GetSegment(root)
-
-	newBytes := sr.GetLayerTotalSize(0)
+	plan, err := s.plan(root)
+	if err != nil {
+		return NilAddress, nil, err
+	}
 
-	if !s[1].CanAppend(newBytes) {
-		l1GarbageBytes := uint64(s[1].nextFreeByte) - sr.GetLayerTotalSize(1)
-		if l1GarbageBytes+s[1].RemainingCapacity() >= newBytes {
-			plan[1] = Compact
-		} else {
-			plan[1] = PushDown
-		}
+	ns, err = s.newStoreFromPlan(plan)
+	if err != nil {
+		return NilAddress, nil, errors.Wrap(err, "while creating new store")
 	}
 
-	if plan[1] == PushDown {
+	ns.StartUse()
 
-		l1Bytes := sr.GetLayerTotalSize(1)
-		if !s[2].CanAppend(l1Bytes) {
-			l2GarbageBytes := uint64(s[2].nextFreeByte) - (sr.GetLayerTotalSize(2))
-			if l2GarbageBytes+s[2].RemainingCapacity() >= l1Bytes {
-				plan[2] = Compact
-			} else {
-				plan[2] = PushDown
-			}
+	gp := newGCPlan(plan, opts)
+	gp.ctx = ctx
 
-		}
+	newRoot, err = executeGCPlan(s, ns, root, gp)
+	if err != nil {
+		s.discardNewLayers(ns)
+		return NilAddress, nil, errors.Wrap(err, "while executing plan")
+	}
+
+	return newRoot, ns, nil
+}
 
+// plan decides what happens to each layer when the transaction layer is committed.
+// Bytes arriving at a layer are appended if they fit. Otherwise the layer is
+// compacted if that frees enough space, or its content is pushed down to the
+// next layer. Layers that could not hold the arriving bytes even when empty
+// are merged down together with them, so that a transaction can be larger than l1.
+// Live bytes are estimated from the layer totals in the header of the root,
+// and counted exactly only if the estimate doesn't fit into the store.
+func (s Store) plan(root Address) ([]LayerGCPlanStep, error) {
+	plan, err := s.planWithLiveSizes(s.estimatedLiveLayerSizes(root))
+	if errors.Cause(err) != ErrFull {
+		return plan, err
 	}
 
-	if plan[2] == PushDown {
+	return s.planWithLiveSizes(s.LiveLayerSizes(root, MaxLayers-1))
+}
 
-		l2Bytes := sr.GetLayerTotalSize(2)
-		if !s[3].CanAppend(l2Bytes) {
-			l3GarbageBytes := uint64(s[3].nextFreeByte) - (sr.GetLayerTotalSize(3))
-			if l3GarbageBytes+s[3].RemainingCapacity() >= l2Bytes {
-				plan[2] = Compact
-			} else {
-				return NilAddress, nil, errors.New("database is full")
-			}
+// estimatedLiveLayerSizes returns the layer totals of the root, which are kept
+// up to date by segment writers. A segment shared by several parents is counted
+// for each of them, so totals are capped at the used bytes of the layer.
+func (s Store) estimatedLiveLayerSizes(root Address) []uint64 {
+	sizes := make([]uint64, MaxLayers)
+	if root == NilAddress {
+		return sizes
+	}
 
+	sr := s.GetSegment(root)
+	for l := range s {
+		sizes[l] = sr.GetLayerTotalSize(l)
+		if s[l] != nil && sizes[l] > s[l].UsedBytes() {
+			sizes[l] = s[l].UsedBytes()
 		}
+	}
 
+	return sizes
+}
+
+func (s Store) planWithLiveSizes(live []uint64) ([]LayerGCPlanStep, error) {
+	plan := []LayerGCPlanStep{
+		PushDown,
+		Keep,
+		Keep,
+		Keep,
 	}
 
-	ns, err := s.newStoreFromPlan(plan)
-	if err != nil {
-		return NilAddress, nil, errors.Wrap(err, "while creating new store")
+	incoming := live[0]
+	layer := 1
+
+	for layer < len(s)-1 && incoming > s[layer].MaxSize() {
+		plan[layer-1] = MergeDown
+		plan[layer] = MergeDown
+		incoming += live[layer]
+		layer++
 	}
 
-	ns.StartUse()
+	for ; layer < len(s); layer++ {
+		if remainingCapacity(s[layer]) >= incoming {
+			return plan, nil
+		}
 
-	newRoot, err := executeGCPlan(s, ns, root, plan)
-	if err != nil {
-		return NilAddress, nil, errors.Wrap(err, "while executing plan")
+		if s.garbageBytes(layer, live)+remainingCapacity(s[layer]) >= incoming {
+			plan[layer] = Compact
+			return plan, nil
+		}
+
+		if layer == len(s)-1 {
+			return nil, ErrFull
+		}
+
+		plan[layer] = PushDown
+		incoming = live[layer]
 	}
 
-	return newRoot, ns, nil
+	return plan, nil
+}
+
+// gcPlan holds the per-layer steps of a commit and a forwarding table
+// of already copied segments, so that a segment reachable through
+// several parents is copied only once.
+type gcPlan struct {
+	ctx       context.Context
+	steps     []LayerGCPlanStep
+	opts      CommitOptions
+	forwarded map[Address]Address
+}
+
+func newGCPlan(steps []LayerGCPlanStep, opts CommitOptions) *gcPlan {
+	return &gcPlan{
+		ctx:       context.Background(),
+		steps:     steps,
+		opts:      opts,
+		forwarded: map[Address]Address{},
+	}
 }
 
-func executeGCPlan(s, ns Store, a Address, plan []LayerGCPlanStep) (Address, error) {
+func executeGCPlan(s, ns Store, a Address, plan *gcPlan) (Address, error) {
 
 	if a == NilAddress {
 		return NilAddress, nil
 	}
 
-	planStep := plan[a.Segment()]
+	planStep := plan.steps[a.Segment()]
 
-	switch planStep {
-	case Keep:
+	if planStep == Keep {
 		return a, nil
-	case PushDown:
-		sr := s.GetSegment(a)
-		nc := sr.NumberOfChildren()
+	}
 
-		children := []Address{}
+	fa, found := plan.forwarded[a]
+	if found {
+		return fa, nil
+	}
 
-		for i := 0; i < nc; i++ {
-			ca := sr.GetChildAddress(i)
-			nca, err := executeGCPlan(s, ns, ca, plan)
-			if err != nil {
-				return NilAddress, err
-			}
-			children = append(children, nca)
-		}
+	err := plan.ctx.Err()
+	if err != nil {
+		return NilAddress, err
+	}
 
-		d := sr.GetData()
-		wr, err := ns.CreateSegment(a.Segment()+1, sr.Type(), nc, len(d))
-		if err != nil {
-			return NilAddress, errors.Wrapf(err, "while creating segment on layer %d", a.Segment()+1)
-		}
+	var na Address
 
-		for i, ch := range children {
-			wr.SetChild(i, ch)
+	switch planStep {
+	case MergeDown:
+		target := a.Segment() + 1
+		for plan.steps[target] == MergeDown {
+			target++
 		}
+		na, err = copySegment(s, ns, a, target, plan)
+	case PushDown:
+		na, err = copySegment(s, ns, a, a.Segment()+1, plan)
+	case Compact:
+		na, err = copySegment(s, ns, a, a.Segment(), plan)
+	case Flatten:
+		na, err = copySegment(s, ns, a, MaxLayers-1, plan)
+	default:
+		return NilAddress, errors.Errorf("Unsupported plan step %d", planStep)
+	}
 
-		copy(wr.Data, d)
+	if err != nil {
+		return NilAddress, err
+	}
 
-		return wr.Address, nil
+	plan.forwarded[a] = na
 
-	case Compact:
+	if plan.opts.OnMove != nil {
+		plan.opts.OnMove(a, na)
+	}
 
-		sr := s.GetSegment(a)
-		nc := sr.NumberOfChildren()
+	return na, nil
 
-		children := []Address{}
+}
 
-		for i := 0; i < nc; i++ {
-			ca := sr.GetChildAddress(i)
-			nca, err := executeGCPlan(s, ns, ca, plan)
-			if err != nil {
-				return NilAddress, err
-			}
-			children = append(children, nca)
-		}
+func copySegment(s, ns Store, a Address, layer int, plan *gcPlan) (Address, error) {
+	sr := s.GetSegment(a)
+	nc := sr.NumberOfChildren()
+
+	children := []Address{}
 
-		d := sr.GetData()
-		wr, err := ns.CreateSegment(a.Segment(), sr.Type(), nc, len(d))
+	for i := 0; i < nc; i++ {
+		ca := sr.GetChildAddress(i)
+		nca, err := executeGCPlan(s, ns, ca, plan)
 		if err != nil {
-			return NilAddress, errors.Wrapf(err, "while creating segment on layer %d", a.Segment()+1)
+			return NilAddress, err
 		}
+		children = append(children, nca)
+	}
 
-		for i, ch := range children {
-			wr.SetChild(i, ch)
-		}
+	// the copy keeps the hash slot of the segment, so that it has the same size
+	wr, err := ns.createSegment(layer, sr.Type(), nc, len(sr.GetData()), sr.hasHashSlot())
+	if err != nil {
+		return NilAddress, errors.Wrapf(err, "while creating segment on layer %d", layer)
+	}
 
-		copy(wr.Data, d)
+	for i, ch := range children {
+		wr.SetChild(i, ch)
+	}
 
-		return wr.Address, nil
+	h, ok := sr.StoredHash()
+	if ok {
+		wr.setHash(h)
+	}
 
-	default:
-		return NilAddress, errors.Errorf("Unsupported plan step %d", planStep)
+	copy(wr.Data, sr.GetData())
+
+	// the payload is sealed with the key and the address of the copy
+	err = ns.finishSegment(layer)
+	if err != nil {
+		return NilAddress, err
 	}
 
+	return wr.Address, nil
 }
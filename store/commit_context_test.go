@@ -0,0 +1,65 @@
+package store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/draganm/immersadb/data"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelledCommit(t *testing.T) {
+	restore := store.SetLayerMaxSizes(4*1024, 1024*1024, 16*1024*1024)
+	defer restore()
+
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	st, err := store.Open(td)
+	require.NoError(t, err)
+	defer st.Close()
+
+	_, err = wbbtree.CreateEmpty(st[1:])
+	require.NoError(t, err)
+
+	txStore, err := st.WithTransaction()
+	require.NoError(t, err)
+	defer txStore[0].CloseAndDelete()
+
+	// more than l1 can take, so that the commit has to create new layer files
+	da, err := data.StoreData(txStore, make([]byte, 8*1024), 1024, 4)
+	require.NoError(t, err)
+
+	root, err := wbbtree.Insert(txStore, st.Root(), []byte("a"), da)
+	require.NoError(t, err)
+
+	filesBefore, err := ioutil.ReadDir(td)
+	require.NoError(t, err)
+
+	t.Run("when the context of the commit is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := txStore.CommitWithContext(ctx, root, store.CommitOptions{})
+
+		t.Run("then the commit should fail with the error of the context", func(t *testing.T) {
+			require.Equal(t, context.Canceled, errors.Cause(err))
+		})
+
+		t.Run("then the layer files created for the commit should be deleted", func(t *testing.T) {
+			filesAfter, err := ioutil.ReadDir(td)
+			require.NoError(t, err)
+			require.Equal(t, len(filesBefore), len(filesAfter))
+		})
+
+		t.Run("then the store should still be usable", func(t *testing.T) {
+			_, ns, err := txStore.Commit(root)
+			require.NoError(t, err)
+			ns.FinishUse()
+		})
+	})
+}
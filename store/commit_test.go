@@ -0,0 +1,60 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb/data"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitPreservesSharing(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	st, err := store.Open(td)
+	require.NoError(t, err)
+	defer st.Close()
+
+	_, err = wbbtree.CreateEmpty(st[1:])
+	require.NoError(t, err)
+
+	txStore, err := st.WithTransaction()
+	require.NoError(t, err)
+	defer txStore[0].CloseAndDelete()
+
+	da, err := data.StoreData(txStore, []byte{1, 2, 3}, 1024, 4)
+	require.NoError(t, err)
+
+	root, err := wbbtree.Insert(txStore, st.Root(), []byte("a"), da)
+	require.NoError(t, err)
+
+	root, err = wbbtree.Insert(txStore, root, []byte("b"), da)
+	require.NoError(t, err)
+
+	t.Run("live layer sizes should count the shared value once", func(t *testing.T) {
+		live := txStore.LiveLayerSizes(root, 0)
+		require.True(t, live[0] < txStore.GetSegment(root).GetLayerTotalSize(0))
+	})
+
+	usedBefore := st[1].UsedBytes()
+	liveBefore := txStore.LiveLayerSizes(root, 0)
+
+	newRoot, ns, err := txStore.Commit(root)
+	require.NoError(t, err)
+	defer ns.FinishUse()
+
+	t.Run("then both keys should point to the same copy", func(t *testing.T) {
+		a, err := wbbtree.Search(ns, newRoot, []byte("a"))
+		require.NoError(t, err)
+		b, err := wbbtree.Search(ns, newRoot, []byte("b"))
+		require.NoError(t, err)
+		require.Equal(t, a, b)
+		require.Equal(t, 1, a.Segment())
+	})
+
+	t.Run("then the shared value should be copied once", func(t *testing.T) {
+		require.Equal(t, liveBefore[0], ns[1].UsedBytes()-usedBefore)
+	})
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	serrors "errors"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCorrupt is returned when segments can't be read because the store is corrupt.
+var ErrCorrupt = serrors.New("store is corrupt")
+
+// ErrClosed is returned when a closed store or transaction is used.
+var ErrClosed = serrors.New("closed")
+
+// ErrInvalidAddress is returned for addresses that don't point to a segment.
+var ErrInvalidAddress = serrors.New("invalid address")
+
+// ErrFull is returned by commits that don't fit into the layers of the store.
+var ErrFull = serrors.New("database is full")
+
+// ErrIO is returned when segments can't be read from a layer file opened with FileBackendPread.
+var ErrIO = serrors.New("I/O error")
+
+// Reading segments panics with one of the errors above or an error of the cipher wrapped, since
+// threading errors through every segment access would be impractical.
+// PanicToError turns such panics back into errors at the API boundary.
+
+// faultError is implemented by the runtime error raised for a fault in a memory
+// mapped region when debug.SetPanicOnFault is enabled.
+type faultError interface {
+	Addr() uintptr
+}
+
+// PanicToError returns the error for a recovered panic value.
+// Faults in memory mapped layers, such as reading past the end of a truncated file,
+// are reported as ErrCorrupt. Other panics, including other runtime errors, are re-raised.
+func PanicToError(r interface{}) error {
+	if r == nil {
+		return nil
+	}
+
+	err, isError := r.(error)
+	if !isError {
+		panic(r)
+	}
+
+	switch errors.Cause(err) {
+	case ErrCorrupt, ErrClosed, ErrInvalidAddress, ErrIO, ErrWrongKey, ErrDecryptionFailed:
+		return err
+	}
+
+	_, isRuntimeError := err.(runtime.Error)
+	_, isFault := err.(faultError)
+	if isRuntimeError && isFault {
+		return errors.Wrap(ErrCorrupt, err.Error())
+	}
+
+	panic(r)
+}
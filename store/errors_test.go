@@ -0,0 +1,39 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanicToError(t *testing.T) {
+	t.Run("when the address points to a layer the store does not have", func(t *testing.T) {
+		st := store.OpenInMemory()
+
+		err := func() (err error) {
+			defer func() {
+				err = store.PanicToError(recover())
+			}()
+			st[1:].GetSegment(store.NewAddress(3, 0))
+			return nil
+		}()
+
+		t.Run("then it should return ErrInvalidAddress", func(t *testing.T) {
+			require.Equal(t, store.ErrInvalidAddress, errors.Cause(err))
+		})
+	})
+
+	t.Run("when the panic is a runtime error other than a fault", func(t *testing.T) {
+		t.Run("then it should be re-raised", func(t *testing.T) {
+			require.Panics(t, func() {
+				defer func() {
+					store.PanicToError(recover())
+				}()
+				var s []int
+				_ = s[len(s)+1]
+			})
+		})
+	})
+}
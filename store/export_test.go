@@ -0,0 +1,21 @@
+package store
+
+// SetLayerMaxSizes changes maximum sizes of layers opened afterwards.
+// It returns a function restoring the previous sizes.
+func SetLayerMaxSizes(sizes ...uint64) func() {
+	old := make([]uint64, len(layers))
+	for i := range layers {
+		old[i] = layers[i].maxSize
+		layers[i].maxSize = sizes[i]
+	}
+	return func() {
+		for i := range layers {
+			layers[i].maxSize = old[i]
+		}
+	}
+}
+
+// CloseFile closes the file of a segment file, so that reading it fails.
+func CloseFile(s *SegmentFile) error {
+	return s.f.Close()
+}
@@ -0,0 +1,264 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+)
+
+// HashSize is the size of the content hash stored in segments.
+const HashSize = sha256.Size
+
+// hashedFlag is set in the type byte of segments with a hash slot.
+const hashedFlag = 0x80
+
+// Hash identifies the content of a map, list or value.
+type Hash [HashSize]byte
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// Digests
+//
+// The hash slot of a segment holds its digest. The digest of a data leaf is the SHA-256
+// of its data and the one of a data node the SHA-256 of the digests of its children.
+// The digest of map and list nodes covers the entries of their sub-tree in order,
+// e1 + e2*r + ... + en*r^(n-1) mod p, where ei is the digest of an entry.
+// It is computed from the digests of both sub-trees and the number of entries
+// in the left one, so it doesn't depend on the shape of the tree.
+// Keys of maps are sorted, so maps with the same entries have the same digest.
+// Empty nodes have the digest zero.
+
+var (
+	digestModulus = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	digestBase    = toDigestInt(sha256.Sum256([]byte("immersadb digest base")))
+)
+
+func toDigestInt(h Hash) *big.Int {
+	i := new(big.Int).SetBytes(h[:])
+	return i.Mod(i, digestModulus)
+}
+
+func fromDigestInt(i *big.Int) Hash {
+	h := Hash{}
+	b := i.Bytes()
+	copy(h[len(h)-len(b):], b)
+	return h
+}
+
+// ConcatDigests returns the digest of the entries of a followed by the entries of b,
+// where a has n entries.
+func ConcatDigests(a Hash, n uint64, b Hash) Hash {
+	d := new(big.Int).Exp(digestBase, new(big.Int).SetUint64(n), digestModulus)
+	d.Mul(d, toDigestInt(b))
+	d.Add(d, toDigestInt(a))
+	return fromDigestInt(d.Mod(d, digestModulus))
+}
+
+// EntryDigest returns the digest of an entry of a map or a list with the hash of its value.
+// Entries of lists have no key.
+func EntryDigest(key []byte, value Hash) Hash {
+	hs := sha256.New()
+	writeLength(hs, len(key))
+	hs.Write(key)
+	hs.Write(value[:])
+
+	h := Hash{}
+	copy(h[:], hs.Sum(nil))
+
+	return fromDigestInt(toDigestInt(h))
+}
+
+func writeLength(w interface{ Write([]byte) (int, error) }, l int) {
+	lb := [8]byte{}
+	binary.BigEndian.PutUint64(lb[:], uint64(l))
+	w.Write(lb[:])
+}
+
+// LeafDigest returns the digest of a data leaf with the data.
+func LeafDigest(data []byte) Hash {
+	hs := sha256.New()
+	hs.Write([]byte{'v'})
+	hs.Write(data)
+
+	h := Hash{}
+	copy(h[:], hs.Sum(nil))
+	return h
+}
+
+// elementHash returns the hash of a map, list or value from the digest of its root segment.
+func elementHash(segmentType SegmentType, digest Hash) Hash {
+	switch segmentType {
+	case TypeWBBTreeNode:
+		return sha256.Sum256(append([]byte{'m'}, digest[:]...))
+	case TypeListNode:
+		return sha256.Sum256(append([]byte{'l'}, digest[:]...))
+	default:
+		return digest
+	}
+}
+
+// isEmptyNode returns true for map and list nodes without entries.
+func isEmptyNode(sr SegmentReader) bool {
+	if sr.Type() != TypeWBBTreeNode && sr.Type() != TypeListNode {
+		return false
+	}
+
+	for i := 0; i < sr.NumberOfChildren(); i++ {
+		if sr.GetChildAddress(i) != NilAddress {
+			return false
+		}
+	}
+
+	return true
+}
+
+// childDigest returns the digest and the type of a child segment.
+type childDigest func(i int) (Hash, SegmentType, bool)
+
+// digestSegment computes the digest of a segment with unsealed data.
+// It returns false if the digest of a child is not known.
+func digestSegment(sr SegmentReader, child childDigest) (Hash, bool) {
+	if isEmptyNode(sr) {
+		return Hash{}, true
+	}
+
+	nc := sr.NumberOfChildren()
+	children := make([]Hash, nc)
+	types := make([]SegmentType, nc)
+
+	for i := 0; i < nc; i++ {
+		h, t, ok := child(i)
+		if !ok {
+			return Hash{}, false
+		}
+		children[i] = h
+		types[i] = t
+	}
+
+	d := sr.GetData()
+
+	switch sr.Type() {
+	case TypeDataLeaf:
+		return LeafDigest(d), true
+	case TypeWBBTreeNode, TypeListNode:
+		if nc != 3 || len(d) < 16 {
+			break
+		}
+
+		var key []byte
+		if sr.Type() == TypeWBBTreeNode {
+			key = d[16:]
+		}
+
+		leftCount := binary.BigEndian.Uint64(d)
+		e := EntryDigest(key, elementHash(types[2], children[2]))
+
+		return ConcatDigests(ConcatDigests(children[0], leftCount, e), leftCount+1, children[1]), true
+	}
+
+	hs := sha256.New()
+	hs.Write([]byte{byte(sr.Type())})
+	for _, ch := range children {
+		hs.Write(ch[:])
+	}
+
+	if sr.Type() != TypeDataNode {
+		hs.Write(d)
+	}
+
+	h := Hash{}
+	copy(h[:], hs.Sum(nil))
+
+	return h, true
+}
+
+// Hash returns the hash of the map, list or value at the address.
+// It is computed from stored digests, digests that are not stored are computed
+// by reading the segment and its children.
+func (s Store) Hash(a Address) Hash {
+	if a == NilAddress {
+		return Hash{}
+	}
+
+	return elementHash(s.rawSegment(a).Type(), s.Digest(a))
+}
+
+// Digest returns the digest of the segment at the address.
+// For map and list nodes, it is the digest of the entries of their sub-tree.
+func (s Store) Digest(a Address) Hash {
+	if a == NilAddress {
+		return Hash{}
+	}
+
+	h, ok := s.rawSegment(a).StoredHash()
+	if ok {
+		return h
+	}
+
+	sr := s.GetSegment(a)
+
+	h, _ = digestSegment(sr, func(i int) (Hash, SegmentType, bool) {
+		ca := sr.GetChildAddress(i)
+		if ca == NilAddress {
+			return Hash{}, TypeUndefined, true
+		}
+		return s.Digest(ca), s.rawSegment(ca).Type(), true
+	})
+
+	return h
+}
+
+// storeHash stores the digest of an unsealed segment if digests of all children are stored.
+// Otherwise the hash slot is left empty and the digest is computed when needed.
+func (s Store) storeHash(sr SegmentReader) {
+	h, ok := digestSegment(sr, func(i int) (Hash, SegmentType, bool) {
+		ca := sr.GetChildAddress(i)
+		if ca == NilAddress {
+			return Hash{}, TypeUndefined, true
+		}
+
+		csr := s.rawSegment(ca)
+
+		h, ok := csr.StoredHash()
+		if ok {
+			return h, csr.Type(), true
+		}
+
+		return Hash{}, csr.Type(), isEmptyNode(csr)
+	})
+
+	if ok {
+		sr.setHash(h)
+	}
+}
+
+// ForEachLeaf calls f once with the address and the digest of every data leaf reachable from the root.
+// Only headers of other segments and of leaves with a stored digest are read.
+func (s Store) ForEachLeaf(root Address, f func(a Address, digest Hash)) {
+	visited := map[Address]bool{}
+
+	var walk func(a Address)
+	walk = func(a Address) {
+		if a == NilAddress || visited[a] {
+			return
+		}
+
+		visited[a] = true
+
+		sr := s.rawSegment(a)
+
+		if sr.Type() == TypeDataLeaf {
+			f(a, s.Digest(a))
+			return
+		}
+
+		for i := 0; i < sr.NumberOfChildren(); i++ {
+			walk(sr.GetChildAddress(i))
+		}
+	}
+
+	walk(root)
+}
@@ -0,0 +1,110 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHash(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	st.SetFormat(store.Format{Hashes: true})
+
+	leaf := func(t *testing.T, layer int, d string) store.SegmentWriter {
+		sw, err := st.CreateSegment(layer, store.TypeDataLeaf, 0, len(d))
+		require.NoError(t, err)
+		copy(sw.Data, d)
+		return sw
+	}
+
+	node := func(t *testing.T, layer int, children ...store.Address) store.SegmentWriter {
+		sw, err := st.CreateSegment(layer, store.TypeDataNode, len(children), 0)
+		require.NoError(t, err)
+		for i, c := range children {
+			sw.SetChild(i, c)
+		}
+		return sw
+	}
+
+	t.Run("when I create a segment", func(t *testing.T) {
+		l := leaf(t, 0, "abc")
+
+		t.Run("then its hash should not be stored yet", func(t *testing.T) {
+			_, ok := st.GetSegment(l.Address).StoredHash()
+			require.False(t, ok)
+		})
+
+		t.Run("then its data should be kept", func(t *testing.T) {
+			require.Equal(t, []byte("abc"), st.GetSegment(l.Address).GetData())
+		})
+
+		t.Run("when I create the next segment of the layer", func(t *testing.T) {
+			expected := st.Hash(l.Address)
+			n := node(t, 0, l.Address)
+
+			t.Run("then its hash should be stored", func(t *testing.T) {
+				h, ok := st.GetSegment(l.Address).StoredHash()
+				require.True(t, ok)
+				require.Equal(t, expected, h)
+			})
+
+			t.Run("then the hash of the parent should depend on the child", func(t *testing.T) {
+				other := node(t, 0, leaf(t, 0, "abd").Address)
+				require.NotEqual(t, st.Hash(other.Address), st.Hash(n.Address))
+			})
+
+			t.Run("then the hash of the parent should be equal to one with the same content", func(t *testing.T) {
+				same := node(t, 0, leaf(t, 0, "abc").Address)
+				require.Equal(t, st.Hash(same.Address), st.Hash(n.Address))
+			})
+		})
+	})
+
+	t.Run("when I flush the store", func(t *testing.T) {
+		l := leaf(t, 1, "abc")
+		require.NoError(t, st.Flush())
+
+		t.Run("then the hash of the last segment of a layer should be stored", func(t *testing.T) {
+			_, ok := st.GetSegment(l.Address).StoredHash()
+			require.True(t, ok)
+		})
+	})
+
+	t.Run("when I create a segment without hashes", func(t *testing.T) {
+		st.SetFormat(store.Format{})
+		defer st.SetFormat(store.Format{Hashes: true})
+
+		l := leaf(t, 0, "abc")
+		hashed := leaf(t, 0, "abc")
+
+		t.Run("then it should have no hash slot", func(t *testing.T) {
+			require.Equal(t, uint64(4+1+4*8+1+3), st.GetSegment(l.Address).SegmentSize())
+		})
+
+		t.Run("then its hash should be computed", func(t *testing.T) {
+			require.Equal(t, st.Hash(hashed.Address), st.Hash(l.Address))
+		})
+	})
+
+	t.Run("when I create an encrypted segment", func(t *testing.T) {
+		c, err := store.NewAESGCMCipher(nil, []byte("0123456789abcdef"))
+		require.NoError(t, err)
+
+		expected := st.Hash(leaf(t, 0, "abc").Address)
+
+		st.SetFormat(store.Format{Cipher: c, Hashes: true})
+		defer st.SetFormat(store.Format{Hashes: true})
+
+		l := leaf(t, 0, "abc")
+		node(t, 0, l.Address)
+
+		t.Run("then its stored hash should be the one of the plaintext", func(t *testing.T) {
+			h, ok := st.GetSegment(l.Address).StoredHash()
+			require.True(t, ok)
+			require.Equal(t, expected, h)
+		})
+	})
+}
@@ -0,0 +1,86 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/draganm/immersadb/data"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLargeTransaction(t *testing.T) {
+	restore := store.SetLayerMaxSizes(64*1024, 1024*1024, 16*1024*1024)
+	defer restore()
+
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	st, err := store.Open(td)
+	require.NoError(t, err)
+	defer st.Close()
+
+	_, err = wbbtree.CreateEmpty(st[1:])
+	require.NoError(t, err)
+
+	smallTx, err := st.WithTransaction()
+	require.NoError(t, err)
+	defer smallTx[0].CloseAndDelete()
+
+	sa, err := data.StoreData(smallTx, []byte{1}, 1024, 4)
+	require.NoError(t, err)
+
+	smallRoot, err := wbbtree.Insert(smallTx, st.Root(), []byte("small"), sa)
+	require.NoError(t, err)
+
+	committedRoot, st, err := smallTx.Commit(smallRoot)
+	require.NoError(t, err)
+	defer st.FinishUse()
+
+	require.Equal(t, 1, committedRoot.Segment())
+
+	txStore, err := st.WithTransaction()
+	require.NoError(t, err)
+	defer txStore[0].CloseAndDelete()
+
+	value := make([]byte, 200*1024)
+	for i := range value {
+		value[i] = byte(i)
+	}
+
+	t.Run("when a transaction writes more than l1 can hold", func(t *testing.T) {
+		da, err := data.StoreData(txStore, value, 1024, 4)
+		require.NoError(t, err)
+
+		root, err := wbbtree.Insert(txStore, committedRoot, []byte("big"), da)
+		require.NoError(t, err)
+
+		newRoot, ns, err := txStore.Commit(root)
+		require.NoError(t, err)
+		defer ns.FinishUse()
+
+		t.Run("then it should be merged into a layer that can hold it", func(t *testing.T) {
+			require.Equal(t, 2, newRoot.Segment())
+			require.Zero(t, ns[1].UsedBytes())
+		})
+
+		t.Run("then the content of l1 should be merged too", func(t *testing.T) {
+			va, err := wbbtree.Search(ns, newRoot, []byte("small"))
+			require.NoError(t, err)
+			require.Equal(t, 2, va.Segment())
+		})
+
+		t.Run("then the committed value should be readable", func(t *testing.T) {
+			va, err := wbbtree.Search(ns, newRoot, []byte("big"))
+			require.NoError(t, err)
+
+			r, err := data.NewReader(va, ns)
+			require.NoError(t, err)
+
+			d, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, value, d)
+		})
+	})
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	serrors "errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLocked is returned when the store is already opened for writing by another process.
+var ErrLocked = serrors.New("store is locked by another process")
+
+const (
+	// lockFileName is locked exclusively by the writer
+	lockFileName = "lock"
+	// readersLockFileName is locked shared by read only openers
+	readersLockFileName = "lock.readers"
+)
+
+// heldLocks holds open lock files per lock file path until the store is closed.
+var heldLocks = struct {
+	sync.Mutex
+	files map[string][]*os.File
+}{
+	files: map[string][]*os.File{},
+}
+
+// lockDir takes a lock on the lock file in dir.
+// The writer takes an exclusive lock, creating the lock files if needed.
+// Read only openers take a shared lock on a separate lock file,
+// so that they don't block the writer. They wait while the writer
+// holds that lock exclusively to recover the store.
+func lockDir(dir string, readOnly bool) error {
+	fileName := filepath.Join(dir, lockFileName)
+	if readOnly {
+		fileName = filepath.Join(dir, readersLockFileName)
+	}
+
+	// the readers lock file is missing in dirs written before it existed
+	f, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "while opening lock file %q", fileName)
+	}
+
+	err = flock(f, !readOnly, readOnly)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	heldLocks.files[fileName] = append(heldLocks.files[fileName], f)
+
+	return nil
+}
+
+// lockReaders takes the readers lock in dir exclusively, which the writer needs
+// to change or delete files that read only openers may use.
+// It returns ErrLocked if the store is opened read only.
+// The returned function releases the lock.
+func lockReaders(dir string) (func(), error) {
+	fileName := filepath.Join(dir, readersLockFileName)
+	f, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while opening lock file %q", fileName)
+	}
+
+	err = flock(f, true, false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		// closing the file releases the lock
+		f.Close()
+	}, nil
+}
+
+// unlockDir releases a lock taken by lockDir.
+func unlockDir(dir string, readOnly bool) error {
+	fileName := filepath.Join(dir, lockFileName)
+	if readOnly {
+		fileName = filepath.Join(dir, readersLockFileName)
+	}
+
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+
+	files := heldLocks.files[fileName]
+	if len(files) == 0 {
+		return nil
+	}
+
+	f := files[len(files)-1]
+
+	if len(files) == 1 {
+		delete(heldLocks.files, fileName)
+	} else {
+		heldLocks.files[fileName] = files[:len(files)-1]
+	}
+
+	// closing the file releases the lock
+	return f.Close()
+}
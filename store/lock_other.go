@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package store
+
+import "os"
+
+// flock is not supported on this platform, stores are not locked here.
+func flock(f *os.File, exclusive, wait bool) error {
+	return nil
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	serrors "errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/pkg/errors"
+)
+
+// ManifestFileName is the name of the file holding the manifest of the last commit.
+const ManifestFileName = "root"
+
+var ErrReadOnly = serrors.New("store is read only")
+
+var ErrNoManifest = serrors.New("manifest not found")
+
+// Manifest describes a committed state of the store: the root address
+// and the file and used size of every layer.
+type Manifest struct {
+	Root   Address      `json:"root"`
+	Layers []LayerState `json:"layers"`
+	// Seq is the sequence number of the commit, which is kept by the database.
+	Seq uint64 `json:"seq,omitempty"`
+	// Keys are the key checks of the encryption keys, which are kept by the database.
+	Keys []KeyCheck `json:"keys,omitempty"`
+}
+
+// Manifest returns the manifest of the store with the given root.
+func (s Store) Manifest(root Address) Manifest {
+	return Manifest{
+		Root:   root,
+		Layers: s.LayerStates(),
+	}
+}
+
+// WriteManifest atomically replaces the manifest in dir.
+// The new manifest is synced to disk, together with the dir, before WriteManifest returns.
+func WriteManifest(dir string, m Manifest) error {
+	d, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "while encoding manifest")
+	}
+
+	fileName := filepath.Join(dir, ManifestFileName)
+	tmpFileName := fileName + ".tmp"
+
+	err = writeFileSynced(tmpFileName, d)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return errors.Wrapf(err, "while renaming %q", tmpFileName)
+	}
+
+	return syncDir(dir)
+}
+
+func writeFileSynced(fileName string, d []byte) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "while creating %q", fileName)
+	}
+
+	_, err = f.Write(d)
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "while writing %q", fileName)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "while syncing %q", fileName)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "while closing %q", fileName)
+	}
+
+	return nil
+}
+
+// syncDir makes renames of files in dir durable.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// dirs can't be synced on windows
+		return nil
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "while opening dir %q", dir)
+	}
+	defer f.Close()
+
+	err = f.Sync()
+	if err != nil {
+		return errors.Wrapf(err, "while syncing dir %q", dir)
+	}
+
+	return nil
+}
+
+// ReadManifest reads the manifest from dir.
+// It returns ErrNoManifest if the dir has no manifest.
+func ReadManifest(dir string) (Manifest, []byte, error) {
+	fileName := filepath.Join(dir, ManifestFileName)
+	d, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return Manifest{}, nil, ErrNoManifest
+	}
+
+	if err != nil {
+		return Manifest{}, nil, errors.Wrapf(err, "while reading %q", fileName)
+	}
+
+	m := Manifest{}
+	err = json.Unmarshal(d, &m)
+	if err != nil {
+		return Manifest{}, nil, errors.Wrapf(err, "while parsing %q", fileName)
+	}
+
+	if len(m.Layers) != MaxLayers {
+		return Manifest{}, nil, errors.Errorf("manifest %q has %d layers", fileName, len(m.Layers))
+	}
+
+	return m, d, nil
+}
+
+// OpenReadOnly opens layer files listed in the manifest for reading.
+// Layer 0 is left empty, since read only stores can't have transactions.
+// A shared lock is held until the store is closed, which does not conflict with the writer.
+func OpenReadOnly(dir string, m Manifest) (Store, error) {
+	return OpenReadOnlyWithBackend(dir, m, FileBackendMmap)
+}
+
+// OpenReadOnlyWithBackend opens layer files listed in the manifest for reading with the backend.
+func OpenReadOnlyWithBackend(dir string, m Manifest, backend FileBackend) (Store, error) {
+	err := lockDir(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := Store(make(Store, MaxLayers)).refresh(dir, m, backend, Format{})
+	if err != nil {
+		unlockDir(dir, true)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Refresh returns a read only store with the layers listed in the manifest.
+// Files of s with the same name and size are reused, other files are opened.
+// Files of s that are not used any more are not closed.
+// New files are accessed with the same backend and have the same format as the files of s.
+func (s Store) Refresh(dir string, m Manifest) (Store, error) {
+	backend := FileBackendMmap
+	for _, l := range s {
+		sf, isFile := l.(*SegmentFile)
+		if isFile {
+			backend = sf.backend
+			break
+		}
+	}
+
+	return s.refresh(dir, m, backend, s.Format())
+}
+
+func (s Store) refresh(dir string, m Manifest, backend FileBackend, f Format) (Store, error) {
+	ns := make(Store, MaxLayers)
+
+	for i := 1; i < MaxLayers; i++ {
+		l := m.Layers[i]
+
+		// files that grew are opened again, so that transactions
+		// reading the old size keep their own handle
+		sf, isFile := s[i].(*SegmentFile)
+		if isFile && sf.Name() == l.Name && sf.UsedBytes() == l.Size {
+			ns[i] = sf
+			continue
+		}
+
+		if filepath.Base(l.Name) != l.Name {
+			return nil, errors.Errorf("invalid layer file name %q", l.Name)
+		}
+
+		sf, err := openReadOnlySegmentFile(filepath.Join(dir, l.Name), layers[i-1].maxSize, l.Size, backend)
+		if err != nil {
+			for _, o := range ns {
+				if o != nil && !s.contains(o) {
+					o.CloseContext(context.Background())
+				}
+			}
+			return nil, errors.Wrapf(err, "while opening layer %d", i)
+		}
+
+		sf.format.set(f)
+		ns[i] = sf
+	}
+
+	return ns, nil
+}
+
+func (s Store) contains(sf Segments) bool {
+	for _, o := range s {
+		if o == sf {
+			return true
+		}
+	}
+	return false
+}
+
+func openReadOnlySegmentFile(fileName string, maxSize, used uint64, backend FileBackend) (*SegmentFile, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while opening file %q", fileName)
+	}
+
+	fs, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "while getting stats of file %q", fileName)
+	}
+
+	if uint64(fs.Size()) < used {
+		f.Close()
+		return nil, errors.Errorf("file %q has %d bytes, expected at least %d", fileName, fs.Size(), used)
+	}
+
+	var mm mmap.MMap
+	if backend == FileBackendMmap {
+		mm, err = mmap.MapRegion(f, int(maxSize), mmap.RDONLY, 0, 0)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "while mmaping file %q", fileName)
+		}
+	}
+
+	sf := newSegmentFile(f, backend, mm, maxSize, int64(used), 0, fs.Size())
+	sf.readOnly = true
+
+	return sf, nil
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+)
+
+const memoryChunkSize = 1024 * 1024
+
+var _ Segments = &SegmentFile{}
+var _ Segments = &MemorySegments{}
+
+// MemorySegments keeps segments of a layer in memory.
+// Segments are allocated in chunks, so bytes of already allocated segments
+// never move and positions of the layer are contiguous across chunks.
+type MemorySegments struct {
+	name                string
+	prefix              string
+	maxSize             uint64
+	chunks              []memoryChunk
+	nextFreeByte        uint64
+	lastSegmentPosition uint64
+	useCount            int
+	mu                  *sync.Mutex
+	useCond             *sync.Cond
+	closed              bool
+	format              layerFormat
+}
+
+type memoryChunk struct {
+	start uint64
+	data  []byte
+}
+
+// NewMemorySegments creates an empty in-memory layer.
+func NewMemorySegments(prefix string, maxSize uint64) *MemorySegments {
+	mu := &sync.Mutex{}
+	return &MemorySegments{
+		name:    fmt.Sprintf("%s-%s", prefix, ksuid.New().String()),
+		prefix:  prefix,
+		maxSize: maxSize,
+		mu:      mu,
+		useCond: sync.NewCond(mu),
+	}
+}
+
+// OpenInMemory creates an empty store that keeps all layers in memory.
+func OpenInMemory() Store {
+	st := make(Store, MaxLayers)
+	for i, l := range layers {
+		st[i+1] = NewMemorySegments(l.prefix, l.maxSize)
+	}
+	return st
+}
+
+func (m *MemorySegments) ensureNotClosed() {
+	if m.closed {
+		panic(errors.Wrapf(ErrClosed, "memory layer %q", m.name))
+	}
+}
+
+func (m *MemorySegments) Allocate(size int) (uint64, []byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ensureNotClosed()
+
+	end := m.nextFreeByte + uint64(size)
+
+	if end > m.maxSize {
+		return 0, nil, errors.Errorf("Cant extend memory layer %q to %d bytes", m.name, end)
+	}
+
+	if len(m.chunks) == 0 || end > m.chunks[len(m.chunks)-1].start+uint64(len(m.chunks[len(m.chunks)-1].data)) {
+		chunkSize := memoryChunkSize
+		if size > chunkSize {
+			chunkSize = size
+		}
+
+		// the rest of the last chunk is not used
+		m.chunks = append(m.chunks, memoryChunk{
+			start: m.nextFreeByte,
+			data:  make([]byte, chunkSize),
+		})
+	}
+
+	c := m.chunks[len(m.chunks)-1]
+	start := m.nextFreeByte
+	offset := start - c.start
+
+	m.nextFreeByte = end
+	m.lastSegmentPosition = start
+
+	return start, c.data[offset : offset+uint64(size) : offset+uint64(size)], nil
+}
+
+// Bytes returns the bytes of the chunk containing the position, starting at the position.
+func (m *MemorySegments) Bytes(position uint64) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ensureNotClosed()
+
+	if position >= m.nextFreeByte {
+		return nil
+	}
+
+	i := sort.Search(len(m.chunks), func(i int) bool {
+		return m.chunks[i].start > position
+	}) - 1
+
+	c := m.chunks[i]
+
+	return c.data[position-c.start:]
+}
+
+func (m *MemorySegments) StartUse() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ensureNotClosed()
+	m.useCount++
+}
+
+func (m *MemorySegments) FinishUse() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ensureNotClosed()
+	if m.useCount <= 0 {
+		panic("finishUse called more often than StartUse")
+	}
+	m.useCount--
+	if m.useCount == 0 {
+		m.useCond.Broadcast()
+	}
+}
+
+// WaitUnused waits until the use count drops to zero or ctx is done.
+func (m *MemorySegments) WaitUnused(ctx context.Context) error {
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				m.mu.Lock()
+				m.useCond.Broadcast()
+				m.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ensureNotClosed()
+
+	for m.useCount != 0 {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		m.useCond.Wait()
+	}
+
+	return nil
+}
+
+func (m *MemorySegments) CreateEmptySibling() (Segments, error) {
+	sibling := NewMemorySegments(m.prefix, m.maxSize)
+	sibling.format.set(m.format.get())
+	return sibling, nil
+}
+
+func (m *MemorySegments) UsedBytes() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ensureNotClosed()
+	return m.nextFreeByte
+}
+
+func (m *MemorySegments) LastSegmentPosition() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ensureNotClosed()
+	return m.lastSegmentPosition
+}
+
+func (m *MemorySegments) MaxSize() uint64 {
+	return m.maxSize
+}
+
+func (m *MemorySegments) ReadSegments(offset, end uint64, maxLength int) ([]byte, error) {
+	used := m.UsedBytes()
+	if end > used || offset > end {
+		return nil, errors.Errorf("reading segments from %d to %d, but only %d bytes are used", offset, end, used)
+	}
+
+	d := []byte{}
+
+	for pos := offset; pos < end; {
+		b := m.Bytes(pos)
+		if len(b) < 4 {
+			return nil, errors.Errorf("invalid segment at %d", pos)
+		}
+
+		length := uint64(binary.BigEndian.Uint32(b))
+		if length == 0 || pos+length > end || length > uint64(len(b)) {
+			return nil, errors.Errorf("invalid segment at %d", pos)
+		}
+
+		if pos > offset && uint64(len(d))+length > uint64(maxLength) {
+			break
+		}
+
+		d = append(d, b[:length]...)
+		pos += length
+	}
+
+	return d, nil
+}
+
+// WriteTo writes the used bytes of all chunks to w.
+func (m *MemorySegments) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	m.ensureNotClosed()
+	chunks := m.chunks
+	used := m.nextFreeByte
+	m.mu.Unlock()
+
+	total := int64(0)
+
+	for i, c := range chunks {
+		end := used
+		if i+1 < len(chunks) {
+			end = chunks[i+1].start
+		}
+
+		n, err := w.Write(c.data[:end-c.start])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+func (m *MemorySegments) Close() error {
+	return m.CloseContext(context.Background())
+}
+
+// CloseContext releases the memory once the layer is not used any more.
+// If ctx is done before that, the layer stays open and the error of ctx is returned.
+func (m *MemorySegments) CloseContext(ctx context.Context) error {
+	err := m.WaitUnused(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ensureNotClosed()
+
+	m.closed = true
+	m.chunks = nil
+
+	return nil
+}
+
+func (m *MemorySegments) CloseAndDelete() error {
+	return m.CloseContext(context.Background())
+}
@@ -0,0 +1,80 @@
+package store_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/stretchr/testify/require"
+)
+
+func allocateSegment(t *testing.T, m *store.MemorySegments, size int, fill byte) uint64 {
+	pos, d, err := m.Allocate(size)
+	require.NoError(t, err)
+	require.Len(t, d, size)
+	for i := range d {
+		d[i] = fill
+	}
+	binary.BigEndian.PutUint32(d, uint32(size))
+	return pos
+}
+
+func TestMemorySegments(t *testing.T) {
+	t.Run("when segments are allocated across chunks", func(t *testing.T) {
+		m := store.NewMemorySegments("l1", 10*1024*1024)
+		defer m.Close()
+
+		p1 := allocateSegment(t, m, 700*1024, 1)
+		p2 := allocateSegment(t, m, 700*1024, 2)
+		p3 := allocateSegment(t, m, 3*1024*1024, 3)
+
+		t.Run("then positions are contiguous", func(t *testing.T) {
+			require.Equal(t, uint64(0), p1)
+			require.Equal(t, uint64(700*1024), p2)
+			require.Equal(t, uint64(1400*1024), p3)
+			require.Equal(t, uint64(1400*1024+3*1024*1024), m.UsedBytes())
+			require.Equal(t, p3, m.LastSegmentPosition())
+		})
+
+		t.Run("then Bytes returns the segment data", func(t *testing.T) {
+			require.Equal(t, byte(1), m.Bytes(p1)[4])
+			require.Equal(t, byte(2), m.Bytes(p2)[4])
+			require.Equal(t, byte(3), m.Bytes(p3 + 3*1024*1024 - 1)[0])
+			require.Nil(t, m.Bytes(m.UsedBytes()))
+		})
+
+		t.Run("then ReadSegments returns whole segments", func(t *testing.T) {
+			d, err := m.ReadSegments(0, m.UsedBytes(), 1024*1024)
+			require.NoError(t, err)
+			require.Len(t, d, 700*1024)
+			require.Equal(t, byte(1), d[len(d)-1])
+		})
+
+		t.Run("then WriteTo writes the used bytes only", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			n, err := m.WriteTo(buf)
+			require.NoError(t, err)
+			require.Equal(t, int64(m.UsedBytes()), n)
+			require.Equal(t, byte(1), buf.Bytes()[p2-1])
+			require.Equal(t, byte(3), buf.Bytes()[p3+4])
+		})
+	})
+
+	t.Run("when the layer is full", func(t *testing.T) {
+		m := store.NewMemorySegments("l1", 1024)
+		defer m.Close()
+		_, _, err := m.Allocate(2048)
+		t.Run("then Allocate returns an error", func(t *testing.T) {
+			require.Error(t, err)
+		})
+	})
+
+	t.Run("when a store is opened in memory", func(t *testing.T) {
+		st := store.OpenInMemory()
+		defer st.Close()
+		t.Run("then it is empty", func(t *testing.T) {
+			require.True(t, st.IsEmpty())
+		})
+	})
+}
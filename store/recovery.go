@@ -0,0 +1,302 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+)
+
+// QuarantineDirName is the name of the dir where unverified layer files are moved to on open.
+const QuarantineDirName = "quarantine"
+
+// quarantineLimit is the number of files kept in the quarantine dir, older ones are deleted.
+const quarantineLimit = 8
+
+// RecoveryReport describes what was cleaned up when a store was opened.
+type RecoveryReport struct {
+	// DeletedFiles are abandoned transaction files and superseded layer files.
+	DeletedFiles []string
+	// QuarantinedFiles are layer files newer than the ones in the manifest,
+	// left over by a commit that did not finish. They were moved to
+	// the quarantine dir and can be deleted manually. Only the newest
+	// quarantined files are kept, older ones are deleted and reported
+	// in DeletedFiles with the quarantine dir as prefix.
+	QuarantinedFiles []string
+	// DiscardedBytes is the number of bytes per layer written after the manifest.
+	DiscardedBytes []uint64
+}
+
+// IsEmpty returns true if nothing had to be cleaned up.
+func (r RecoveryReport) IsEmpty() bool {
+	for _, d := range r.DiscardedBytes {
+		if d != 0 {
+			return false
+		}
+	}
+	return len(r.DeletedFiles) == 0 && len(r.QuarantinedFiles) == 0
+}
+
+// OpenAndRecover opens the store in dir for writing.
+// The live file of each layer is the one listed in the manifest or,
+// for stores without a manifest, the lexically last one.
+// Live files are verified against the manifest and bytes written after it are discarded.
+// Abandoned transaction files and older layer files are deleted, newer layer files are quarantined.
+func OpenAndRecover(dir string) (Store, RecoveryReport, error) {
+	return OpenAndRecoverWithBackend(dir, FileBackendMmap)
+}
+
+// OpenAndRecoverWithBackend opens the store in dir like OpenAndRecover, accessing layer files with the backend.
+func OpenAndRecoverWithBackend(dir string, backend FileBackend) (Store, RecoveryReport, error) {
+	report := RecoveryReport{
+		DiscardedBytes: make([]uint64, MaxLayers),
+	}
+
+	err := lockDir(dir, false)
+	if err != nil {
+		return nil, report, err
+	}
+
+	st, err := recoverLayers(dir, &report, backend)
+	if err != nil {
+		for _, sf := range st {
+			if sf != nil {
+				sf.CloseContext(context.Background())
+			}
+		}
+		unlockDir(dir, false)
+		return nil, report, err
+	}
+
+	return st, report, nil
+}
+
+func recoverLayers(dir string, report *RecoveryReport, backend FileBackend) (Store, error) {
+	hasManifest := true
+	m, _, err := ReadManifest(dir)
+	if err == ErrNoManifest {
+		hasManifest = false
+	} else if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while listing dir %q", dir)
+	}
+
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.Mode().IsRegular() && (strings.HasPrefix(name, "transaction-") || name == ManifestFileName+".tmp") {
+			err = os.Remove(filepath.Join(dir, name))
+			if os.IsNotExist(err) {
+				// the transaction layer of the last commit is deleted in the background
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "while deleting %q", name)
+			}
+			report.DeletedFiles = append(report.DeletedFiles, name)
+		}
+	}
+
+	st := make(Store, MaxLayers)
+	// sizes of live files listed in the manifest
+	sizes := map[int]uint64{}
+	obsolete := []string{}
+	abandoned := []string{}
+	discard := false
+
+	for i, l := range layers {
+		layer := i + 1
+		layerFiles := filesWithPrefixSorted(l.prefix+"-", files)
+
+		live := ""
+		if len(layerFiles) > 0 {
+			live = layerFiles[len(layerFiles)-1]
+		}
+
+		var ls LayerState
+		if hasManifest {
+			ls = m.Layers[layer]
+			if containsString(layerFiles, ls.Name) {
+				live = ls.Name
+			} else if ls.Size > 0 {
+				return st, errors.Errorf("file %q of layer %d listed in the manifest is missing", ls.Name, layer)
+			}
+		}
+
+		for _, f := range layerFiles {
+			switch {
+			case f < live:
+				obsolete = append(obsolete, f)
+			case f > live:
+				abandoned = append(abandoned, f)
+			}
+		}
+
+		if live == "" {
+			live = fmt.Sprintf("%s-%s", l.prefix, ksuid.New().String())
+		}
+
+		sf, err := OpenOrCreateSegmentFileWithBackend(filepath.Join(dir, live), l.maxSize, backend)
+		if err != nil {
+			return st, errors.Wrapf(err, "while opening layer %d", layer)
+		}
+
+		st[layer] = sf
+
+		if hasManifest && ls.Name == live {
+			sizes[layer] = ls.Size
+			discard = discard || sf.UsedBytes() != ls.Size
+		}
+	}
+
+	if len(obsolete) > 0 || len(abandoned) > 0 || discard {
+		// read only openers may still use layer files of an older manifest
+		unlock, err := lockReaders(dir)
+		if err != nil {
+			return st, errors.Wrap(err, "while locking out readers to recover layer files")
+		}
+		defer unlock()
+	}
+
+	for _, f := range obsolete {
+		err = os.Remove(filepath.Join(dir, f))
+		if err != nil {
+			return st, errors.Wrapf(err, "while deleting %q", f)
+		}
+		report.DeletedFiles = append(report.DeletedFiles, f)
+	}
+
+	for _, f := range abandoned {
+		err = quarantine(dir, f)
+		if err != nil {
+			return st, err
+		}
+		report.QuarantinedFiles = append(report.QuarantinedFiles, f)
+	}
+
+	if len(abandoned) > 0 {
+		deleted, err := pruneQuarantine(dir)
+		if err != nil {
+			return st, err
+		}
+		report.DeletedFiles = append(report.DeletedFiles, deleted...)
+	}
+
+	for layer, size := range sizes {
+		sf := st[layer].(*SegmentFile)
+		report.DiscardedBytes[layer], err = sf.rewind(size)
+		if err != nil {
+			return st, errors.Wrapf(err, "while verifying layer %d", layer)
+		}
+	}
+
+	if hasManifest && m.Root != NilAddress {
+		l := m.Root.Segment()
+		if l == 0 || m.Root.Position() >= st[l].UsedBytes() {
+			return st, errors.Errorf("root %s in the manifest is not in the store", m.Root)
+		}
+	}
+
+	return st, nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func quarantine(dir, name string) error {
+	qdir := filepath.Join(dir, QuarantineDirName)
+	err := os.MkdirAll(qdir, 0700)
+	if err != nil {
+		return errors.Wrapf(err, "while creating %q", qdir)
+	}
+
+	err = os.Rename(filepath.Join(dir, name), filepath.Join(qdir, name))
+	if err != nil {
+		return errors.Wrapf(err, "while quarantining %q", name)
+	}
+
+	return nil
+}
+
+// pruneQuarantine deletes all but the newest quarantineLimit files in the quarantine dir
+// and returns their paths relative to dir.
+func pruneQuarantine(dir string) ([]string, error) {
+	qdir := filepath.Join(dir, QuarantineDirName)
+	files, err := ioutil.ReadDir(qdir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while listing dir %q", qdir)
+	}
+
+	// names of layer files end with a ksuid, which sorts by creation time
+	sort.Slice(files, func(i, j int) bool {
+		return quarantinedFileID(files[i].Name()) < quarantinedFileID(files[j].Name())
+	})
+
+	deleted := []string{}
+	for len(files) > quarantineLimit {
+		name := files[0].Name()
+		files = files[1:]
+
+		err = os.Remove(filepath.Join(qdir, name))
+		if err != nil {
+			return deleted, errors.Wrapf(err, "while deleting %q", name)
+		}
+		deleted = append(deleted, filepath.Join(QuarantineDirName, name))
+	}
+
+	return deleted, nil
+}
+
+func quarantinedFileID(name string) string {
+	i := strings.LastIndex(name, "-")
+	return name[i+1:]
+}
+
+// rewind verifies that the file contains size bytes of complete segments and
+// discards all segments after them. It returns the number of discarded bytes.
+func (s *SegmentFile) rewind(size uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ensureNotClosed()
+
+	if int64(size) > s.nextFreeByte {
+		return 0, errors.Errorf("file %q has %d bytes of segments, expected at least %d", s.Name(), s.nextFreeByte, size)
+	}
+
+	next, last, err := scanSegments(s.reader(), 0, 0, int64(size))
+	if err != nil {
+		return 0, errors.Wrapf(err, "while scanning %q", s.Name())
+	}
+
+	if next != int64(size) {
+		return 0, errors.Errorf("file %q has no segment boundary at %d", s.Name(), size)
+	}
+
+	discarded := uint64(s.nextFreeByte) - size
+
+	err = s.zeroRange(int64(size), s.nextFreeByte)
+	if err != nil {
+		return 0, err
+	}
+
+	s.nextFreeByte = next
+	s.lastSegmentPosition = last
+
+	return discarded, nil
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// LayerState describes which file holds a layer and how many bytes of it are used.
+type LayerState struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+// LayerStates returns states of layers 1-3. The state of layer 0 is always empty.
+func (s Store) LayerStates() []LayerState {
+	states := make([]LayerState, len(s))
+	for i := 1; i < len(s); i++ {
+		states[i] = LayerState{
+			Name: layerName(s[i]),
+			Size: s[i].UsedBytes(),
+		}
+	}
+	return states
+}
+
+// CreateLayerFile creates an empty file with the given name for the layer in dir,
+// accessed with the backend. An existing file with the same name is replaced.
+func CreateLayerFile(dir string, layer int, name string, backend FileBackend) (*SegmentFile, error) {
+	if layer < 1 || layer > len(layers) {
+		return nil, errors.Errorf("layer %d does not exist", layer)
+	}
+
+	if filepath.Base(name) != name {
+		return nil, errors.Errorf("invalid layer file name %q", name)
+	}
+
+	fileName := filepath.Join(dir, name)
+
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "while removing %q", fileName)
+	}
+
+	return OpenOrCreateSegmentFileWithBackend(fileName, layers[layer-1].maxSize, backend)
+}
+
+// Name returns the base name of the segment file.
+func (s *SegmentFile) Name() string {
+	return filepath.Base(s.f.Name())
+}
+
+// AppendSegments appends segments copied from another segment file.
+// The offset must match the number of used bytes and d must contain only complete segments.
+// Only bytes after the used part of the file are written, so segments that are
+// read concurrently are not changed, also when the data is rejected.
+func (s *SegmentFile) AppendSegments(offset uint64, d []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ensureNotClosed()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	if offset != uint64(s.nextFreeByte) {
+		return errors.Errorf("appending at %d, but %d bytes are used", offset, s.nextFreeByte)
+	}
+
+	end := s.nextFreeByte + int64(len(d))
+
+	if uint64(end) > s.maxSize {
+		return errors.Errorf("Cant extend segment %p to %d bytes", s, end)
+	}
+
+	err := s.writeBuffered()
+	if err != nil {
+		return err
+	}
+
+	err = s.ensureSize(int(end))
+	if err != nil {
+		return errors.Wrap(err, "while ensuring size")
+	}
+
+	err = s.ensureMapped(end)
+	if err != nil {
+		return err
+	}
+
+	if s.backend == FileBackendMmap {
+		copy(s.mmap()[s.nextFreeByte:], d)
+	} else {
+		_, err = s.f.WriteAt(d, s.nextFreeByte)
+		if err != nil {
+			return errors.Wrapf(err, "while writing %q", s.f.Name())
+		}
+	}
+
+	next, last, err := scanSegments(s.reader(), s.nextFreeByte, s.lastSegmentPosition, end)
+	if err != nil || next != end {
+		// forget the partial segment
+		zerr := s.zeroRange(s.nextFreeByte, end)
+		if zerr != nil {
+			return zerr
+		}
+		if err != nil {
+			return errors.Wrap(err, "while scanning appended data")
+		}
+		return errors.New("appended data does not end with a complete segment")
+	}
+
+	s.nextFreeByte = next
+	s.lastSegmentPosition = last
+
+	return nil
+}
+
+// ReadSegments returns a copy of complete segments starting at offset and ending before end.
+// At most maxLength bytes are returned, unless the first segment is longer.
+func (s *SegmentFile) ReadSegments(offset, end uint64, maxLength int) ([]byte, error) {
+	s.mu.Lock()
+	s.ensureNotClosed()
+	used := uint64(s.nextFreeByte)
+	s.mu.Unlock()
+
+	if end > used || offset > end {
+		return nil, errors.Errorf("reading segments from %d to %d, but only %d bytes are used", offset, end, used)
+	}
+
+	header := make([]byte, 4)
+
+	pos := offset
+	for pos < end {
+		_, err := s.ReadAt(header, int64(pos))
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading segment at %d", pos)
+		}
+		length := uint64(binary.BigEndian.Uint32(header))
+		if length == 0 || pos+length > end {
+			return nil, errors.Errorf("invalid segment at %d", pos)
+		}
+		if pos > offset && pos+length-offset > uint64(maxLength) {
+			break
+		}
+		pos += length
+	}
+
+	d := make([]byte, pos-offset)
+	_, err := s.ReadAt(d, int64(offset))
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading segments at %d", offset)
+	}
+	return d, nil
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Segments with a sealed payload have sealedFlag set in their type byte.
+// The payload is sealed with the address of the segment as additional data,
+// so a payload copied to another address can't be opened.
+// Headers are not sealed, they are needed to find children and sizes of segments.
+//
+// A new segment is created with room for the overhead of the cipher, but its length
+// covers only the plaintext until it is finished, which is when the next segment
+// of the layer is created or the layer is committed. Segments are created bottom-up,
+// so nothing writes to a segment once the next one is created.
+// Layer files keep unfinished segments in memory and write them only once they are
+// finished, so plaintext payloads are never written to disk.
+
+const sealedFlag = 0x40
+
+// additionalData returns the additional data of the payload of a segment at the address.
+func additionalData(a Address) []byte {
+	d := make([]byte, 8)
+	binary.BigEndian.PutUint64(d, uint64(a))
+	return d
+}
+
+// finishSegment stores the hash and seals the payload of the last segment of the layer.
+// Both are computed from the plaintext, before the segment can be written to a file.
+func (s Store) finishSegment(layer int) error {
+	l := s[layer]
+	used := l.UsedBytes()
+	if used == 0 {
+		return nil
+	}
+
+	position := l.LastSegmentPosition()
+	a := NewAddress(layer, position)
+	sr := s.rawSegment(a)
+
+	if sr.isSealed() {
+		return nil
+	}
+
+	if sr.hasHashSlot() {
+		_, ok := sr.StoredHash()
+		if !ok {
+			s.storeHash(sr)
+		}
+	}
+
+	allocated := used - position
+	if sr.SegmentSize() == allocated {
+		return nil
+	}
+
+	c := formatOf(l).get().Cipher
+	if c == nil {
+		return errors.Errorf("segment at %s has %d unused bytes", a, allocated-sr.SegmentSize())
+	}
+
+	d := l.Bytes(position)[:allocated]
+
+	offset := sr.dataOffset()
+	plaintext := append([]byte{}, d[offset:sr.SegmentSize()]...)
+
+	err := c.Seal(d[offset:], plaintext, additionalData(a))
+	if err != nil {
+		return errors.Wrapf(err, "while sealing segment at %s", a)
+	}
+
+	binary.BigEndian.PutUint32(d, uint32(allocated))
+	d[4] |= sealedFlag
+
+	return nil
+}
+
+// isFinished returns true if the bytes allocated for a segment hold no payload that still has to be sealed.
+func isFinished(d []byte) bool {
+	return len(d) >= 4 && uint64(binary.BigEndian.Uint32(d)) == uint64(len(d))
+}
+
+// isUnfinished returns true if the segment at the address is the last one of its layer
+// and its payload will be sealed once it is finished.
+func (s Store) isUnfinished(a Address, sr SegmentReader) bool {
+	l := s[a.Segment()]
+	if formatOf(l).get().Cipher == nil || len(sr.GetData()) == 0 {
+		return false
+	}
+
+	return a.Position() == l.LastSegmentPosition() && l.UsedBytes()-a.Position() > sr.SegmentSize()
+}
+
+// openSegment returns a copy of the sealed segment at the address with the payload opened.
+func (s Store) openSegment(a Address, sr SegmentReader) SegmentReader {
+	c := formatOf(s[a.Segment()]).get().Cipher
+	if c == nil {
+		panic(errors.Wrapf(ErrWrongKey, "segment at %s is encrypted and no key was provided", a))
+	}
+
+	offset := sr.dataOffset()
+
+	plaintext, err := c.Open(sr[offset:], additionalData(a))
+	if err != nil {
+		panic(errors.Wrapf(err, "while opening segment at %s", a))
+	}
+
+	d := make([]byte, offset+len(plaintext))
+	copy(d, sr[:offset])
+	copy(d[offset:], plaintext)
+
+	binary.BigEndian.PutUint32(d, uint32(len(d)))
+	d[4] &^= sealedFlag
+
+	return SegmentReader(d)
+}
+
+// finishLayers finishes the last segments of layers 1-3, which have to be sealed
+// before they are written to the file.
+func (s Store) finishLayers() error {
+	for i := 1; i < len(s); i++ {
+		if s[i] == nil {
+			continue
+		}
+
+		err := s.finishSegment(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
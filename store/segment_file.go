@@ -1,11 +1,14 @@
 package store
 
 import (
+	"context"
 	"encoding/binary"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/edsrzf/mmap-go"
 	"github.com/pkg/errors"
@@ -14,9 +17,18 @@ import (
 
 const extendStep = 1 * 1024 * 1024
 
+// scanWindowSize is the number of bytes read at once while scanning segment headers.
+const scanWindowSize = 64 * 1024
+
 type SegmentFile struct {
-	f                   *os.File
-	MMap                mmap.MMap
+	f       *os.File
+	backend FileBackend
+	// mapped holds the current mmap.MMap of the file. Writable files are mapped
+	// only as far as they are used and mapped again with a larger size when they grow.
+	// Earlier mappings stay valid until the file is closed, since segments
+	// returned from them can still be in use.
+	mapped              atomic.Value
+	maps                []mmap.MMap
 	maxSize             uint64
 	nextFreeByte        int64
 	lastSegmentPosition int64
@@ -25,9 +37,26 @@ type SegmentFile struct {
 	mu                  *sync.Mutex
 	useCond             *sync.Cond
 	closed              bool
+	readOnly            bool
+	format              layerFormat
+
+	// pending holds the *bufferedSegment being written on an encrypted layer with
+	// the mmap backend. It is built in memory and copied to the mapping once it is
+	// finished, so that plaintext never reaches the file.
+	pending atomic.Value
+
+	// buffered are new segments not written to the file by the pread backend
+	buffered      []bufferedSegment
+	bufferedBytes int
+	cache         *segmentCache
 }
 
 func OpenOrCreateSegmentFile(fileName string, maxSize uint64) (*SegmentFile, error) {
+	return OpenOrCreateSegmentFileWithBackend(fileName, maxSize, FileBackendMmap)
+}
+
+// OpenOrCreateSegmentFileWithBackend opens or creates a segment file accessed with the backend.
+func OpenOrCreateSegmentFileWithBackend(fileName string, maxSize uint64, backend FileBackend) (*SegmentFile, error) {
 
 	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
@@ -39,59 +68,155 @@ func OpenOrCreateSegmentFile(fileName string, maxSize uint64) (*SegmentFile, err
 		return nil, errors.Wrapf(err, "while getting stats of file %q", fileName)
 	}
 
-	mm, err := mmap.MapRegion(f, int(maxSize), mmap.RDWR, 0, 0)
-	if err != nil {
-		f.Close()
-		return nil, errors.Wrapf(err, "while mmaping file %q", fileName)
+	var mm mmap.MMap
+	if backend == FileBackendMmap {
+		mm, err = mmap.MapRegion(f, mapSize(fs.Size(), 0, maxSize), mmap.RDWR, 0, 0)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "while mmaping file %q", fileName)
+		}
 	}
 
-	offset := int64(0)
-
-	limit := fs.Size()
-
-	var lastSegmentPosition int64
+	sf := newSegmentFile(f, backend, mm, maxSize, 0, 0, fs.Size())
 
-	for offset+4 < limit {
-		skip := int64(binary.BigEndian.Uint32(mm[offset:]))
-		if skip == int64(0) {
-			break
-		}
-		lastSegmentPosition = offset
-		offset += skip
+	sf.nextFreeByte, sf.lastSegmentPosition, err = scanSegments(sf.reader(), 0, 0, sf.limit)
+	if err != nil {
+		sf.Close()
+		return nil, errors.Wrapf(err, "while scanning file %q", fileName)
 	}
 
+	return sf, nil
+}
+
+func newSegmentFile(f *os.File, backend FileBackend, mm mmap.MMap, maxSize uint64, nextFreeByte, lastSegmentPosition, limit int64) *SegmentFile {
 	mu := &sync.Mutex{}
 	useCond := sync.NewCond(mu)
 
-	return &SegmentFile{
+	sf := &SegmentFile{
 		f:                   f,
-		MMap:                mm,
+		backend:             backend,
 		maxSize:             maxSize,
-		nextFreeByte:        offset,
+		nextFreeByte:        nextFreeByte,
 		lastSegmentPosition: lastSegmentPosition,
 		limit:               limit,
 		mu:                  mu,
 		useCond:             useCond,
-	}, nil
+		cache:               newSegmentCache(),
+	}
+
+	if mm != nil {
+		sf.maps = []mmap.MMap{mm}
+	}
+	sf.mapped.Store(mm)
+
+	return sf
 }
 
-func (s *SegmentFile) ensureSize(bytes int) error {
+// initialMapSize is the smallest size writable files are mapped with.
+const initialMapSize = 64 * 1024 * 1024
 
-	for int(s.limit-s.nextFreeByte) < bytes {
-		// TODO: figure out how to do only one truncate
-		err := s.f.Truncate(int64(s.nextFreeByte + extendStep))
-		if err != nil {
-			return errors.Wrapf(err, "while extending file %q to %d bytes", s.f.Name(), extendStep)
+// mapSize returns the size of a mapping that covers size bytes, at least
+// twice the size of the current mapping and at most maxSize.
+func mapSize(size int64, current int, maxSize uint64) int {
+	n := current * 2
+	if n < initialMapSize {
+		n = initialMapSize
+	}
+
+	for int64(n) < size {
+		n *= 2
+	}
+
+	if uint64(n) > maxSize {
+		n = int(maxSize)
+	}
+
+	return n
+}
+
+// mmap returns the current mapping of the file.
+func (s *SegmentFile) mmap() mmap.MMap {
+	return s.mapped.Load().(mmap.MMap)
+}
+
+// ensureMapped maps the file again if the current mapping does not cover size bytes.
+// It must be called with s.mu locked.
+func (s *SegmentFile) ensureMapped(size int64) error {
+	if s.backend != FileBackendMmap || size <= int64(len(s.mmap())) {
+		return nil
+	}
+
+	mm, err := mmap.MapRegion(s.f, mapSize(size, len(s.mmap()), s.maxSize), mmap.RDWR, 0, 0)
+	if err != nil {
+		return errors.Wrapf(err, "while mmaping file %q", s.f.Name())
+	}
+
+	s.maps = append(s.maps, mm)
+	s.mapped.Store(mm)
+
+	return nil
+}
+
+// scanSegments skips over segments starting at offset until it finds one with length 0
+// or reaches the limit. It returns the offset after the last segment and the position of the last segment.
+func scanSegments(r io.ReaderAt, offset, lastSegmentPosition, limit int64) (int64, int64, error) {
+	window := make([]byte, scanWindowSize)
+	windowStart := int64(0)
+	windowLength := 0
+
+	for offset+4 < limit {
+		if offset < windowStart || offset+4 > windowStart+int64(windowLength) {
+			// mapped bytes after the limit are not backed by the file
+			w := window
+			if int64(len(w)) > limit-offset {
+				w = w[:limit-offset]
+			}
+			n, err := r.ReadAt(w, offset)
+			if n < 4 {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return offset, lastSegmentPosition, err
+			}
+			windowStart = offset
+			windowLength = n
+		}
+
+		skip := int64(binary.BigEndian.Uint32(window[offset-windowStart:]))
+		if skip == int64(0) {
+			break
 		}
-		s.limit += extendStep
+		lastSegmentPosition = offset
+		offset += skip
+	}
+	return offset, lastSegmentPosition, nil
+}
+
+// ensureSize extends the file in steps of extendStep until it is at least size bytes long.
+func (s *SegmentFile) ensureSize(size int) error {
+
+	newLimit := s.limit
+	for newLimit < int64(size) {
+		newLimit += extendStep
+	}
+
+	if newLimit == s.limit {
+		return nil
 	}
 
+	err := s.f.Truncate(newLimit)
+	if err != nil {
+		return errors.Wrapf(err, "while extending file %q to %d bytes", s.f.Name(), newLimit)
+	}
+
+	s.limit = newLimit
+
 	return nil
 }
 
 func (s *SegmentFile) ensureNotClosed() {
 	if s.closed {
-		panic("segment file is closed!")
+		panic(errors.Wrapf(ErrClosed, "segment file %q", s.f.Name()))
 	}
 }
 
@@ -116,6 +241,23 @@ func (s *SegmentFile) FinishUse() {
 }
 
 func (s *SegmentFile) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext closes the file once it is not used any more.
+// If ctx is done before that, the file stays open and the error of ctx is returned.
+func (s *SegmentFile) CloseContext(ctx context.Context) error {
+	return s.closeContext(ctx, false)
+}
+
+// closeContext closes the file once it is not used any more.
+// If discard is true, buffered segments are dropped instead of written.
+func (s *SegmentFile) closeContext(ctx context.Context, discard bool) error {
+	err := s.WaitUnused(ctx)
+	if err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -125,9 +267,28 @@ func (s *SegmentFile) Close() error {
 		s.useCond.Wait()
 	}
 
-	err := s.MMap.Unmap()
-	if err != nil {
-		return errors.Wrapf(err, "while unmmaping %q", s.f.Name())
+	if s.backend == FileBackendMmap {
+		if discard {
+			s.pending.Store((*bufferedSegment)(nil))
+		}
+		s.writePending()
+		for _, mm := range s.maps {
+			err = mm.Unmap()
+			if err != nil {
+				return errors.Wrapf(err, "while unmmaping %q", s.f.Name())
+			}
+		}
+		s.maps = nil
+	} else {
+		if discard {
+			s.buffered = nil
+			s.bufferedBytes = 0
+		}
+		err = s.writeBuffered()
+		if err != nil {
+			return err
+		}
+		s.cache.clear()
 	}
 
 	s.closed = true
@@ -135,9 +296,55 @@ func (s *SegmentFile) Close() error {
 	return s.f.Close()
 }
 
+// WaitUnused waits until the use count drops to zero or ctx is done.
+func (s *SegmentFile) WaitUnused(ctx context.Context) error {
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.mu.Lock()
+				s.useCond.Broadcast()
+				s.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ensureNotClosed()
+
+	for s.useCount != 0 {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		s.useCond.Wait()
+	}
+
+	return nil
+}
+
 func (s *SegmentFile) Flush() error {
 	s.ensureNotClosed()
-	return s.MMap.Flush()
+
+	if s.backend == FileBackendMmap {
+		s.mu.Lock()
+		s.writePending()
+		s.mu.Unlock()
+		return s.mmap().Flush()
+	}
+
+	err := s.WriteBuffered()
+	if err != nil {
+		return err
+	}
+
+	return s.f.Sync()
 }
 
 func (s *SegmentFile) Allocate(size int) (uint64, []byte, error) {
@@ -146,6 +353,10 @@ func (s *SegmentFile) Allocate(size int) (uint64, []byte, error) {
 
 	s.ensureNotClosed()
 
+	if s.readOnly {
+		return 0, nil, ErrReadOnly
+	}
+
 	if uint64(size)+uint64(s.nextFreeByte) > s.maxSize {
 		return 0, nil, errors.Errorf("Cant extend segment %p to %d bytes", s, uint64(size)+uint64(s.nextFreeByte))
 	}
@@ -154,14 +365,38 @@ func (s *SegmentFile) Allocate(size int) (uint64, []byte, error) {
 	if err != nil {
 		return 0, nil, errors.Wrap(err, "while ensuring size")
 	}
+
+	err = s.ensureMapped(s.nextFreeByte + int64(size))
+	if err != nil {
+		return 0, nil, err
+	}
+
 	start := s.nextFreeByte
+
+	var d []byte
+	if s.backend == FileBackendMmap && s.format.get().Cipher != nil {
+		d, err = s.allocatePending(start, size)
+		if err != nil {
+			return 0, nil, err
+		}
+	} else if s.backend == FileBackendMmap {
+		d = s.mmap()[int(start) : int(start)+size]
+	} else {
+		d, err = s.allocateBuffered(start, size)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
 	s.nextFreeByte += int64(size)
 	s.lastSegmentPosition = start
-	return uint64(start), s.MMap[int(start) : int(start)+size], nil
+	return uint64(start), d, nil
 }
 
 func (s *SegmentFile) CloseAndDelete() error {
-	err := s.Close()
+	// buffered segments of a deleted file don't have to be written,
+	// but readers may still use them until the file is closed
+	err := s.closeContext(context.Background(), true)
 	if err != nil {
 		return errors.Wrap(err, "while closing layer")
 	}
@@ -188,7 +423,7 @@ func (s *SegmentFile) UsedBytes() uint64 {
 	return uint64(s.nextFreeByte)
 }
 
-func (s *SegmentFile) CreateEmptySibling() (*SegmentFile, error) {
+func (s *SegmentFile) CreateEmptySibling() (Segments, error) {
 	s.mu.Lock()
 
 	s.ensureNotClosed()
@@ -212,7 +447,97 @@ func (s *SegmentFile) CreateEmptySibling() (*SegmentFile, error) {
 		return nil, errors.Wrapf(err, "while parsing ksuid %q", parts[1])
 	}
 
-	return ensureNextLayer(prefix, dir, maxSize, id)
+	sf, err := ensureNextLayer(prefix, dir, maxSize, id, s.backend)
+	if err != nil {
+		return nil, err
+	}
+
+	sf.format.set(s.format.get())
+
+	return sf, nil
+}
+
+// CreateLayer creates a new file for a layer in the directory of the segment file.
+func (s *SegmentFile) CreateLayer(prefix string, maxSize uint64) (Segments, error) {
+	sf, err := ensureLayer(prefix, filepath.Dir(s.f.Name()), nil, maxSize, s.backend)
+	if err != nil {
+		return nil, err
+	}
+
+	sf.format.set(s.format.get())
+
+	return sf, nil
+}
+
+// pendingSegment returns the segment that is not copied to the mapping yet, or nil.
+func (s *SegmentFile) pendingSegment() *bufferedSegment {
+	p, _ := s.pending.Load().(*bufferedSegment)
+	return p
+}
+
+// allocatePending reserves size bytes for a new segment in memory, after copying
+// the previous one to the mapping. Since segments are created bottom-up,
+// the previous one is finished when the next one is allocated.
+// It must be called with s.mu locked.
+func (s *SegmentFile) allocatePending(start int64, size int) ([]byte, error) {
+	s.writePending()
+
+	p := s.pendingSegment()
+	if p != nil {
+		return nil, errors.Errorf("segment at %d of %q was not finished", p.position, s.f.Name())
+	}
+
+	d := make([]byte, size)
+	s.pending.Store(&bufferedSegment{position: start, data: d})
+
+	return d, nil
+}
+
+// writePending copies the pending segment to the mapping if it is finished.
+// It must be called with s.mu locked.
+func (s *SegmentFile) writePending() {
+	p := s.pendingSegment()
+	if p == nil || !isFinished(p.data) {
+		return
+	}
+
+	copy(s.mmap()[p.position:], p.data)
+	s.pending.Store((*bufferedSegment)(nil))
+}
+
+// Bytes returns the mapped bytes of the file starting at the position.
+// With the pread backend only the bytes of the segment at the position are returned.
+func (s *SegmentFile) Bytes(position uint64) []byte {
+	if s.backend != FileBackendMmap {
+		return s.preadBytes(position)
+	}
+
+	p := s.pendingSegment()
+	if p != nil && p.position == int64(position) {
+		return p.data
+	}
+
+	mm := s.mmap()
+	if position >= uint64(len(mm)) {
+		return nil
+	}
+	return mm[position:]
+}
+
+func (s *SegmentFile) LastSegmentPosition() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ensureNotClosed()
+	return uint64(s.lastSegmentPosition)
+}
+
+// Backend returns how the file is accessed.
+func (s *SegmentFile) Backend() FileBackend {
+	return s.backend
+}
+
+func (s *SegmentFile) MaxSize() uint64 {
+	return s.maxSize
 }
 
 func (s *SegmentFile) CanAppend(bytes uint64) bool {
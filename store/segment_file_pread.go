@@ -0,0 +1,323 @@
+package store
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// FileBackend selects how segment files are accessed.
+type FileBackend int
+
+const (
+	// FileBackendMmap maps the whole file, up to the maximum size of its layer, into memory.
+	FileBackendMmap FileBackend = iota
+	// FileBackendPread reads segments with pread and writes them with pwrite.
+	// It does not reserve address space and I/O errors are returned instead of raising SIGBUS.
+	FileBackendPread
+)
+
+func (b FileBackend) String() string {
+	switch b {
+	case FileBackendMmap:
+		return "mmap"
+	case FileBackendPread:
+		return "pread"
+	default:
+		return "unknown"
+	}
+}
+
+// writeBufferSize is the number of bytes of new segments that are kept in memory
+// before they are written to the file with the pread backend.
+const writeBufferSize = 4 * 1024 * 1024
+
+// readCacheSize is the number of bytes of segments read with the pread backend that are cached.
+const readCacheSize = 4 * 1024 * 1024
+
+// readAheadSize is the number of bytes read with the header of a segment, which
+// avoids a second read for small segments.
+const readAheadSize = 4 * 1024
+
+// bufferedSegment is a new segment that was not written to the file yet.
+type bufferedSegment struct {
+	position int64
+	data     []byte
+}
+
+// segmentCache keeps segments read from the file, the oldest ones are evicted first.
+type segmentCache struct {
+	bytes    int
+	segments map[uint64][]byte
+	order    []uint64
+}
+
+func newSegmentCache() *segmentCache {
+	return &segmentCache{
+		segments: map[uint64][]byte{},
+	}
+}
+
+func (c *segmentCache) get(position uint64) ([]byte, bool) {
+	d, found := c.segments[position]
+	return d, found
+}
+
+func (c *segmentCache) put(position uint64, d []byte) {
+	if len(d) > readCacheSize {
+		return
+	}
+
+	_, found := c.segments[position]
+	if found {
+		return
+	}
+
+	for c.bytes+len(d) > readCacheSize {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.bytes -= len(c.segments[oldest])
+		delete(c.segments, oldest)
+	}
+
+	c.segments[position] = d
+	c.order = append(c.order, position)
+	c.bytes += len(d)
+}
+
+func (c *segmentCache) clear() {
+	c.bytes = 0
+	c.segments = map[uint64][]byte{}
+	c.order = nil
+}
+
+// allocateBuffered reserves size bytes for a new segment in memory.
+// Buffered segments are written once they exceed writeBufferSize. Since segments are
+// created bottom-up, all of them are complete when the next one is allocated.
+// It must be called with s.mu locked.
+func (s *SegmentFile) allocateBuffered(start int64, size int) ([]byte, error) {
+	if s.bufferedBytes > 0 && s.bufferedBytes+size > writeBufferSize {
+		err := s.writeBuffered()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d := make([]byte, size)
+	s.buffered = append(s.buffered, bufferedSegment{position: start, data: d})
+	s.bufferedBytes += size
+
+	return d, nil
+}
+
+// writeBuffered writes buffered segments to the file with a single write.
+// The last segment stays buffered if it is not finished, since its payload is not sealed yet.
+// It must be called with s.mu locked.
+func (s *SegmentFile) writeBuffered() error {
+	var unfinished []bufferedSegment
+
+	finished := s.buffered
+	if len(finished) > 0 && !isFinished(finished[len(finished)-1].data) {
+		unfinished = finished[len(finished)-1:]
+		finished = finished[:len(finished)-1]
+	}
+
+	if len(finished) == 0 {
+		return nil
+	}
+
+	start := finished[0].position
+
+	d := make([]byte, 0, s.bufferedBytes)
+	for _, b := range finished {
+		d = append(d, b.data...)
+	}
+
+	_, err := s.f.WriteAt(d, start)
+	if err != nil {
+		return errors.Wrapf(err, "while writing %d bytes to %q", len(d), s.f.Name())
+	}
+
+	s.buffered = unfinished
+	s.bufferedBytes = 0
+	for _, b := range unfinished {
+		s.bufferedBytes += len(b.data)
+	}
+
+	return nil
+}
+
+// WriteBuffered writes segments buffered in memory to the file.
+// Segments written with the mmap backend are always in the file.
+func (s *SegmentFile) WriteBuffered() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ensureNotClosed()
+
+	s.writePending()
+
+	return s.writeBuffered()
+}
+
+// ReadAt reads bytes of the file, including segments that are still buffered.
+func (s *SegmentFile) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	s.ensureNotClosed()
+	buffered := s.buffered
+	pending := s.pendingSegment()
+	s.mu.Unlock()
+
+	var n int
+	var err error
+
+	if s.backend == FileBackendMmap {
+		n, err = mmapReader(s.mmap()).ReadAt(p, off)
+		if pending != nil {
+			buffered = []bufferedSegment{*pending}
+		}
+	} else {
+		// the file is always extended to cover buffered segments
+		n, err = s.f.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			return n, errors.Wrapf(err, "while reading %q", s.f.Name())
+		}
+	}
+
+	end := off + int64(n)
+
+	first := sort.Search(len(buffered), func(i int) bool {
+		return buffered[i].position+int64(len(buffered[i].data)) > off
+	})
+
+	for _, b := range buffered[first:] {
+		if b.position >= end {
+			break
+		}
+
+		if b.position < off {
+			copy(p[:n], b.data[off-b.position:])
+		} else {
+			copy(p[b.position-off:n], b.data)
+		}
+	}
+
+	return n, err
+}
+
+// preadBytes returns the segment at the position.
+// Buffered segments are returned as they are, so that changes made to them are written.
+func (s *SegmentFile) preadBytes(position uint64) []byte {
+	s.mu.Lock()
+	s.ensureNotClosed()
+
+	i := sort.Search(len(s.buffered), func(i int) bool {
+		return s.buffered[i].position >= int64(position)
+	})
+
+	if i < len(s.buffered) && s.buffered[i].position == int64(position) {
+		d := s.buffered[i].data
+		s.mu.Unlock()
+		return d
+	}
+
+	d, cached := s.cache.get(position)
+	s.mu.Unlock()
+
+	if cached {
+		return d
+	}
+
+	d = make([]byte, readAheadSize)
+	n, err := s.ReadAt(d, int64(position))
+	if err != nil && err != io.EOF {
+		panic(errors.Wrapf(ErrIO, "while reading segment at %d of %q: %s", position, s.f.Name(), err))
+	}
+
+	if n < 4 {
+		return nil
+	}
+
+	d = d[:n]
+
+	length := int(binary.BigEndian.Uint32(d))
+	if length == 0 {
+		return d
+	}
+
+	if length <= n {
+		d = d[:length:length]
+	} else {
+		d = make([]byte, length)
+		n, err = s.ReadAt(d, int64(position))
+		if err != nil && err != io.EOF {
+			panic(errors.Wrapf(ErrIO, "while reading segment at %d of %q: %s", position, s.f.Name(), err))
+		}
+		if n < length {
+			return d[:n]
+		}
+	}
+
+	s.mu.Lock()
+	if !s.closed && position+uint64(length) <= uint64(s.nextFreeByte) {
+		s.cache.put(position, d)
+	}
+	s.mu.Unlock()
+
+	return d
+}
+
+// zeroRange overwrites bytes of the file from start to end with zeros.
+// It must be called with s.mu locked and without buffered segments.
+func (s *SegmentFile) zeroRange(start, end int64) error {
+	if s.backend == FileBackendMmap {
+		mm := s.mmap()
+		for i := start; i < end; i++ {
+			mm[i] = 0
+		}
+		return nil
+	}
+
+	zeros := make([]byte, extendStep)
+	for start < end {
+		n := end - start
+		if n > int64(len(zeros)) {
+			n = int64(len(zeros))
+		}
+
+		_, err := s.f.WriteAt(zeros[:n], start)
+		if err != nil {
+			return errors.Wrapf(err, "while writing %q", s.f.Name())
+		}
+
+		start += n
+	}
+
+	s.cache.clear()
+
+	return nil
+}
+
+// reader returns a reader of the file that does not lock s.
+// It must only be used without buffered segments.
+func (s *SegmentFile) reader() io.ReaderAt {
+	if s.backend == FileBackendMmap {
+		return mmapReader(s.mmap())
+	}
+	return s.f
+}
+
+type mmapReader []byte
+
+func (m mmapReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
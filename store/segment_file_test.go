@@ -1,10 +1,14 @@
 package store_test
 
 import (
+	"encoding/binary"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,3 +19,136 @@ func createTempDir(t *testing.T) (string, func() error) {
 		return os.RemoveAll(td)
 	}
 }
+
+func TestPreadSegmentFile(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	fileName := filepath.Join(td, "l1")
+
+	sf, err := store.OpenOrCreateSegmentFileWithBackend(fileName, 1024*1024*1024, store.FileBackendPread)
+	require.NoError(t, err)
+
+	allocate := func(t *testing.T, size int, fill byte) uint64 {
+		pos, d, err := sf.Allocate(size)
+		require.NoError(t, err)
+		for i := range d {
+			d[i] = fill
+		}
+		binary.BigEndian.PutUint32(d, uint32(size))
+		return pos
+	}
+
+	p1 := allocate(t, 100, 1)
+	p2 := allocate(t, 3*1024*1024, 2)
+
+	t.Run("when segments are buffered", func(t *testing.T) {
+		t.Run("then Bytes returns them", func(t *testing.T) {
+			require.Equal(t, byte(1), sf.Bytes(p1)[99])
+			require.Len(t, sf.Bytes(p2), 3*1024*1024)
+		})
+
+		t.Run("then they are not in the file yet", func(t *testing.T) {
+			d, err := ioutil.ReadFile(fileName)
+			require.NoError(t, err)
+			require.Equal(t, byte(0), d[p1+99])
+		})
+	})
+
+	t.Run("when more segments than fit into the write buffer are allocated", func(t *testing.T) {
+		p3 := allocate(t, 2*1024*1024, 3)
+
+		t.Run("then earlier segments are written to the file", func(t *testing.T) {
+			d, err := ioutil.ReadFile(fileName)
+			require.NoError(t, err)
+			require.Equal(t, byte(1), d[p1+99])
+			require.Equal(t, byte(2), d[p2+4])
+		})
+
+		t.Run("then ReadSegments returns written and buffered segments", func(t *testing.T) {
+			d, err := sf.ReadSegments(p2, sf.UsedBytes(), 8*1024*1024)
+			require.NoError(t, err)
+			require.Len(t, d, 5*1024*1024)
+			require.Equal(t, byte(3), d[p3-p2+4])
+		})
+	})
+
+	t.Run("when the file is reopened", func(t *testing.T) {
+		used := sf.UsedBytes()
+		last := sf.LastSegmentPosition()
+		require.NoError(t, sf.Close())
+
+		sf, err = store.OpenOrCreateSegmentFileWithBackend(fileName, 1024*1024*1024, store.FileBackendPread)
+		require.NoError(t, err)
+		defer sf.Close()
+
+		t.Run("then buffered segments were written on close", func(t *testing.T) {
+			require.Equal(t, used, sf.UsedBytes())
+			require.Equal(t, last, sf.LastSegmentPosition())
+			require.Equal(t, byte(3), sf.Bytes(last)[4])
+		})
+	})
+}
+
+func TestPreadSegmentFileReadFailure(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	fileName := filepath.Join(td, "l1")
+
+	sf, err := store.OpenOrCreateSegmentFileWithBackend(fileName, 1024*1024*1024, store.FileBackendPread)
+	require.NoError(t, err)
+
+	pos, d, err := sf.Allocate(100)
+	require.NoError(t, err)
+	binary.BigEndian.PutUint32(d, 100)
+	require.NoError(t, sf.Close())
+
+	sf, err = store.OpenOrCreateSegmentFileWithBackend(fileName, 1024*1024*1024, store.FileBackendPread)
+	require.NoError(t, err)
+
+	t.Run("when reading a segment from the file fails", func(t *testing.T) {
+		require.NoError(t, store.CloseFile(sf))
+
+		err := func() (err error) {
+			defer func() {
+				err = store.PanicToError(recover())
+			}()
+			sf.Bytes(pos)
+			return nil
+		}()
+
+		t.Run("then it should be turned into ErrIO", func(t *testing.T) {
+			require.Equal(t, store.ErrIO, errors.Cause(err))
+		})
+	})
+}
+
+func TestMmapSegmentFileGrowth(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	sf, err := store.OpenOrCreateSegmentFile(filepath.Join(td, "l1"), 1024*1024*1024)
+	require.NoError(t, err)
+	defer sf.Close()
+
+	pos, d, err := sf.Allocate(100)
+	require.NoError(t, err)
+	binary.BigEndian.PutUint32(d, 100)
+	d[99] = 1
+
+	t.Run("when more is allocated than the file is mapped with", func(t *testing.T) {
+		large, ld, err := sf.Allocate(65 * 1024 * 1024)
+		require.NoError(t, err)
+		binary.BigEndian.PutUint32(ld, uint32(len(ld)))
+
+		t.Run("then segments from the earlier mapping should stay usable", func(t *testing.T) {
+			d[98] = 2
+			require.Equal(t, []byte{2, 1}, sf.Bytes(pos)[98:100])
+		})
+
+		t.Run("then the new segment should be readable", func(t *testing.T) {
+			require.Equal(t, uint32(len(ld)), binary.BigEndian.Uint32(sf.Bytes(large)))
+		})
+	})
+}
@@ -2,40 +2,47 @@ package store
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
+
+	"github.com/pkg/errors"
 )
 
 // layout
 // total length: 4 bytes
-// type: byte
+// type: byte, with hashedFlag set if the segment has a hash slot and sealedFlag if the data is sealed
 // layer_sizes: 4 * 8 bytes
 // number_of_children: 1 byte
 // number_of_children * 8 bytes
+// hash: HashSize bytes, if hashedFlag is set, all zero until the hash is known
+// data
 
 type SegmentReader []byte
 
 func NewSegmentReader(data []byte) SegmentReader {
 	if len(data) < 4 {
-		panic(errors.New("segment data is too short"))
+		panic(errors.Wrap(ErrCorrupt, "segment data is too short"))
 	}
 
 	totalLength := int(binary.BigEndian.Uint32(data))
 
 	if len(data) < totalLength {
-		panic(errors.New("segment data is too short"))
+		panic(errors.Wrap(ErrCorrupt, "segment data is too short"))
 	}
 
 	if totalLength < 4+1+4*8+1 {
-		panic(errors.New("total length is too short"))
+		panic(errors.Wrap(ErrCorrupt, "total length is too short"))
 	}
 
 	numberOfChildren := data[4+1+4*8]
 
-	headerLength := numberOfChildren*8 + 4 + 1 + 4*8 + 1
+	headerLength := int(numberOfChildren)*8 + 4 + 1 + 4*8 + 1
+
+	if data[4]&hashedFlag != 0 {
+		headerLength += HashSize
+	}
 
-	if int(headerLength) > totalLength {
-		panic(errors.New("total length is too short"))
+	if headerLength > totalLength {
+		panic(errors.Wrap(ErrCorrupt, "total length is too short"))
 	}
 
 	return data[:totalLength]
@@ -52,19 +59,55 @@ func (s SegmentReader) SegmentSize() uint64 {
 
 func (s SegmentReader) GetChildAddress(i int) Address {
 	if i < 0 {
-		panic("negative child index")
+		panic(errors.Wrap(ErrInvalidAddress, "negative child index"))
 	}
 
 	if i >= s.NumberOfChildren() {
-		panic("trying to get address of not existing child")
+		panic(errors.Wrapf(ErrInvalidAddress, "segment has no child %d", i))
 	}
 
 	return Address(binary.BigEndian.Uint64(s[4+1+4*8+1+8*i:]))
 }
 
 func (s SegmentReader) GetData() []byte {
-	nc := s.NumberOfChildren()
-	return s[4+1+4*8+1+8*nc:]
+	return s[s.dataOffset():]
+}
+
+func (s SegmentReader) hashOffset() int {
+	return 4 + 1 + 4*8 + 1 + 8*s.NumberOfChildren()
+}
+
+func (s SegmentReader) dataOffset() int {
+	if s.hasHashSlot() {
+		return s.hashOffset() + HashSize
+	}
+	return s.hashOffset()
+}
+
+func (s SegmentReader) hasHashSlot() bool {
+	return s[4]&hashedFlag != 0
+}
+
+// StoredHash returns the hash stored in the segment.
+// It returns false if the segment was written without a hash slot
+// or the hash was not known when it was written.
+func (s SegmentReader) StoredHash() (Hash, bool) {
+	h := Hash{}
+	if !s.hasHashSlot() {
+		return h, false
+	}
+
+	copy(h[:], s[s.hashOffset():])
+
+	return h, h != Hash{}
+}
+
+func (s SegmentReader) isSealed() bool {
+	return s[4]&sealedFlag != 0
+}
+
+func (s SegmentReader) setHash(h Hash) {
+	copy(s[s.hashOffset():], h[:])
 }
 
 func (s SegmentReader) GetLayerTotalSize(l int) uint64 {
@@ -87,7 +130,7 @@ func (s SegmentReader) GetTotalTreeSize() uint64 {
 }
 
 func (s SegmentReader) Type() SegmentType {
-	return SegmentType(s[4])
+	return SegmentType(s[4] &^ (hashedFlag | sealedFlag))
 }
 
 func (s SegmentReader) String() string {
@@ -14,13 +14,36 @@ type SegmentWriter struct {
 }
 
 func NewSegmentWriter(layer int, st Store, segmentType SegmentType, numberOfChildren int, dataSize int) (SegmentWriter, error) {
-	pos, d, err := st[layer].Allocate(4 + 1 + 4*8 + 1 + 8*numberOfChildren + dataSize)
+	return newSegmentWriter(layer, st, segmentType, numberOfChildren, dataSize, formatOf(st[layer]).get().Hashes)
+}
+
+// newSegmentWriter creates a segment with a hash slot if hashed is set.
+// The hash is stored once the segment is finished.
+func newSegmentWriter(layer int, st Store, segmentType SegmentType, numberOfChildren int, dataSize int, hashed bool) (SegmentWriter, error) {
+	hashSize := 0
+	if hashed {
+		hashSize = HashSize
+	}
+
+	size := 4 + 1 + 4*8 + 1 + 8*numberOfChildren + hashSize + dataSize
+
+	// the payload is sealed once the segment is finished
+	overhead := 0
+	c := formatOf(st[layer]).get().Cipher
+	if c != nil && dataSize > 0 {
+		overhead = c.Overhead()
+	}
+
+	pos, d, err := st[layer].Allocate(size + overhead)
 	if err != nil {
 		return SegmentWriter{}, errors.Wrap(err, "while creating segment writer")
 	}
 
-	binary.BigEndian.PutUint32(d, uint32(len(d)))
+	binary.BigEndian.PutUint32(d, uint32(size))
 	d[4] = byte(segmentType)
+	if hashed {
+		d[4] |= hashedFlag
+	}
 
 	binary.BigEndian.PutUint64(d[4+1+layer*8:], uint64(len(d)))
 
@@ -33,7 +56,7 @@ func NewSegmentWriter(layer int, st Store, segmentType SegmentType, numberOfChil
 	return SegmentWriter{
 		st:            st,
 		SegmentReader: NewSegmentReader(d),
-		Data:          d[4+1+4*8+1+8*numberOfChildren:],
+		Data:          d[4+1+4*8+1+8*numberOfChildren+hashSize : size],
 		Address:       NewAddress(layer, pos),
 	}, nil
 }
@@ -60,7 +83,7 @@ func (s SegmentWriter) SetChild(i int, addr Address) {
 
 	if oldChildAddress != NilAddress {
 		for i := 0; i < 4; i++ {
-			oldChildReader := s.st.GetSegment(oldChildAddress)
+			oldChildReader := s.st.rawSegment(oldChildAddress)
 			newSize := s.GetLayerTotalSize(i) - oldChildReader.GetLayerTotalSize(i)
 			s.SetLayerTotalSize(i, newSize)
 		}
@@ -72,7 +95,7 @@ func (s SegmentWriter) SetChild(i int, addr Address) {
 		return
 	}
 
-	newChildReader := NewSegmentReader(s.st.GetSegment(addr))
+	newChildReader := s.st.rawSegment(addr)
 
 	for i := 0; i < 4; i++ {
 		newSize := s.GetLayerTotalSize(i) + newChildReader.GetLayerTotalSize(i)
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Segments stores the segments of a layer.
+// Segments are appended to the layer and are addressed by their position.
+// SegmentFile keeps them in a file, MemorySegments in memory.
+// Operations that only make sense for one of them, such as writing buffered
+// segments to the file, are methods of the concrete type.
+type Segments interface {
+	// Allocate reserves size bytes for a new segment and returns its position and its bytes.
+	Allocate(size int) (uint64, []byte, error)
+	// Bytes returns the bytes of the layer starting at the position.
+	// It returns nil if the position is outside of the layer.
+	Bytes(position uint64) []byte
+
+	UsedBytes() uint64
+	LastSegmentPosition() uint64
+	MaxSize() uint64
+
+	// StartUse marks the layer as used, it won't be closed until FinishUse is called.
+	StartUse()
+	FinishUse()
+	// WaitUnused waits until the layer is not used or ctx is done.
+	WaitUnused(ctx context.Context) error
+
+	// CreateEmptySibling creates an empty layer replacing this one after a commit.
+	CreateEmptySibling() (Segments, error)
+
+	// CloseContext closes the layer once it is not used any more.
+	CloseContext(ctx context.Context) error
+	// CloseAndDelete closes the layer once it is not used any more and deletes its segments.
+	CloseAndDelete() error
+}
+
+// Format describes how segments of a layer are written.
+// Layers created from a layer, such as its sibling after a commit, have the same format.
+type Format struct {
+	// Cipher seals the payloads of new segments, segments with sealed payloads
+	// can't be read without it.
+	Cipher Cipher
+	// Hashes makes new segments store their content hash.
+	// It adds HashSize bytes to every segment.
+	Hashes bool
+}
+
+// layerFormat holds the format of a layer, so that it can be read without locking.
+type layerFormat struct {
+	v atomic.Value
+}
+
+func (f *layerFormat) get() Format {
+	v := f.v.Load()
+	if v == nil {
+		return Format{}
+	}
+	return v.(Format)
+}
+
+func (f *layerFormat) set(nf Format) {
+	f.v.Store(nf)
+}
+
+// formatOf returns the format of the layer.
+func formatOf(l Segments) *layerFormat {
+	switch l := l.(type) {
+	case *SegmentFile:
+		return &l.format
+	case *MemorySegments:
+		return &l.format
+	default:
+		return &layerFormat{}
+	}
+}
+
+// Format returns the format of the layers of the store.
+func (s Store) Format() Format {
+	for _, l := range s {
+		if l != nil {
+			return formatOf(l).get()
+		}
+	}
+	return Format{}
+}
+
+// SetFormat sets the format of all layers of the store.
+func (s Store) SetFormat(f Format) {
+	for _, l := range s {
+		if l != nil {
+			formatOf(l).set(f)
+		}
+	}
+}
+
+// remainingCapacity returns the number of bytes that can still be allocated in the layer.
+func remainingCapacity(l Segments) uint64 {
+	return l.MaxSize() - l.UsedBytes()
+}
+
+// layerName returns the name of the layer, which is the file name for layers in files.
+func layerName(l Segments) string {
+	switch l := l.(type) {
+	case *SegmentFile:
+		return l.Name()
+	case *MemorySegments:
+		return l.name
+	default:
+		return ""
+	}
+}
+
+// createLayer creates an empty layer with the prefix, stored the same way as l.
+func createLayer(l Segments, prefix string, maxSize uint64) (Segments, error) {
+	switch l := l.(type) {
+	case *SegmentFile:
+		return l.CreateLayer(prefix, maxSize)
+	default:
+		m := NewMemorySegments(prefix, maxSize)
+		m.format.set(formatOf(l).get())
+		return m, nil
+	}
+}
+
+// ReadSegments returns a copy of complete segments of the layer starting at offset and ending before end.
+// At most maxLength bytes are returned, unless the first segment is longer.
+func (s Store) ReadSegments(layer int, offset, end uint64, maxLength int) ([]byte, error) {
+	switch l := s[layer].(type) {
+	case *SegmentFile:
+		return l.ReadSegments(offset, end, maxLength)
+	case *MemorySegments:
+		return l.ReadSegments(offset, end, maxLength)
+	default:
+		return nil, errors.Errorf("segments of layer %d can't be read", layer)
+	}
+}
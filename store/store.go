@@ -1,10 +1,10 @@
 package store
 
 import (
+	"context"
 	"encoding/binary"
 	serrors "errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -14,29 +14,68 @@ import (
 	"github.com/segmentio/ksuid"
 )
 
-type Store []*SegmentFile
+type Store []Segments
 
 var ErrNotFound = serrors.New("not found")
 
+// GetSegment returns the segment at the address.
+// Sealed payloads are opened with the cipher of the layer, the returned segment is then a copy.
+// Segments that will be sealed once they are finished are copied as well.
 func (s Store) GetSegment(a Address) SegmentReader {
+	sr := s.rawSegment(a)
+	if sr.isSealed() {
+		return s.openSegment(a, sr)
+	}
+
+	if s.isUnfinished(a, sr) {
+		return append(SegmentReader{}, sr...)
+	}
+
+	return sr
+}
+
+// rawSegment returns the segment at the address as it is stored.
+func (s Store) rawSegment(a Address) SegmentReader {
 	if a == NilAddress {
-		panic("getting Nil Segment")
+		panic(errors.Wrap(ErrInvalidAddress, "getting Nil Segment"))
 	}
 
 	idx := a.Segment()
-	data := s[idx].MMap
+	if idx >= len(s) || s[idx] == nil {
+		panic(errors.Wrapf(ErrInvalidAddress, "layer of %s is not open", a))
+	}
+
+	data := s[idx].Bytes(a.Position())
+
+	if len(data) < 4 {
+		panic(errors.Wrapf(ErrInvalidAddress, "%s is out of the layer", a))
+	}
 
-	length := binary.BigEndian.Uint32(data[a.Position():])
+	length := binary.BigEndian.Uint32(data)
 	if length == 0 {
-		panic("getting segment with length 0")
+		panic(errors.Wrapf(ErrCorrupt, "segment at %s has length 0", a))
 	}
 
-	return []byte(data[a.Position() : int(a.Position())+int(length)])
+	if uint64(length) > uint64(len(data)) {
+		panic(errors.Wrapf(ErrCorrupt, "segment at %s is longer than the layer", a))
+	}
+
+	return NewSegmentReader(data[:length])
 
 }
 
+// CreateSegment creates a segment on the layer, after finishing the last segment of the layer.
 func (s Store) CreateSegment(layer int, segmentType SegmentType, numberOfChildren int, dataSize int) (SegmentWriter, error) {
-	return NewSegmentWriter(layer, s, segmentType, numberOfChildren, dataSize)
+	return s.createSegment(layer, segmentType, numberOfChildren, dataSize, formatOf(s[layer]).get().Hashes)
+}
+
+func (s Store) createSegment(layer int, segmentType SegmentType, numberOfChildren int, dataSize int, hashed bool) (SegmentWriter, error) {
+	err := s.finishSegment(layer)
+	if err != nil {
+		return SegmentWriter{}, err
+	}
+
+	return newSegmentWriter(layer, s, segmentType, numberOfChildren, dataSize, hashed)
 }
 
 func filesWithPrefixSorted(prefix string, infos []os.FileInfo) []string {
@@ -53,7 +92,7 @@ func filesWithPrefixSorted(prefix string, infos []os.FileInfo) []string {
 	return prefixed
 }
 
-func ensureNextLayer(prefix, dir string, maxSize uint64, old ksuid.KSUID) (*SegmentFile, error) {
+func ensureNextLayer(prefix, dir string, maxSize uint64, old ksuid.KSUID, backend FileBackend) (*SegmentFile, error) {
 	newID := ksuid.New()
 	if newID.String() <= old.String() {
 		newID = old.Next()
@@ -61,11 +100,11 @@ func ensureNextLayer(prefix, dir string, maxSize uint64, old ksuid.KSUID) (*Segm
 
 	fileName := fmt.Sprintf("%s-%s", prefix, newID.String())
 
-	return OpenOrCreateSegmentFile(filepath.Join(dir, fileName), maxSize)
+	return OpenOrCreateSegmentFileWithBackend(filepath.Join(dir, fileName), maxSize, backend)
 
 }
 
-func ensureLayer(prefix, dir string, infos []os.FileInfo, maxSize uint64) (*SegmentFile, error) {
+func ensureLayer(prefix, dir string, infos []os.FileInfo, maxSize uint64, backend FileBackend) (*SegmentFile, error) {
 	files := filesWithPrefixSorted(prefix, infos)
 
 	var fileName string
@@ -76,7 +115,7 @@ func ensureLayer(prefix, dir string, infos []os.FileInfo, maxSize uint64) (*Segm
 		fileName = files[len(files)-1]
 	}
 
-	return OpenOrCreateSegmentFile(filepath.Join(dir, fileName), maxSize)
+	return OpenOrCreateSegmentFileWithBackend(filepath.Join(dir, fileName), maxSize, backend)
 }
 
 type layer struct {
@@ -99,34 +138,21 @@ var layers = []layer{
 	},
 }
 
+// Open opens the store in dir for writing.
+// It returns ErrLocked if the store is already opened for writing.
 func Open(dir string) (Store, error) {
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return nil, errors.Wrapf(err, "while listing dir %q", dir)
-	}
-
-	st := make(Store, 4)
-
-	for i, l := range layers {
-		sf, err := ensureLayer(l.prefix, dir, files, l.maxSize)
-		if err != nil {
-			return nil, errors.Wrapf(err, "while ensuring layer %d", i)
-		}
-
-		st[i+1] = sf
-	}
-
-	return st, nil
-
+	st, _, err := OpenAndRecover(dir)
+	return st, err
 }
 
 func (s Store) WithTransaction() (Store, error) {
 	st := make(Store, 4)
 	copy(st, s)
 
-	dir := filepath.Dir(s[1].f.Name())
-
-	sf, err := ensureLayer("transaction", dir, nil, 100*1024*1024)
+	// the transaction layer can grow as large as the last layer, commit merges
+	// it into a deeper layer if it doesn't fit into l1. The file is mapped
+	// only as far as it is used, so small transactions don't reserve that much.
+	sf, err := createLayer(s[1], "transaction", layers[len(layers)-1].maxSize)
 	if err != nil {
 		return nil, errors.Wrap(err, "while creating transaction layer")
 	}
@@ -139,7 +165,7 @@ func (s Store) WithTransaction() (Store, error) {
 func (s Store) IsEmpty() bool {
 	for _, l := range s {
 		if l != nil {
-			if !l.IsEmpty() {
+			if l.UsedBytes() != 0 {
 				return false
 			}
 		}
@@ -151,8 +177,8 @@ func (s Store) IsEmpty() bool {
 func (s Store) Root() Address {
 	for i, l := range s {
 		if l != nil {
-			if !l.IsEmpty() {
-				return NewAddress(i, uint64(l.lastSegmentPosition))
+			if l.UsedBytes() != 0 {
+				return NewAddress(i, l.LastSegmentPosition())
 			}
 		}
 	}
@@ -160,18 +186,94 @@ func (s Store) Root() Address {
 	panic("store is empty")
 }
 
-func (s Store) Close() error {
+// WriteBuffered writes segments buffered in memory to layers 1-3.
+// It has to be called before the manifest of a commit is written.
+func (s Store) WriteBuffered() error {
+	err := s.finishLayers()
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i < len(s); i++ {
+		sf, isFile := s[i].(*SegmentFile)
+		if isFile {
+			err := sf.WriteBuffered()
+			if err != nil {
+				return errors.Wrapf(err, "while writing layer %d", i)
+			}
+		}
+	}
+	return nil
+}
+
+// Flush writes all layers stored in files to disk.
+func (s Store) Flush() error {
+	err := s.finishLayers()
+	if err != nil {
+		return err
+	}
+
 	for i, l := range s {
-		if l != nil {
-			err := l.Close()
+		sf, isFile := l.(*SegmentFile)
+		if isFile {
+			err := sf.Flush()
 			if err != nil {
-				return errors.Wrapf(err, "while closing layer %d", i)
+				return errors.Wrapf(err, "while flushing layer %d", i)
 			}
 		}
 	}
 	return nil
 }
 
+// Close closes all layers and releases the lock of the store.
+func (s Store) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext closes the store once none of its layers is used.
+// If ctx is done before that, the store stays open and the error of ctx is returned.
+func (s Store) CloseContext(ctx context.Context) error {
+	for _, l := range s {
+		if l != nil {
+			err := l.WaitUnused(ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var dir string
+	readOnly := false
+	var closeErr error
+
+	for i, l := range s {
+		if l != nil {
+			sf, isFile := l.(*SegmentFile)
+			if isFile {
+				dir = filepath.Dir(sf.f.Name())
+				readOnly = sf.readOnly
+			}
+			err := l.CloseContext(context.Background())
+			if err != nil && closeErr == nil {
+				closeErr = errors.Wrapf(err, "while closing layer %d", i)
+			}
+		}
+	}
+
+	if dir == "" {
+		return closeErr
+	}
+
+	// the lock is released even if a layer could not be closed,
+	// since the store can't be used any more
+	err := unlockDir(dir, readOnly)
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return err
+}
+
 func (s Store) String() string {
 	sb := &strings.Builder{}
 	for _, l := range s {
@@ -179,20 +281,39 @@ func (s Store) String() string {
 			sb.WriteString("NIL\n")
 			continue
 		}
-		sb.WriteString(fmt.Sprintf("fn: %q maxSize %d nextFreeByte %d\n", filepath.Base(l.f.Name()), l.maxSize, l.nextFreeByte))
+		sb.WriteString(fmt.Sprintf("fn: %q maxSize %d nextFreeByte %d\n", layerName(l), l.MaxSize(), l.UsedBytes()))
 	}
 	return sb.String()
 }
 
+// CalculateSegmentSizes adds sizes of all segments reachable from the address to sizes per layer.
+// Segments reachable through several parents are counted once.
 func (s Store) CalculateSegmentSizes(a Address, sizes []uint64) {
+	s.calculateSegmentSizes(a, MaxLayers-1, sizes, map[Address]bool{})
+}
+
+// LiveLayerSizes returns the number of bytes per layer used by segments reachable from the root.
+// Unlike the layer totals in segment headers, which sum up sizes of children,
+// a segment shared by several parents is counted only once.
+// Since children are never in a lower layer than their parents, only segments
+// in layers up to maxLayer are visited and sizes of deeper layers are left at zero.
+func (s Store) LiveLayerSizes(root Address, maxLayer int) []uint64 {
+	sizes := make([]uint64, MaxLayers)
+	s.calculateSegmentSizes(root, maxLayer, sizes, map[Address]bool{})
+	return sizes
+}
+
+func (s Store) calculateSegmentSizes(a Address, maxLayer int, sizes []uint64, visited map[Address]bool) {
+	if a == NilAddress || a.Segment() > maxLayer || visited[a] {
+		return
+	}
+
+	visited[a] = true
+
 	sr := s.GetSegment(a)
-	ss := sr.SegmentSize()
-	sizes[a.Segment()] += ss
+	sizes[a.Segment()] += sr.SegmentSize()
 	for i := 0; i < sr.NumberOfChildren(); i++ {
-		ca := sr.GetChildAddress(i)
-		if ca != NilAddress {
-			s.CalculateSegmentSizes(ca, sizes)
-		}
+		s.calculateSegmentSizes(sr.GetChildAddress(i), maxLayer, sizes, visited)
 	}
 }
 
@@ -0,0 +1,1004 @@
+package immersadb
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"net"
+
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbblist"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+// Sync protocol
+//
+// The destination sends a syncRequest for a path of the source and the source
+// answers with a syncResponse describing the element at the path: its kind and Hash,
+// the number of entries of maps and lists and, unless its hash is known to the destination,
+// the data of a value.
+// Entries of maps and lists that differ are found by requesting ranges of keys or indexes.
+// For a range with at most syncBatchSize entries, the source sends the key, kind and Hash
+// of each map entry or the kind and Hash of each list element. Larger ranges are split in two,
+// and the source sends the digest and the number of entries of both halves.
+// The destination requests only ranges whose digests differ from its own, so unchanged
+// entries are skipped in large groups, and the data of list elements whose hashes differ.
+// Maps and lists that are elements of lists can't be addressed by a path, requests for them
+// add the steps from the element at the path to them, and they are compared like map entries.
+// Expired entries of maps are left out of the source's answers.
+// The source answers from a single snapshot until the destination sends a request with Done set.
+
+const syncBatchSize = 64
+
+// syncRange is a range of keys of a map, or of indexes of a list, with the digest
+// and the number of its entries. Empty keys are open bounds.
+type syncRange struct {
+	FromKey []byte
+	ToKey   []byte
+	From    uint64
+	To      uint64
+	Digest  Hash
+	Count   uint64
+}
+
+// syncStep selects an entry of a map by its key or, if List is set, an element of a list by its index.
+type syncStep struct {
+	Key   string
+	List  bool
+	Index uint64
+}
+
+type syncRequest struct {
+	Path   string
+	Within []syncStep
+	Known  *Hash
+	Range  *syncRange
+	Items  []uint64
+	Done   bool
+}
+
+type syncEntry struct {
+	Key  string
+	Kind elementKind
+	Hash Hash
+}
+
+type syncResponse struct {
+	Error   string
+	Kind    elementKind
+	Hash    Hash
+	Count   uint64
+	Data    []byte
+	Entries []syncEntry
+	Hashes  []Hash
+	Kinds   []elementKind
+	Ranges  []syncRange
+	Items   [][]byte
+}
+
+// ServeSync answers requests of a destination synchronizing from this database through conn.
+// It returns when the destination is done, ctx is cancelled or the connection fails.
+// If conn implements io.Closer, it is closed when ctx is cancelled.
+func (db *DB) ServeSync(ctx context.Context, conn io.ReadWriter) error {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	rtx := db.NewReadTransactionContext(ctx)
+	defer rtx.Discard()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	for {
+		req := syncRequest{}
+		err := dec.Decode(&req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "while reading sync request")
+		}
+
+		if req.Done {
+			return nil
+		}
+
+		resp, err := rtx.describe(req)
+		if err != nil {
+			resp = syncResponse{Error: err.Error()}
+		}
+
+		err = enc.Encode(resp)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "while sending sync response")
+		}
+	}
+}
+
+func (t *ReadTransaction) describe(req syncRequest) (resp syncResponse, err error) {
+	defer t.guard(&err)()
+
+	parts, err := dbpath.Split(req.Path)
+	if err != nil {
+		return resp, errors.Wrapf(err, "while parsing dbpath %q", req.Path)
+	}
+
+	a, err := t.pathElementAddress(req.Path)
+	if err != nil {
+		return resp, errors.Wrapf(err, "while looking up %q", req.Path)
+	}
+
+	resp.Kind, err = t.kindOf(a)
+	if err != nil {
+		return resp, err
+	}
+
+	a, resp.Kind, err = t.syncElementWithin(a, resp.Kind, req.Within)
+	if err != nil {
+		return resp, errors.Wrapf(err, "while looking up an element within %q", req.Path)
+	}
+
+	resp.Hash = t.st.Hash(a)
+
+	switch {
+	case req.Range != nil && resp.Kind == kindMap:
+		// only entries of maps at a path can expire
+		err = t.describeMapRange(parts, len(req.Within) == 0, a, *req.Range, &resp)
+	case req.Range != nil && resp.Kind == kindList:
+		err = t.describeListRange(a, *req.Range, &resp)
+	case req.Items != nil && resp.Kind == kindList:
+		for _, i := range req.Items {
+			var va store.Address
+			va, err = wbblist.Get(t.st, a, i)
+			if err != nil {
+				break
+			}
+
+			var d []byte
+			d, err = t.readData(va)
+			if err != nil {
+				break
+			}
+
+			resp.Items = append(resp.Items, d)
+		}
+	case resp.Kind == kindMap:
+		resp.Count, err = wbbtree.Count(t.st, a)
+	case resp.Kind == kindList:
+		resp.Count, err = wbblist.Count(t.st, a)
+	case resp.Kind == kindValue && (req.Known == nil || *req.Known != resp.Hash):
+		resp.Data, err = t.readData(a)
+	}
+
+	if err != nil {
+		return resp, errors.Wrapf(err, "while describing %q", req.Path)
+	}
+
+	return resp, nil
+}
+
+// syncElementWithin follows the steps from the element at a of the kind.
+func (t *ReadTransaction) syncElementWithin(a store.Address, kind elementKind, steps []syncStep) (store.Address, elementKind, error) {
+	var err error
+
+	for i, s := range steps {
+		switch {
+		case s.List && kind == kindList:
+			a, err = wbblist.Get(t.st, a, s.Index)
+		case !s.List && kind == kindMap:
+			a, err = wbbtree.Search(t.st, a, []byte(s.Key))
+		default:
+			return store.NilAddress, kind, errors.Errorf("step %d doesn't match the kind of the element", i)
+		}
+
+		if err != nil {
+			return store.NilAddress, kind, err
+		}
+
+		kind, err = t.kindOf(a)
+		if err != nil {
+			return store.NilAddress, kind, err
+		}
+	}
+
+	return a, kind, nil
+}
+
+// describeMapRange describes the entries of the map in the range,
+// or splits the range in two at its middle key if it is too large.
+func (t *ReadTransaction) describeMapRange(parts []string, expires bool, a store.Address, r syncRange, resp *syncResponse) error {
+	_, n, err := wbbtree.RangeDigest(t.st, a, r.FromKey, r.ToKey)
+	if err != nil {
+		return err
+	}
+
+	if n > syncBatchSize {
+		first, err := wbbtree.Rank(t.st, a, r.FromKey)
+		if err != nil {
+			return err
+		}
+
+		middle, err := wbbtree.KeyAt(t.st, a, first+n/2)
+		if err != nil {
+			return err
+		}
+
+		for _, h := range []syncRange{{FromKey: r.FromKey, ToKey: middle}, {FromKey: middle, ToKey: r.ToKey}} {
+			h.Digest, h.Count, err = wbbtree.RangeDigest(t.st, a, h.FromKey, h.ToKey)
+			if err != nil {
+				return err
+			}
+			resp.Ranges = append(resp.Ranges, h)
+		}
+
+		return nil
+	}
+
+	expired, err := t.expiryCheck()
+	if err != nil {
+		return errors.Wrap(err, "while checking expiry")
+	}
+
+	resp.Entries = []syncEntry{}
+
+	return wbbtree.ForEachInRange(t.st, a, r.FromKey, r.ToKey, func(k []byte, ca store.Address) error {
+		if expires {
+			exp, err := expired(append(parts[:len(parts):len(parts)], string(k)))
+			if err != nil || exp {
+				return err
+			}
+		}
+
+		kind, err := t.kindOf(ca)
+		if err != nil {
+			return err
+		}
+
+		resp.Entries = append(resp.Entries, syncEntry{
+			Key:  string(k),
+			Kind: kind,
+			Hash: t.st.Hash(ca),
+		})
+
+		return nil
+	})
+}
+
+// describeListRange describes the elements of the list in the range,
+// or splits the range in two if it is too large.
+func (t *ReadTransaction) describeListRange(a store.Address, r syncRange, resp *syncResponse) error {
+	cnt, err := wbblist.Count(t.st, a)
+	if err != nil {
+		return err
+	}
+
+	if r.To > cnt {
+		r.To = cnt
+	}
+
+	if r.From+syncBatchSize < r.To {
+		middle := r.From + (r.To-r.From)/2
+
+		for _, h := range []syncRange{{From: r.From, To: middle}, {From: middle, To: r.To}} {
+			h.Digest, h.Count, err = wbblist.RangeDigest(t.st, a, h.From, h.To)
+			if err != nil {
+				return err
+			}
+			resp.Ranges = append(resp.Ranges, h)
+		}
+
+		return nil
+	}
+
+	resp.Hashes = []Hash{}
+	resp.Kinds = []elementKind{}
+
+	for i := r.From; i < r.To; i++ {
+		va, err := wbblist.Get(t.st, a, i)
+		if err != nil {
+			return err
+		}
+
+		kind, err := t.kindOf(va)
+		if err != nil {
+			return err
+		}
+
+		resp.Hashes = append(resp.Hashes, t.st.Hash(va))
+		resp.Kinds = append(resp.Kinds, kind)
+	}
+
+	return nil
+}
+
+// SyncFrom brings the element at dstPath in line with the element at srcPath of a source
+// database served by ServeSync through conn. Only maps, lists and values that differ are
+// transferred and changed, in a single transaction.
+// If conn implements io.Closer, it is closed when ctx is cancelled.
+func (db *DB) SyncFrom(ctx context.Context, conn io.ReadWriter, srcPath, dstPath string) error {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	srcParts, err := dbpath.Split(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", srcPath)
+	}
+
+	dstParts, err := dbpath.Split(dstPath)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", dstPath)
+	}
+
+	s := &syncer{
+		enc: gob.NewEncoder(conn),
+		dec: gob.NewDecoder(conn),
+	}
+
+	err = db.TransactionContext(ctx, func(tx *Transaction) error {
+		s.tx = tx
+		return s.syncPath(srcParts, dstParts)
+	})
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = s.enc.Encode(syncRequest{Done: true})
+	if err != nil {
+		return errors.Wrap(err, "while finishing sync")
+	}
+
+	return nil
+}
+
+// Sync brings the element at dstPath of dst in line with the element at srcPath of src.
+func Sync(ctx context.Context, src *DB, srcPath string, dst *DB, dstPath string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sc, dc := net.Pipe()
+	defer sc.Close()
+	defer dc.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- src.ServeSync(ctx, sc)
+	}()
+
+	err := dst.SyncFrom(ctx, dc, srcPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	return <-served
+}
+
+type syncer struct {
+	tx  *Transaction
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+func (s *syncer) request(req syncRequest) (syncResponse, error) {
+	err := s.enc.Encode(req)
+	if err != nil {
+		return syncResponse{}, errors.Wrap(err, "while sending sync request")
+	}
+
+	resp := syncResponse{}
+	err = s.dec.Decode(&resp)
+	if err != nil {
+		return resp, errors.Wrap(err, "while reading sync response")
+	}
+
+	if resp.Error != "" {
+		return resp, errors.Errorf("source failed: %s", resp.Error)
+	}
+
+	return resp, nil
+}
+
+func (s *syncer) syncPath(srcParts, dstParts []string) (err error) {
+	t := s.tx
+	defer t.guard(&err)()
+	return s.sync(srcParts, dstParts, nil)
+}
+
+// sync brings dst in line with src. If the entry of src in its parent map is known,
+// src is requested only if its hash differs from the one of dst.
+func (s *syncer) sync(srcParts, dstParts []string, entry *syncEntry) error {
+	t := s.tx
+	dstPath := dbpath.Join(dstParts...)
+
+	err := t.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	exists := true
+	a, err := t.pathElementAddress(dstPath)
+	if errors.Cause(err) == wbbtree.ErrNotFound {
+		exists = false
+	} else if err != nil {
+		return err
+	}
+
+	var kind elementKind
+	var hash Hash
+
+	if exists {
+		kind, err = t.kindOf(a)
+		if err != nil {
+			return err
+		}
+		hash = t.st.Hash(a)
+	}
+
+	if entry != nil && exists && entry.Kind == kind && entry.Hash == hash {
+		return nil
+	}
+
+	req := syncRequest{Path: dbpath.Join(srcParts...)}
+
+	if exists && kind == kindValue {
+		req.Known = &hash
+	}
+
+	resp, err := s.request(req)
+	if err != nil {
+		return err
+	}
+
+	if exists && resp.Kind == kind && resp.Hash == hash {
+		return nil
+	}
+
+	if len(dstParts) == 0 && resp.Kind != kindMap {
+		return errors.Errorf("can't replace the root map with %q", req.Path)
+	}
+
+	if resp.Kind == kindValue {
+		return t.Put(dstPath, resp.Data)
+	}
+
+	if exists && kind != resp.Kind {
+		err = t.Delete(dstPath)
+		if err != nil {
+			return err
+		}
+		exists = false
+	}
+
+	if resp.Kind == kindList {
+		if !exists {
+			err = t.CreateList(dstPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		return s.syncList(srcParts, dstParts, resp.Count)
+	}
+
+	if !exists {
+		err = t.CreateMap(dstPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.syncMapRange(srcParts, dstParts, syncRange{})
+}
+
+// syncMapRange brings the entries of the dst map in the range in line with those of src.
+func (s *syncer) syncMapRange(srcParts, dstParts []string, r syncRange) error {
+	t := s.tx
+
+	resp, err := s.request(syncRequest{Path: dbpath.Join(srcParts...), Range: &r})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range resp.Ranges {
+		ma, err := t.lookup(dstParts)
+		if err != nil {
+			return err
+		}
+
+		d, n, err := wbbtree.RangeDigest(t.st, ma, h.FromKey, h.ToKey)
+		if err != nil {
+			return err
+		}
+
+		if d == h.Digest && n == h.Count {
+			continue
+		}
+
+		err = s.syncMapRange(srcParts, dstParts, h)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.Ranges != nil {
+		return nil
+	}
+
+	inSource := map[string]bool{}
+	for _, e := range resp.Entries {
+		inSource[e.Key] = true
+	}
+
+	ma, err := t.lookup(dstParts)
+	if err != nil {
+		return err
+	}
+
+	toDelete := []string{}
+	err = wbbtree.ForEachInRange(t.st, ma, r.FromKey, r.ToKey, func(k []byte, _ store.Address) error {
+		if !inSource[string(k)] {
+			toDelete = append(toDelete, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range toDelete {
+		err = t.Delete(dbpath.Join(append(dstParts[:len(dstParts):len(dstParts)], k)...))
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range resp.Entries {
+		e := resp.Entries[i]
+		err = s.sync(
+			append(srcParts[:len(srcParts):len(srcParts)], e.Key),
+			append(dstParts[:len(dstParts):len(dstParts)], e.Key),
+			&e,
+		)
+		if err != nil {
+			return errors.Wrapf(err, "while syncing %q", e.Key)
+		}
+	}
+
+	return nil
+}
+
+// syncList brings the elements of the dst list in line with the count elements of src,
+// comparing elements with the same index.
+func (s *syncer) syncList(srcParts, dstParts []string, count uint64) error {
+	t := s.tx
+	dstPath := dbpath.Join(dstParts...)
+
+	n, err := t.Len(dstPath)
+	if err != nil {
+		return err
+	}
+
+	for ; n > count; n-- {
+		err = t.Remove(dstPath, n-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	return s.syncListRange(srcParts, dstParts, syncRange{From: 0, To: count})
+}
+
+func (s *syncer) syncListRange(srcParts, dstParts []string, r syncRange) error {
+	t := s.tx
+	srcPath := dbpath.Join(srcParts...)
+	dstPath := dbpath.Join(dstParts...)
+
+	resp, err := s.request(syncRequest{Path: srcPath, Range: &r})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range resp.Ranges {
+		la, err := t.lookup(dstParts)
+		if err != nil {
+			return err
+		}
+
+		d, n, err := wbblist.RangeDigest(t.st, la, h.From, h.To)
+		if err != nil {
+			return err
+		}
+
+		if d == h.Digest && n == h.Count {
+			continue
+		}
+
+		err = s.syncListRange(srcParts, dstParts, h)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.Ranges != nil {
+		return nil
+	}
+
+	la, err := t.lookup(dstParts)
+	if err != nil {
+		return err
+	}
+
+	n, err := wbblist.Count(t.st, la)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Kinds) != len(resp.Hashes) {
+		return errors.Errorf("source sent %d kinds of elements of %q, expected %d", len(resp.Kinds), srcPath, len(resp.Hashes))
+	}
+
+	// elements are replaced in ascending order, so that missing ones are appended
+	changed := []uint64{}
+	wanted := []uint64{}
+	for j, h := range resp.Hashes {
+		i := r.From + uint64(j)
+		if i < n {
+			va, err := wbblist.Get(t.st, la, i)
+			if err != nil {
+				return err
+			}
+
+			kind, err := t.kindOf(va)
+			if err != nil {
+				return err
+			}
+
+			if kind == resp.Kinds[j] && t.st.Hash(va) == h {
+				continue
+			}
+		}
+
+		changed = append(changed, i)
+		if resp.Kinds[j] == kindValue {
+			wanted = append(wanted, i)
+		}
+	}
+
+	items := syncResponse{}
+	if len(wanted) > 0 {
+		items, err = s.request(syncRequest{Path: srcPath, Items: wanted})
+		if err != nil {
+			return err
+		}
+
+		if len(items.Items) != len(wanted) {
+			return errors.Errorf("source sent %d elements of %q, expected %d", len(items.Items), srcPath, len(wanted))
+		}
+	}
+
+	for _, i := range changed {
+		if len(wanted) > 0 && wanted[0] == i {
+			ea, err := t.storeData(items.Items[0])
+			if err != nil {
+				return err
+			}
+
+			wanted, items.Items = wanted[1:], items.Items[1:]
+
+			err = t.setListElement(dstPath, i, ea)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		la, err := t.lookup(dstParts)
+		if err != nil {
+			return err
+		}
+
+		ea, err := listElementOrNil(t.st, la, i)
+		if err != nil {
+			return err
+		}
+
+		ea, err = s.syncWithin(srcPath, []syncStep{{List: true, Index: i}}, ea)
+		if err != nil {
+			return errors.Wrapf(err, "while syncing element %d", i)
+		}
+
+		err = t.setListElement(dstPath, i, ea)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listElementOrNil returns the address of the element of the list at the index,
+// or NilAddress if the list is shorter.
+func listElementOrNil(st store.Store, la store.Address, i uint64) (store.Address, error) {
+	n, err := wbblist.Count(st, la)
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	if i >= n {
+		return store.NilAddress, nil
+	}
+
+	return wbblist.Get(st, la, i)
+}
+
+// syncWithin returns the address of an element like the element of src within the element at srcPath,
+// built from the element at a, which is NilAddress if dst has no such element.
+// Elements within lists can't be addressed by a path, so they are rebuilt like an element
+// being imported and then stored in the list at a path.
+func (s *syncer) syncWithin(srcPath string, within []syncStep, a store.Address) (store.Address, error) {
+	t := s.tx
+
+	err := t.ctx.Err()
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	req := syncRequest{Path: srcPath, Within: within}
+
+	var kind elementKind
+	var hash Hash
+
+	if a != store.NilAddress {
+		kind, err = t.kindOf(a)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		hash = t.st.Hash(a)
+		if kind == kindValue {
+			req.Known = &hash
+		}
+	}
+
+	resp, err := s.request(req)
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	if a != store.NilAddress && resp.Kind == kind && resp.Hash == hash {
+		return a, nil
+	}
+
+	if resp.Kind == kindValue {
+		return t.storeData(resp.Data)
+	}
+
+	if kind != resp.Kind {
+		a = store.NilAddress
+	}
+
+	if resp.Kind == kindList {
+		if a == store.NilAddress {
+			a, err = wbblist.CreateEmpty(t.st)
+			if err != nil {
+				return store.NilAddress, err
+			}
+		}
+
+		return s.syncListWithin(srcPath, within, a, resp.Count)
+	}
+
+	if a == store.NilAddress {
+		a, err = wbbtree.CreateEmpty(t.st)
+		if err != nil {
+			return store.NilAddress, err
+		}
+	}
+
+	return s.syncMapRangeWithin(srcPath, within, a, syncRange{})
+}
+
+// syncMapRangeWithin brings the entries of the map at ma in the range in line with those
+// of the map within the element at srcPath, like syncMapRange, and returns the address of the new map.
+func (s *syncer) syncMapRangeWithin(srcPath string, within []syncStep, ma store.Address, r syncRange) (store.Address, error) {
+	t := s.tx
+
+	resp, err := s.request(syncRequest{Path: srcPath, Within: within, Range: &r})
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	for _, h := range resp.Ranges {
+		d, n, err := wbbtree.RangeDigest(t.st, ma, h.FromKey, h.ToKey)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if d == h.Digest && n == h.Count {
+			continue
+		}
+
+		ma, err = s.syncMapRangeWithin(srcPath, within, ma, h)
+		if err != nil {
+			return store.NilAddress, err
+		}
+	}
+
+	if resp.Ranges != nil {
+		return ma, nil
+	}
+
+	inSource := map[string]bool{}
+	for _, e := range resp.Entries {
+		inSource[e.Key] = true
+	}
+
+	toDelete := []string{}
+	err = wbbtree.ForEachInRange(t.st, ma, r.FromKey, r.ToKey, func(k []byte, _ store.Address) error {
+		if !inSource[string(k)] {
+			toDelete = append(toDelete, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	for _, k := range toDelete {
+		ma, err = wbbtree.Delete(t.st, ma, []byte(k))
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if ma == store.NilAddress {
+			ma, err = wbbtree.CreateEmpty(t.st)
+			if err != nil {
+				return store.NilAddress, err
+			}
+		}
+	}
+
+	for _, e := range resp.Entries {
+		ca, err := wbbtree.Search(t.st, ma, []byte(e.Key))
+		if errors.Cause(err) == wbbtree.ErrNotFound {
+			ca = store.NilAddress
+		} else if err != nil {
+			return store.NilAddress, err
+		}
+
+		if ca != store.NilAddress {
+			kind, err := t.kindOf(ca)
+			if err != nil {
+				return store.NilAddress, err
+			}
+
+			if kind == e.Kind && t.st.Hash(ca) == e.Hash {
+				continue
+			}
+		}
+
+		ca, err = s.syncWithin(srcPath, append(within[:len(within):len(within)], syncStep{Key: e.Key}), ca)
+		if err != nil {
+			return store.NilAddress, errors.Wrapf(err, "while syncing %q", e.Key)
+		}
+
+		ma, err = wbbtree.Insert(t.st, ma, []byte(e.Key), ca)
+		if err != nil {
+			return store.NilAddress, err
+		}
+	}
+
+	return ma, nil
+}
+
+// syncListWithin brings the elements of the list at la in line with the count elements
+// of the list within the element at srcPath, and returns the address of the new list.
+func (s *syncer) syncListWithin(srcPath string, within []syncStep, la store.Address, count uint64) (store.Address, error) {
+	t := s.tx
+
+	n, err := wbblist.Count(t.st, la)
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	for ; n > count; n-- {
+		la, err = wbblist.Delete(t.st, la, n-1)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if la == store.NilAddress {
+			la, err = wbblist.CreateEmpty(t.st)
+			if err != nil {
+				return store.NilAddress, err
+			}
+		}
+	}
+
+	if count == 0 {
+		return la, nil
+	}
+
+	return s.syncListRangeWithin(srcPath, within, la, syncRange{From: 0, To: count})
+}
+
+// syncListRangeWithin brings the elements of the list at la in the range in line with those
+// of the list within the element at srcPath. Elements that differ are synced one by one.
+func (s *syncer) syncListRangeWithin(srcPath string, within []syncStep, la store.Address, r syncRange) (store.Address, error) {
+	t := s.tx
+
+	resp, err := s.request(syncRequest{Path: srcPath, Within: within, Range: &r})
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	for _, h := range resp.Ranges {
+		d, n, err := wbblist.RangeDigest(t.st, la, h.From, h.To)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if d == h.Digest && n == h.Count {
+			continue
+		}
+
+		la, err = s.syncListRangeWithin(srcPath, within, la, h)
+		if err != nil {
+			return store.NilAddress, err
+		}
+	}
+
+	if resp.Ranges != nil {
+		return la, nil
+	}
+
+	if len(resp.Kinds) != len(resp.Hashes) {
+		return store.NilAddress, errors.Errorf("source sent %d kinds of elements, expected %d", len(resp.Kinds), len(resp.Hashes))
+	}
+
+	for j, h := range resp.Hashes {
+		i := r.From + uint64(j)
+
+		ea, err := listElementOrNil(t.st, la, i)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		if ea != store.NilAddress {
+			kind, err := t.kindOf(ea)
+			if err != nil {
+				return store.NilAddress, err
+			}
+
+			if kind == resp.Kinds[j] && t.st.Hash(ea) == h {
+				continue
+			}
+		}
+
+		ea, err = s.syncWithin(srcPath, append(within[:len(within):len(within)], syncStep{List: true, Index: i}), ea)
+		if err != nil {
+			return store.NilAddress, errors.Wrapf(err, "while syncing element %d", i)
+		}
+
+		la, err = setListElement(t.st, la, i, ea)
+		if err != nil {
+			return store.NilAddress, err
+		}
+	}
+
+	return la, nil
+}
@@ -0,0 +1,319 @@
+package immersadb_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	sd, cleanupSrc := createTempDir(t)
+	defer cleanupSrc()
+
+	dd, cleanupDst := createTempDir(t)
+	defer cleanupDst()
+
+	src, err := immersadb.Open(sd)
+	require.NoError(t, err)
+	defer src.Close()
+
+	dst, err := immersadb.Open(dd)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	export := func(t *testing.T, db *immersadb.DB, path string) string {
+		buf := &bytes.Buffer{}
+		require.NoError(t, db.Export(path, buf))
+		return buf.String()
+	}
+
+	common := func(tx *immersadb.Transaction) error {
+		for _, m := range []string{"data", "data/same", "data/changed", "data/kind"} {
+			err := tx.CreateMap(m)
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.Put("data/same/a", make([]byte, 100000))
+		if err != nil {
+			return err
+		}
+		err = tx.Put("data/changed/a", []byte("1"))
+		if err != nil {
+			return err
+		}
+		return tx.Put("data/changed/b", []byte("2"))
+	}
+
+	err = src.Transaction(func(tx *immersadb.Transaction) error {
+		err := common(tx)
+		if err != nil {
+			return err
+		}
+		err = tx.Put("data/changed/a", []byte("changed"))
+		if err != nil {
+			return err
+		}
+		err = tx.Put("data/changed/new", []byte("new"))
+		if err != nil {
+			return err
+		}
+		err = tx.Put("data/kind/x", []byte("value"))
+		if err != nil {
+			return err
+		}
+		err = tx.CreateList("data/list")
+		if err != nil {
+			return err
+		}
+		return tx.Append("data/list", []byte("item"))
+	})
+	require.NoError(t, err)
+
+	err = dst.Transaction(func(tx *immersadb.Transaction) error {
+		err := common(tx)
+		if err != nil {
+			return err
+		}
+		err = tx.Delete("data/changed/b")
+		if err != nil {
+			return err
+		}
+		err = tx.Put("data/changed/extra", []byte("extra"))
+		if err != nil {
+			return err
+		}
+		err = tx.CreateMap("data/kind/x")
+		if err != nil {
+			return err
+		}
+		return tx.Put("data/list", []byte("not a list"))
+	})
+	require.NoError(t, err)
+
+	t.Run("when I sync diverged databases", func(t *testing.T) {
+		err = immersadb.Sync(context.Background(), src, "data", dst, "data")
+		require.NoError(t, err)
+
+		t.Run("then the destination should match the source", func(t *testing.T) {
+			require.Equal(t, export(t, src, "data"), export(t, dst, "data"))
+		})
+
+		t.Run("then syncing again should change nothing", func(t *testing.T) {
+			seq := dst.Seq()
+			err = immersadb.Sync(context.Background(), src, "data", dst, "data")
+			require.NoError(t, err)
+			require.Equal(t, seq, dst.Seq())
+		})
+	})
+
+	t.Run("when I sync a sub-map to a new path through a connection", func(t *testing.T) {
+		sc, dc := net.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			served <- src.ServeSync(context.Background(), sc)
+		}()
+
+		err = dst.SyncFrom(context.Background(), dc, "data/changed", "copy")
+		require.NoError(t, err)
+		require.NoError(t, <-served)
+
+		t.Run("then the new path should match the source", func(t *testing.T) {
+			require.Equal(t, export(t, src, "data/changed"), export(t, dst, "copy"))
+		})
+	})
+
+	t.Run("when I sync a path that doesn't exist in the source", func(t *testing.T) {
+		err = immersadb.Sync(context.Background(), src, "missing", dst, "data")
+
+		t.Run("then it should fail", func(t *testing.T) {
+			require.Error(t, err)
+		})
+
+		t.Run("then the destination should not change", func(t *testing.T) {
+			require.Equal(t, export(t, src, "data"), export(t, dst, "data"))
+		})
+	})
+}
+
+type countingConn struct {
+	net.Conn
+	read int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestSyncTransfersDifferences(t *testing.T) {
+	sd, cleanupSrc := createTempDir(t)
+	defer cleanupSrc()
+
+	dd, cleanupDst := createTempDir(t)
+	defer cleanupDst()
+
+	src, err := immersadb.Open(sd)
+	require.NoError(t, err)
+	defer src.Close()
+
+	dst, err := immersadb.Open(dd)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	value := make([]byte, 100)
+
+	// keys are written in a different order to each database
+	fill := func(db *immersadb.DB, reversed bool) {
+		err := db.Transaction(func(tx *immersadb.Transaction) error {
+			err := tx.CreateMap("big")
+			if err != nil {
+				return err
+			}
+
+			err = tx.CreateList("list")
+			if err != nil {
+				return err
+			}
+
+			for i := 0; i < 2000; i++ {
+				k := i
+				if reversed {
+					k = 1999 - i
+				}
+
+				err = tx.Put(fmt.Sprintf("big/%04d", k), value)
+				if err != nil {
+					return err
+				}
+
+				err = tx.Append("list", value)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	fill(src, false)
+	fill(dst, true)
+
+	err = dst.Transaction(func(tx *immersadb.Transaction) error {
+		err := tx.Put("big/0100", []byte("changed"))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete("big/1500")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Remove("list", 1000)
+		if err != nil {
+			return err
+		}
+
+		return tx.Insert("list", 1000, []byte("changed"))
+	})
+	require.NoError(t, err)
+
+	export := func(t *testing.T, db *immersadb.DB) string {
+		buf := &bytes.Buffer{}
+		require.NoError(t, db.Export("", buf))
+		return buf.String()
+	}
+
+	t.Run("when I sync databases that differ in a few entries", func(t *testing.T) {
+		sc, dc := net.Pipe()
+		conn := &countingConn{Conn: dc}
+
+		served := make(chan error, 1)
+		go func() {
+			served <- src.ServeSync(context.Background(), sc)
+		}()
+
+		err = dst.SyncFrom(context.Background(), conn, "", "")
+		require.NoError(t, err)
+		require.NoError(t, <-served)
+
+		t.Run("then the destination should match the source", func(t *testing.T) {
+			require.Equal(t, export(t, src), export(t, dst))
+		})
+
+		t.Run("then only a small part of the source should be transferred", func(t *testing.T) {
+			require.Less(t, conn.read, len(export(t, src))/100)
+		})
+	})
+}
+
+func TestSyncNestedLists(t *testing.T) {
+	sd, cleanupSrc := createTempDir(t)
+	defer cleanupSrc()
+
+	dd, cleanupDst := createTempDir(t)
+	defer cleanupDst()
+
+	src, err := immersadb.Open(sd)
+	require.NoError(t, err)
+	defer src.Close()
+
+	dst, err := immersadb.Open(dd)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	putJSON := func(t *testing.T, db *immersadb.DB, path, doc string) {
+		err := db.Transaction(func(tx *immersadb.Transaction) error {
+			return tx.PutJSON(path, json.RawMessage(doc))
+		})
+		require.NoError(t, err)
+	}
+
+	getJSON := func(t *testing.T, db *immersadb.DB, path string) string {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		d, err := rtx.GetJSON(path)
+		require.NoError(t, err)
+		return string(d)
+	}
+
+	doc := `{"items":[{"a":1,"tags":["x",{"deep":[[],[true,null]]}]},[1,[2,3]],{"b":{"c":[1,2]}},3]}`
+
+	putJSON(t, src, "doc", doc)
+	putJSON(t, dst, "doc", `{"items":[{"a":2,"tags":["x",{"deep":[[1],[true]]}]},"was a value",{"b":{"c":[1,2],"d":4}},[3],5]}`)
+
+	t.Run("when I sync lists with maps and lists as elements", func(t *testing.T) {
+		err = immersadb.Sync(context.Background(), src, "doc", dst, "doc")
+		require.NoError(t, err)
+
+		t.Run("then the destination should match the source", func(t *testing.T) {
+			require.JSONEq(t, doc, getJSON(t, dst, "doc"))
+		})
+
+		t.Run("then syncing again should change nothing", func(t *testing.T) {
+			seq := dst.Seq()
+			err = immersadb.Sync(context.Background(), src, "doc", dst, "doc")
+			require.NoError(t, err)
+			require.Equal(t, seq, dst.Seq())
+		})
+	})
+
+	t.Run("when I sync them to a new path", func(t *testing.T) {
+		err = immersadb.Sync(context.Background(), src, "doc", dst, "copy")
+		require.NoError(t, err)
+
+		t.Run("then the new path should match the source", func(t *testing.T) {
+			require.JSONEq(t, doc, getJSON(t, dst, "copy"))
+		})
+	})
+}
@@ -1,6 +1,7 @@
 package immersadb
 
 import (
+	"context"
 	serrors "errors"
 
 	"github.com/draganm/immersadb/data"
@@ -12,62 +13,81 @@ import (
 
 type Transaction struct {
 	*ReadTransaction
-	db *DB
+	db        *DB
+	leafIndex *txLeafIndex
+	// base is the committed root the transaction started from
+	base       store.Address
+	baseUser   store.Address
+	baseSystem store.Address
+	// extractors of indexes registered when the transaction started
+	extractors map[string]IndexExtractor
+	indexCache struct {
+		at   store.Address
+		defs []*indexDefinition
+	}
 }
 
-func newTransaction(st store.Store, root store.Address, db *DB) (*Transaction, error) {
+// newTransaction must be called with db.mu locked.
+func newTransaction(ctx context.Context, db *DB) (*Transaction, error) {
 
-	txStore, err := st.WithTransaction()
+	txStore, err := db.st.WithTransaction()
 	if err != nil {
 		return nil, errors.Wrap(err, "while opening tx file")
 	}
 
 	txStore.StartUse()
 
+	var li *txLeafIndex
+	if db.leafIndex != nil {
+		li = db.leafIndex.newTransactionIndex(txStore, db.root)
+	}
+
 	return &Transaction{
 		ReadTransaction: &ReadTransaction{
-			st:   txStore,
-			root: root,
+			ctx:    ctx,
+			st:     txStore,
+			root:   db.userRoot,
+			system: db.systemRoot,
 		},
-		db: db,
+		db:         db,
+		leafIndex:  li,
+		base:       db.root,
+		baseUser:   db.userRoot,
+		baseSystem: db.systemRoot,
+		extractors: db.indexExtractors(),
 	}, nil
 
 }
 
 var ErrAlreadyExists = serrors.New("Already exists")
 
-func (t *Transaction) CreateMap(path string) error {
-	return t.modifyPath(path, func(ad store.Address, key string) (store.Address, error) {
-		_, err := wbbtree.Search(t.st, ad, []byte(key))
-		if err == nil {
-			return store.NilAddress, ErrAlreadyExists
-		}
-		if errors.Cause(err) != wbbtree.ErrNotFound {
+func (t *Transaction) CreateMap(path string) (err error) {
+	defer t.guard(&err)()
+
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	return t.write(parts, func(old store.Address) (store.Address, error) {
+		occupied, err := t.occupied(parts, old)
+		if err != nil {
 			return store.NilAddress, err
 		}
 
+		if occupied {
+			return store.NilAddress, ErrAlreadyExists
+		}
+
 		ea, err := wbbtree.CreateEmpty(t.st)
 		if err != nil {
 			return store.NilAddress, errors.Wrap(err, "while creating empty map")
 		}
 
-		return wbbtree.Insert(t.st, ad, []byte(key), ea)
+		return ea, nil
 	})
 }
 
-func (t *Transaction) modifyPath(path string, f func(ad store.Address, key string) (store.Address, error)) error {
-	pth, err := dbpath.Split(path)
-	if err != nil {
-		return errors.Wrapf(err, "while parsing dbpath %q", path)
-	}
-	nr, err := modifyPath(t.st, t.root, pth, f)
-	if err != nil {
-		return errors.Wrap(err, "while modifying path")
-	}
-	t.root = nr
-	return nil
-}
-
 func modifyPath(st store.Store, ad store.Address, path []string, f func(ad store.Address, key string) (store.Address, error)) (store.Address, error) {
 
 	if len(path) == 0 {
@@ -90,24 +110,205 @@ func modifyPath(st store.Store, ad store.Address, path []string, f func(ad store
 
 }
 
-func (t *Transaction) Commit() error {
-	return t.db.commit(t.st[0], t.root)
+func (t *Transaction) Commit() (err error) {
+	defer t.guard(&err)()
+	if t.closed {
+		return ErrClosed
+	}
+	defer t.close()
+
+	root := t.base
+	if t.root != t.baseUser || t.system != t.baseSystem {
+		root, err = joinRoot(t.st, t.root, t.system)
+		if err != nil {
+			t.db.rollback(t.st)
+			return err
+		}
+	}
+
+	return t.db.commit(t.ctx, t.st, root, t.leafIndex)
+}
+
+func (t *Transaction) Rollback() (err error) {
+	defer t.guard(&err)()
+	if t.closed {
+		return ErrClosed
+	}
+	defer t.close()
+	return t.db.rollback(t.st)
 }
 
-func (t *Transaction) Rollback() error {
-	return t.db.rollback(t.st[0])
+func (t *Transaction) Put(path string, d []byte) (err error) {
+	defer t.guard(&err)()
+
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	return t.write(parts, func(store.Address) (store.Address, error) {
+		return t.storeData(d)
+	})
 }
 
-func (t *Transaction) Put(path string, d []byte) error {
-	return t.modifyPath(path, func(ad store.Address, key string) (store.Address, error) {
-		da, err := data.StoreData(t.st, d, t.db.dataSegmentSize, t.db.dataFanout)
+// write replaces the element at the path with the result of f, which is passed
+// the element stored there or NilAddress. If f returns NilAddress, the element is deleted.
+// All modifications of the user tree that replace a whole element go through write,
+// which keeps index entries and expiry of the path up to date.
+func (t *Transaction) write(parts []string, f func(old store.Address) (store.Address, error)) error {
+	if len(parts) == 0 {
+		return errors.New("attempted to modify parent of root")
+	}
+
+	old, na, err := t.modifyElement(parts, f)
+	if err != nil {
+		return err
+	}
+
+	return t.replaced(parts, old, na)
+}
+
+// modifyElement replaces the element at the path with the result of f like write,
+// but leaves indexes and expiry alone. The root can be replaced, but not deleted.
+func (t *Transaction) modifyElement(parts []string, f func(old store.Address) (store.Address, error)) (old, na store.Address, err error) {
+	if len(parts) == 0 {
+		na, err = f(t.root)
+		if err != nil {
+			return store.NilAddress, store.NilAddress, err
+		}
+
+		if na == store.NilAddress {
+			return store.NilAddress, store.NilAddress, errors.New("attempted to delete the root")
+		}
+
+		old = t.root
+		t.root = na
+		return old, na, nil
+	}
+
+	// the old element is looked up without checking its expiry,
+	// so that index entries of expired values are removed too
+	nr, err := modifyPath(t.st, t.root, parts, func(ad store.Address, key string) (store.Address, error) {
+		var err error
+		old, err = wbbtree.Search(t.st, ad, []byte(key))
+		if errors.Cause(err) == wbbtree.ErrNotFound {
+			old = store.NilAddress
+		} else if err != nil {
+			return store.NilAddress, err
+		}
+
+		na, err = f(old)
 		if err != nil {
-			return store.NilAddress, errors.Wrap(err, "while storing data")
+			return store.NilAddress, err
+		}
+
+		if na != store.NilAddress {
+			ra, err := wbbtree.Insert(t.st, ad, []byte(key), na)
+			if err != nil {
+				return store.NilAddress, errors.Wrapf(err, "while inserting %q into %s", key, ad)
+			}
+			return ra, nil
 		}
-		ra, err := wbbtree.Insert(t.st, ad, []byte(key), da)
+
+		ra, err := wbbtree.Delete(t.st, ad, []byte(key))
 		if err != nil {
-			return store.NilAddress, errors.Wrapf(err, "while inserting %q into %s", key, ad)
+			return store.NilAddress, errors.Wrapf(err, "while deleting %q from %s", key, ad)
 		}
+
+		if ra == store.NilAddress {
+			return wbbtree.CreateEmpty(t.st)
+		}
+
 		return ra, nil
 	})
+	if err != nil {
+		return store.NilAddress, store.NilAddress, errors.Wrap(err, "while modifying path")
+	}
+
+	t.root = nr
+
+	return old, na, nil
+}
+
+// replaced updates index entries of the parent map and expiry
+// after the element at the path was replaced.
+func (t *Transaction) replaced(parts []string, old, na store.Address) error {
+	err := t.clearExpiry(parts)
+	if err != nil {
+		return err
+	}
+
+	return t.modified(parts, old, na)
+}
+
+// modified updates index entries of the parent map after the element
+// at the path was changed in place, such as a list that got a new element.
+// Unlike replaced, it keeps the expiry of the path.
+func (t *Transaction) modified(parts []string, old, na store.Address) error {
+	key := parts[len(parts)-1]
+
+	defs, err := t.indexesOf(parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+
+	for _, def := range defs {
+		err = t.reindexValue(def, key, old, na)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.reindexUnder(parts)
+}
+
+func (t *Transaction) storeData(d []byte) (store.Address, error) {
+	dw := t.newDataWriter()
+
+	// write in chunks, so that storing a large value can be cancelled
+	for len(d) > 0 {
+		err := t.ctx.Err()
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		n := len(d)
+		if n > t.db.dataSegmentSize {
+			n = t.db.dataSegmentSize
+		}
+
+		_, err = dw.Write(d[:n])
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while writing data")
+		}
+
+		d = d[n:]
+	}
+
+	da, err := dw.Finish()
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while storing data")
+	}
+	return da, nil
+}
+
+func (t *Transaction) newDataWriter() *data.DataWriter {
+	dw := data.NewDataWriter(t.st, t.db.dataSegmentSize, t.db.dataFanout)
+	if t.leafIndex != nil {
+		dw.WithLeafIndex(t.leafIndex)
+	}
+	return dw
+}
+
+func (t *Transaction) Delete(path string) (err error) {
+	defer t.guard(&err)()
+
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	return t.write(parts, func(store.Address) (store.Address, error) {
+		return store.NilAddress, nil
+	})
 }
@@ -0,0 +1,477 @@
+package immersadb
+
+import (
+	"context"
+	"encoding/binary"
+	serrors "errors"
+	"time"
+
+	"github.com/draganm/immersadb/dbpath"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/pkg/errors"
+)
+
+// Expiry of values is kept in two system maps:
+// expiry maps the deadline (8 bytes of big endian unix nanoseconds) followed by the path
+// to the deadline, so that it can be iterated in the order of deadlines,
+// and expires maps the path to the deadline.
+const (
+	expiryMapKey  = "expiry"
+	expiresMapKey = "expires"
+)
+
+const defaultReapInterval = time.Second
+
+const reapBatchSize = 1000
+
+var errStopIteration = serrors.New("stop iteration")
+
+// PutWithTTL stores the value at the path, like Put, and deletes it once ttl has passed.
+// Until the value is deleted by the reaper, reads of the path return not found
+// and enumerations of its map skip the key, but Count of the map still includes it.
+// Replacing or deleting the path removes the expiry, copying or moving it keeps it.
+func (t *Transaction) PutWithTTL(path string, d []byte, ttl time.Duration) (err error) {
+	defer t.guard(&err)()
+
+	err = t.Put(path, d)
+	if err != nil {
+		return err
+	}
+
+	parts, err := dbpath.Split(path)
+	if err != nil {
+		return errors.Wrapf(err, "while parsing dbpath %q", path)
+	}
+
+	deadline := make([]byte, 8)
+	binary.BigEndian.PutUint64(deadline, uint64(time.Now().Add(ttl).UnixNano()))
+
+	da, err := t.storeData(deadline)
+	if err != nil {
+		return err
+	}
+
+	return t.setExpiry([]byte(dbpath.Join(parts...)), da)
+}
+
+// setExpiry adds the deadline stored at da to the path.
+func (t *Transaction) setExpiry(p []byte, da store.Address) error {
+	deadline, err := t.readData(da)
+	if err != nil {
+		return errors.Wrap(err, "while reading deadline")
+	}
+
+	err = t.modifySystemMap([]string{expiryMapKey}, func(ma store.Address) (store.Address, error) {
+		return wbbtree.Insert(t.st, ma, append(deadline, p...), da)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "while adding expiry of %q", p)
+	}
+
+	err = t.modifySystemMap([]string{expiresMapKey}, func(ma store.Address) (store.Address, error) {
+		return wbbtree.Insert(t.st, ma, p, da)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "while adding expiry of %q", p)
+	}
+
+	return nil
+}
+
+// expired returns true if the value at the path has a deadline that has passed.
+func (t *ReadTransaction) expired(parts []string) (bool, error) {
+	expired, err := t.expiryCheck()
+	if err != nil {
+		return false, err
+	}
+	return expired(parts)
+}
+
+// expiryCheck returns a function telling if the value at a path has a deadline that has passed,
+// which looks up the map of deadlines only once.
+func (t *ReadTransaction) expiryCheck() (func(parts []string) (bool, error), error) {
+	ea, err := t.systemMap(expiresMapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixNano()
+
+	return func(parts []string) (bool, error) {
+		if ea == store.NilAddress {
+			return false, nil
+		}
+
+		da, err := wbbtree.Search(t.st, ea, []byte(dbpath.Join(parts...)))
+		if errors.Cause(err) == wbbtree.ErrNotFound {
+			return false, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		deadline, err := t.readData(da)
+		if err != nil {
+			return false, errors.Wrap(err, "while reading deadline")
+		}
+
+		return int64(binary.BigEndian.Uint64(deadline)) <= now, nil
+	}, nil
+}
+
+// occupied returns true if there is an element at the path that has not expired.
+// old is the element at the path, looked up without checking its expiry.
+func (t *Transaction) occupied(parts []string, old store.Address) (bool, error) {
+	if old == store.NilAddress {
+		return false, nil
+	}
+
+	expired, err := t.expired(parts)
+	if err != nil {
+		return false, errors.Wrap(err, "while checking expiry")
+	}
+
+	return !expired, nil
+}
+
+// copyExpiry gives paths under dst the deadlines of the same paths under src.
+func (t *Transaction) copyExpiry(src, dst []string) error {
+	expiries, err := t.expiriesMovedTo(src, dst)
+	if err != nil {
+		return err
+	}
+
+	return t.setExpiries(expiries)
+}
+
+// expiry is the deadline of a path.
+type expiry struct {
+	p  []byte
+	da store.Address
+}
+
+// expiriesMovedTo returns deadlines of the path src and of paths under it, moved to dst.
+func (t *Transaction) expiriesMovedTo(src, dst []string) ([]expiry, error) {
+	ea, err := t.systemMap(expiresMapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if ea == store.NilAddress {
+		return nil, nil
+	}
+
+	sp := dbpath.Join(src...)
+	dp := dbpath.Join(dst...)
+
+	expiries := []expiry{}
+
+	da, err := wbbtree.Search(t.st, ea, []byte(sp))
+	if err == nil {
+		expiries = append(expiries, expiry{p: []byte(dp), da: da})
+	} else if errors.Cause(err) != wbbtree.ErrNotFound {
+		return nil, err
+	}
+
+	err = wbbtree.ForEachWithPrefix(t.st, ea, []byte(sp+dbpath.Separator), func(k []byte, da store.Address) error {
+		expiries = append(expiries, expiry{p: append([]byte(dp), k[len(sp):]...), da: da})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return expiries, nil
+}
+
+func (t *Transaction) setExpiries(expiries []expiry) error {
+	for _, e := range expiries {
+		err := t.setExpiry(e.p, e.da)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clearExpiry removes expiry of the path and of all paths under it.
+func (t *Transaction) clearExpiry(parts []string) error {
+	ea, err := t.systemMap(expiresMapKey)
+	if err != nil {
+		return err
+	}
+
+	if ea == store.NilAddress {
+		return nil
+	}
+
+	p := dbpath.Join(parts...)
+
+	paths := [][]byte{}
+
+	_, err = wbbtree.Search(t.st, ea, []byte(p))
+	if err == nil {
+		paths = append(paths, []byte(p))
+	} else if errors.Cause(err) != wbbtree.ErrNotFound {
+		return err
+	}
+
+	err = wbbtree.ForEachWithPrefix(t.st, ea, []byte(p+dbpath.Separator), func(k []byte, _ store.Address) error {
+		paths = append(paths, k)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range paths {
+		err = t.removeExpiry(k)
+		if err != nil {
+			return errors.Wrapf(err, "while removing expiry of %q", k)
+		}
+	}
+
+	return nil
+}
+
+func (t *Transaction) removeExpiry(p []byte) error {
+	var deadline []byte
+
+	err := t.modifySystemMap([]string{expiresMapKey}, func(ma store.Address) (store.Address, error) {
+		da, err := wbbtree.Search(t.st, ma, p)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		deadline, err = t.readData(da)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while reading deadline")
+		}
+
+		return deleteIfExists(t.st, ma, p)
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.modifySystemMap([]string{expiryMapKey}, func(ma store.Address) (store.Address, error) {
+		return deleteIfExists(t.st, ma, append(deadline, p...))
+	})
+}
+
+// ReapExpired deletes values whose deadline has passed and returns how many were deleted.
+// It is called periodically by the database once a value was stored with PutWithTTL,
+// unless Options.ReapInterval is negative.
+// Values are deleted in transactions of at most 1000 values. No transaction
+// is started if no deadline has passed.
+func (db *DB) ReapExpired(ctx context.Context) (int, error) {
+	total := 0
+
+	for {
+		n, err := db.reapBatch(ctx)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		if n < reapBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func (db *DB) reapBatch(ctx context.Context) (int, error) {
+	due, err := db.expiryDue(ctx)
+	if err != nil || !due {
+		return 0, err
+	}
+
+	tx, err := db.newTransactionContext(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		db.mu.Lock()
+		db.reaping = false
+		db.commitCond.Broadcast()
+		db.mu.Unlock()
+	}()
+
+	n, err := tx.reapExpired(time.Now())
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// expiryDue returns true if the deadline of a value has passed.
+func (db *DB) expiryDue(ctx context.Context) (bool, error) {
+	rtx := db.NewReadTransactionContext(ctx)
+	defer rtx.Discard()
+	return rtx.expiryDue(time.Now())
+}
+
+func (t *ReadTransaction) expiryDue(now time.Time) (due bool, err error) {
+	defer t.guard(&err)()
+
+	ea, err := t.systemMap(expiryMapKey)
+	if err != nil || ea == store.NilAddress {
+		return false, err
+	}
+
+	// the first key holds the earliest deadline
+	err = wbbtree.ForEach(t.st, ea, func(k []byte, _ store.Address) error {
+		due = int64(binary.BigEndian.Uint64(k)) <= now.UnixNano()
+		return errStopIteration
+	})
+	if err != nil && err != errStopIteration {
+		return false, err
+	}
+
+	return due, nil
+}
+
+func (t *Transaction) reapExpired(now time.Time) (n int, err error) {
+	defer t.guard(&err)()
+
+	ea, err := t.systemMap(expiryMapKey)
+	if err != nil || ea == store.NilAddress {
+		return 0, err
+	}
+
+	paths := []string{}
+
+	err = wbbtree.ForEach(t.st, ea, func(k []byte, _ store.Address) error {
+		if len(paths) == reapBatchSize || int64(binary.BigEndian.Uint64(k)) > now.UnixNano() {
+			return errStopIteration
+		}
+		paths = append(paths, string(k[8:]))
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return 0, err
+	}
+
+	for _, p := range paths {
+		err = t.ctx.Err()
+		if err != nil {
+			return 0, err
+		}
+
+		err = t.Delete(p)
+		if errors.Cause(err) == wbbtree.ErrNotFound {
+			// the map containing the value is gone
+			err = t.removeExpiry([]byte(p))
+		}
+
+		if err != nil {
+			return 0, errors.Wrapf(err, "while deleting expired %q", p)
+		}
+	}
+
+	return len(paths), nil
+}
+
+type reaper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startReaper starts deleting expired values every interval,
+// unless it is running already or no value was stored with PutWithTTL.
+// It must be called with db.mu locked.
+func (db *DB) startReaper() {
+	if db.reapInterval < 0 || db.reaper != nil || !db.hasExpiries() {
+		return
+	}
+
+	interval := db.reapInterval
+	if interval == 0 {
+		interval = defaultReapInterval
+	}
+
+	r := &reaper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	db.reaper = r
+
+	go func() {
+		defer close(r.done)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() {
+			select {
+			case <-r.stop:
+				cancel()
+			case <-r.done:
+			}
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				// failures, such as a transaction in progress, are retried on the next tick
+				db.ReapExpired(ctx)
+			}
+		}
+	}()
+}
+
+// hasExpiries returns true if there is a map of deadlines.
+// It must be called with db.mu locked.
+func (db *DB) hasExpiries() bool {
+	rtx := &ReadTransaction{
+		ctx:    context.Background(),
+		st:     db.st,
+		root:   db.userRoot,
+		system: db.systemRoot,
+	}
+
+	found, err := rtx.hasSystemMap(expiryMapKey)
+	// a corrupt system map is reported by transactions
+	return err == nil && found
+}
+
+func (t *ReadTransaction) hasSystemMap(key string) (found bool, err error) {
+	defer t.guard(&err)()
+	ma, err := t.systemMap(key)
+	return ma != store.NilAddress, err
+}
+
+// stopReaper stops the reaper and waits until it is finished.
+// It returns true if the reaper was running.
+func (db *DB) stopReaper() bool {
+	db.mu.Lock()
+	r := db.reaper
+	db.reaper = nil
+	db.mu.Unlock()
+
+	if r == nil {
+		return false
+	}
+
+	close(r.stop)
+	<-r.done
+
+	return true
+}
@@ -0,0 +1,316 @@
+package immersadb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/draganm/immersadb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTL(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.OpenWithOptions(td, immersadb.Options{ReapInterval: -1})
+	require.NoError(t, err)
+	defer db.Close()
+
+	exists := func(t *testing.T, path string) bool {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		ex, err := rtx.Exists(path)
+		require.NoError(t, err)
+		return ex
+	}
+
+	count := func(t *testing.T, path string) uint64 {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		cnt, err := rtx.Count(path)
+		require.NoError(t, err)
+		return cnt
+	}
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		err := tx.CreateMap("cache")
+		if err != nil {
+			return err
+		}
+
+		err = tx.PutWithTTL("cache/short", []byte("1"), 50*time.Millisecond)
+		if err != nil {
+			return err
+		}
+
+		err = tx.PutWithTTL("cache/long", []byte("2"), time.Hour)
+		if err != nil {
+			return err
+		}
+
+		err = tx.PutWithTTL("cache/overwritten", []byte("3"), 50*time.Millisecond)
+		if err != nil {
+			return err
+		}
+
+		return tx.Put("cache/overwritten", []byte("4"))
+	})
+	require.NoError(t, err)
+
+	t.Run("when the deadline has not passed", func(t *testing.T) {
+		t.Run("then values should be readable", func(t *testing.T) {
+			require.True(t, exists(t, "cache/short"))
+			require.True(t, exists(t, "cache/long"))
+		})
+	})
+
+	time.Sleep(60 * time.Millisecond)
+
+	t.Run("when the deadline has passed", func(t *testing.T) {
+		t.Run("then expired values should not be found", func(t *testing.T) {
+			require.False(t, exists(t, "cache/short"))
+
+			rtx := db.NewReadTransaction()
+			defer rtx.Discard()
+			_, err := rtx.Get("cache/short")
+			require.Error(t, err)
+		})
+
+		t.Run("then values with a later deadline should be readable", func(t *testing.T) {
+			require.True(t, exists(t, "cache/long"))
+		})
+
+		t.Run("then overwritten values should not expire", func(t *testing.T) {
+			require.True(t, exists(t, "cache/overwritten"))
+		})
+
+		t.Run("then expired values should still be counted until reaped", func(t *testing.T) {
+			require.Equal(t, uint64(3), count(t, "cache"))
+		})
+	})
+
+	t.Run("when I reap expired values", func(t *testing.T) {
+		n, err := db.ReapExpired(context.Background())
+		require.NoError(t, err)
+
+		t.Run("then only expired values should be deleted", func(t *testing.T) {
+			require.Equal(t, 1, n)
+			require.Equal(t, uint64(2), count(t, "cache"))
+		})
+
+		t.Run("then reaping again should delete nothing", func(t *testing.T) {
+			n, err := db.ReapExpired(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, 0, n)
+		})
+
+		t.Run("then reaping with no deadline passed should not commit", func(t *testing.T) {
+			seq := db.Seq()
+			_, err := db.ReapExpired(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, seq, db.Seq())
+		})
+	})
+
+	t.Run("when I delete the map of a value with a deadline", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			err := tx.Delete("cache")
+			if err != nil {
+				return err
+			}
+			err = tx.CreateMap("cache")
+			if err != nil {
+				return err
+			}
+			return tx.Put("cache/long", []byte("5"))
+		})
+		require.NoError(t, err)
+
+		t.Run("then a new value at the same path should not expire", func(t *testing.T) {
+			n, err := db.ReapExpired(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, 0, n)
+			require.True(t, exists(t, "cache/long"))
+		})
+	})
+}
+
+func TestTTLWrites(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.OpenWithOptions(td, immersadb.Options{ReapInterval: -1})
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.RegisterIndex("byValue", "cache", func(v []byte) [][]byte {
+		return [][]byte{v}
+	}))
+
+	err = db.Transaction(func(tx *immersadb.Transaction) error {
+		err := tx.CreateMap("cache")
+		if err != nil {
+			return err
+		}
+
+		for _, k := range []string{"reaped", "replaced", "copied", "moved", "json", "map"} {
+			err = tx.PutWithTTL("cache/"+k, []byte(k), 50*time.Millisecond)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Copy("cache/copied", "copy")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Move("cache/moved", "moved")
+		if err != nil {
+			return err
+		}
+
+		err = tx.PutJSON("cache/json", "doc")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete("cache/map")
+		if err != nil {
+			return err
+		}
+
+		return tx.CreateMap("cache/map")
+	})
+	require.NoError(t, err)
+
+	time.Sleep(60 * time.Millisecond)
+
+	read := func(t *testing.T, f func(rtx *immersadb.ReadTransaction) error) {
+		rtx := db.NewReadTransaction()
+		defer rtx.Discard()
+		require.NoError(t, f(rtx))
+	}
+
+	t.Run("when the deadline has passed", func(t *testing.T) {
+		t.Run("then copied and moved values should have expired", func(t *testing.T) {
+			read(t, func(rtx *immersadb.ReadTransaction) error {
+				for _, p := range []string{"copy", "moved", "cache/copied"} {
+					ex, err := rtx.Exists(p)
+					if err != nil {
+						return err
+					}
+					require.False(t, ex, p)
+				}
+				return nil
+			})
+		})
+
+		t.Run("then values replaced with JSON or a map should not expire", func(t *testing.T) {
+			read(t, func(rtx *immersadb.ReadTransaction) error {
+				d, err := rtx.GetJSON("cache")
+				require.JSONEq(t, `{"json":"doc","map":{}}`, string(d))
+				return err
+			})
+		})
+
+		t.Run("then enumerating the map should skip expired values", func(t *testing.T) {
+			keys := []string{}
+			read(t, func(rtx *immersadb.ReadTransaction) error {
+				return rtx.ForEach("cache", func(k string) error {
+					keys = append(keys, k)
+					return nil
+				})
+			})
+			require.Equal(t, []string{"json", "map"}, keys)
+		})
+
+		t.Run("then looking up the index should skip expired values", func(t *testing.T) {
+			read(t, func(rtx *immersadb.ReadTransaction) error {
+				keys, err := rtx.LookupIndex("byValue", []byte("reaped"))
+				require.Empty(t, keys)
+				return err
+			})
+		})
+
+		t.Run("then a map can be created at the path of an expired value", func(t *testing.T) {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.CreateMap("cache/replaced")
+			})
+			require.NoError(t, err)
+		})
+	})
+
+	t.Run("when I reap expired values", func(t *testing.T) {
+		n, err := db.ReapExpired(context.Background())
+		require.NoError(t, err)
+
+		t.Run("then expired, copied and moved values should be deleted", func(t *testing.T) {
+			require.Equal(t, 4, n)
+		})
+
+		t.Run("then index entries of deleted and replaced values should be removed", func(t *testing.T) {
+			err = db.Transaction(func(tx *immersadb.Transaction) error {
+				return tx.Put("cache/reaped", []byte("again"))
+			})
+			require.NoError(t, err)
+
+			read(t, func(rtx *immersadb.ReadTransaction) error {
+				for _, term := range []string{"reaped", "replaced"} {
+					keys, err := rtx.LookupIndex("byValue", []byte(term))
+					if err != nil {
+						return err
+					}
+					require.Empty(t, keys, term)
+				}
+				return nil
+			})
+		})
+	})
+}
+
+func TestTTLReaper(t *testing.T) {
+	td, cleanup := createTempDir(t)
+	defer cleanup()
+
+	db, err := immersadb.OpenWithOptions(td, immersadb.Options{ReapInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer db.Close()
+
+	t.Run("when I put values with a short TTL", func(t *testing.T) {
+		err = db.Transaction(func(tx *immersadb.Transaction) error {
+			err := tx.CreateMap("cache")
+			if err != nil {
+				return err
+			}
+			for _, k := range []string{"a", "b", "c"} {
+				err = tx.PutWithTTL("cache/"+k, []byte(k), 20*time.Millisecond)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		t.Run("then the reaper should delete them", func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				rtx := db.NewReadTransaction()
+				defer rtx.Discard()
+				cnt, err := rtx.Count("cache")
+				require.NoError(t, err)
+				return cnt == 0
+			}, time.Second, 10*time.Millisecond)
+		})
+
+		t.Run("then transactions should not collide with the reaper", func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				err = db.Transaction(func(tx *immersadb.Transaction) error {
+					return tx.PutWithTTL("cache/x", []byte("x"), time.Millisecond)
+				})
+				require.NoError(t, err)
+			}
+		})
+	})
+}
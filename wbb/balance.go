@@ -0,0 +1,107 @@
+package wbb
+
+import (
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+const weight = 4
+
+// Balance rotates the node at k, whose sub-trees are balanced, if one of them
+// is too heavy. Nodes are of segment type t.
+func Balance(s store.Store, t store.SegmentType, k store.Address) (store.Address, error) {
+	return tree{s: s, t: t}.balance(k)
+}
+
+// IsBalanced returns true if the tree with the root, of nodes of segment type t, is balanced.
+func IsBalanced(s store.Store, t store.SegmentType, root store.Address) (bool, error) {
+	return tree{s: s, t: t}.isBalanced(root)
+}
+
+func (tr tree) balance(k store.Address) (store.Address, error) {
+	if k == store.NilAddress {
+		return k, nil
+
+	}
+	nr, err := tr.newNodeReader(k)
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while creating node reader")
+	}
+	ln := nr.leftCount()
+	rn := nr.rightCount()
+
+	if ln+rn <= 2 {
+		return k, nil
+	}
+
+	if rn > weight*ln { // right is too big
+		rnnr, err := tr.newNodeReader(nr.rightChild())
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating node reader")
+		}
+
+		rln := rnnr.leftCount()
+		rrn := rnnr.rightCount()
+
+		if rln < rrn {
+			return tr.singleLeft(k)
+		} else {
+			return tr.doubleLeft(k)
+		}
+	}
+
+	if ln > weight*rn { // left is too big
+		lnnr, err := tr.newNodeReader(nr.leftChild())
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating node reader")
+		}
+		lln := lnnr.leftCount()
+		lrn := lnnr.rightCount()
+
+		if lrn < lln {
+			return tr.singleRight(k)
+		} else {
+			return tr.doubleRight(k)
+		}
+	}
+
+	return k, nil
+
+}
+
+func (tr tree) isBalanced(root store.Address) (bool, error) {
+	if root == store.NilAddress {
+		return true, nil
+	}
+
+	nr, err := tr.newNodeReader(root)
+	if err != nil {
+		return false, errors.Wrap(err, "while creating node reader")
+	}
+
+	lcnt := nr.leftCount()
+	rcnt := nr.rightCount()
+
+	if lcnt+rcnt <= 2 {
+		return true, nil
+	}
+
+	if lcnt > weight*rcnt {
+		return false, nil
+	}
+
+	lc := nr.leftChild()
+
+	bal, err := tr.isBalanced(lc)
+	if err != nil {
+		return false, err
+	}
+
+	if !bal {
+		return false, err
+	}
+
+	rc := nr.rightChild()
+
+	return tr.isBalanced(rc)
+}
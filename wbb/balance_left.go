@@ -1,23 +1,23 @@
-package wbbtree
+package wbb
 
 import (
 	"github.com/draganm/immersadb/store"
 	"github.com/pkg/errors"
 )
 
-func singleLeft(s store.Store, k store.Address) (store.Address, error) {
+func (tr tree) singleLeft(k store.Address) (store.Address, error) {
 
-	nr, err := newNodeReader(s, k)
+	nr, err := tr.newNodeReader(k)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	rcnr, err := newNodeReader(s, nr.rightChild())
+	rcnr, err := tr.newNodeReader(nr.rightChild())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	nm, err := newNodeModifier(s, nr.key())
+	nm, err := tr.newNodeModifier(nr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -29,12 +29,12 @@ func singleLeft(s store.Store, k store.Address) (store.Address, error) {
 	nm.setRightCount(rcnr.leftCount())
 
 	nlc := nm.Address
-	nlccount, err := Count(s, nlc)
+	nlccount, err := tr.count(nlc)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while getting count of a'")
 	}
 
-	nm, err = newNodeModifier(s, rcnr.key())
+	nm, err = tr.newNodeModifier(rcnr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -50,23 +50,23 @@ func singleLeft(s store.Store, k store.Address) (store.Address, error) {
 	return nm.Address, nil
 }
 
-func doubleLeft(s store.Store, k store.Address) (store.Address, error) {
-	nr, err := newNodeReader(s, k)
+func (tr tree) doubleLeft(k store.Address) (store.Address, error) {
+	nr, err := tr.newNodeReader(k)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	rcnr, err := newNodeReader(s, nr.rightChild())
+	rcnr, err := tr.newNodeReader(nr.rightChild())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	rlcnr, err := newNodeReader(s, rcnr.leftChild())
+	rlcnr, err := tr.newNodeReader(rcnr.leftChild())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	nm, err := newNodeModifier(s, nr.key())
+	nm, err := tr.newNodeModifier(nr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -81,7 +81,7 @@ func doubleLeft(s store.Store, k store.Address) (store.Address, error) {
 
 	nlc := nm.Address
 
-	nm, err = newNodeModifier(s, rcnr.key())
+	nm, err = tr.newNodeModifier(rcnr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -96,17 +96,17 @@ func doubleLeft(s store.Store, k store.Address) (store.Address, error) {
 
 	nrc := nm.Address
 
-	nlccount, err := Count(s, nlc)
+	nlccount, err := tr.count(nlc)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while getting count of a'")
 	}
 
-	nrccount, err := Count(s, nrc)
+	nrccount, err := tr.count(nrc)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while getting count of c'")
 	}
 
-	nm, err = newNodeModifier(s, rlcnr.key())
+	nm, err = tr.newNodeModifier(rlcnr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -1,23 +1,23 @@
-package wbbtree
+package wbb
 
 import (
 	"github.com/draganm/immersadb/store"
 	"github.com/pkg/errors"
 )
 
-func singleRight(s store.Store, k store.Address) (store.Address, error) {
+func (tr tree) singleRight(k store.Address) (store.Address, error) {
 
-	nr, err := newNodeReader(s, k)
+	nr, err := tr.newNodeReader(k)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	lcnr, err := newNodeReader(s, nr.leftChild())
+	lcnr, err := tr.newNodeReader(nr.leftChild())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	nm, err := newNodeModifier(s, nr.key())
+	nm, err := tr.newNodeModifier(nr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -31,12 +31,12 @@ func singleRight(s store.Store, k store.Address) (store.Address, error) {
 
 	nrc := nm.Address
 
-	nrccount, err := Count(s, nrc)
+	nrccount, err := tr.count(nrc)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while getting count of a'")
 	}
 
-	nm, err = newNodeModifier(s, lcnr.key())
+	nm, err = tr.newNodeModifier(lcnr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -51,23 +51,23 @@ func singleRight(s store.Store, k store.Address) (store.Address, error) {
 	return nm.Address, nil
 }
 
-func doubleRight(s store.Store, k store.Address) (store.Address, error) {
-	nr, err := newNodeReader(s, k)
+func (tr tree) doubleRight(k store.Address) (store.Address, error) {
+	nr, err := tr.newNodeReader(k)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	lcnr, err := newNodeReader(s, nr.leftChild())
+	lcnr, err := tr.newNodeReader(nr.leftChild())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	lrcnr, err := newNodeReader(s, lcnr.rightChild())
+	lrcnr, err := tr.newNodeReader(lcnr.rightChild())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node reader")
 	}
 
-	nm, err := newNodeModifier(s, nr.key())
+	nm, err := tr.newNodeModifier(nr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -82,7 +82,7 @@ func doubleRight(s store.Store, k store.Address) (store.Address, error) {
 
 	nrc := nm.Address
 
-	nm, err = newNodeModifier(s, lcnr.key())
+	nm, err = tr.newNodeModifier(lcnr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
@@ -97,17 +97,17 @@ func doubleRight(s store.Store, k store.Address) (store.Address, error) {
 
 	nlc := nm.Address
 
-	nlccount, err := Count(s, nlc)
+	nlccount, err := tr.count(nlc)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while getting count of a'")
 	}
 
-	nrccount, err := Count(s, nrc)
+	nrccount, err := tr.count(nrc)
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while getting count of c'")
 	}
 
-	nm, err = newNodeModifier(s, lrcnr.key())
+	nm, err = tr.newNodeModifier(lrcnr.payload())
 	if err != nil {
 		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
 	}
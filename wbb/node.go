@@ -0,0 +1,130 @@
+// Package wbb balances weight balanced binary trees stored in segments.
+// It is shared by the maps of wbbtree and the lists of wbblist, whose nodes
+// have the same layout and differ only in the segment type and the payload:
+//
+//	children: left child, right child, value
+//	data: left count (8 bytes), right count (8 bytes), payload
+package wbb
+
+import (
+	"encoding/binary"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// tree holds the store and the segment type of the nodes of a tree.
+type tree struct {
+	s store.Store
+	t store.SegmentType
+}
+
+type nodeReader store.SegmentReader
+
+func (tr tree) newNodeReader(a store.Address) (nodeReader, error) {
+	sr := tr.s.GetSegment(a)
+	if sr.Type() != tr.t {
+		return nodeReader{}, errors.Errorf("segment %s is %s and not %s", a, sr.Type(), tr.t)
+	}
+
+	if sr.NumberOfChildren() == 0 && len(sr.GetData()) == 0 {
+		// empty node
+		return nodeReader(sr), nil
+	}
+
+	if sr.NumberOfChildren() != 3 {
+		return nodeReader{}, errors.New("segment does not have 3 children")
+	}
+
+	if len(sr.GetData()) < 16 {
+		return nodeReader{}, errors.New("segment must have at least 16 bytes")
+	}
+
+	return nodeReader(sr), nil
+}
+
+func (n nodeReader) segmentReader() store.SegmentReader {
+	return store.SegmentReader(n)
+}
+
+func (n nodeReader) isEmpty() bool {
+	return n.segmentReader().NumberOfChildren() == 0
+}
+
+func (n nodeReader) leftChild() store.Address {
+	return n.segmentReader().GetChildAddress(0)
+}
+
+func (n nodeReader) rightChild() store.Address {
+	return n.segmentReader().GetChildAddress(1)
+}
+
+func (n nodeReader) value() store.Address {
+	return n.segmentReader().GetChildAddress(2)
+}
+
+func (n nodeReader) payload() []byte {
+	return n.segmentReader().GetData()[16:]
+}
+
+func (n nodeReader) leftCount() uint64 {
+	return binary.BigEndian.Uint64(n.segmentReader().GetData())
+}
+
+func (n nodeReader) rightCount() uint64 {
+	return binary.BigEndian.Uint64(n.segmentReader().GetData()[8:])
+}
+
+type nodeModifier store.SegmentWriter
+
+// newNodeModifier creates a node with the payload, which is the key of map nodes.
+func (tr tree) newNodeModifier(payload []byte) (nodeModifier, error) {
+	sw, err := tr.s.CreateSegment(0, tr.t, 3, 16+len(payload))
+	if err != nil {
+		return nodeModifier{}, errors.Wrap(err, "while creating segment")
+	}
+	copy(sw.Data[16:], payload)
+	return nodeModifier(sw), nil
+}
+
+func (n nodeModifier) segmentWriter() store.SegmentWriter {
+	return store.SegmentWriter(n)
+}
+
+func (n nodeModifier) setLeftCount(c uint64) {
+	binary.BigEndian.PutUint64(n.Data, c)
+}
+
+func (n nodeModifier) setRightCount(c uint64) {
+	binary.BigEndian.PutUint64(n.Data[8:], c)
+}
+
+func (n nodeModifier) setLeftChild(lck store.Address) {
+	n.segmentWriter().SetChild(0, lck)
+}
+
+func (n nodeModifier) setRightChild(rck store.Address) {
+	n.segmentWriter().SetChild(1, rck)
+}
+
+func (n nodeModifier) setValue(vk store.Address) {
+	n.segmentWriter().SetChild(2, vk)
+}
+
+// count returns the number of values in the tree with the root.
+func (tr tree) count(root store.Address) (uint64, error) {
+	if root == store.NilAddress {
+		return 0, nil
+	}
+
+	nr, err := tr.newNodeReader(root)
+	if err != nil {
+		return 0, errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return 0, nil
+	}
+
+	return nr.leftCount() + nr.rightCount() + 1, nil
+}
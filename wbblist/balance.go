@@ -0,0 +1,14 @@
+package wbblist
+
+import (
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbb"
+)
+
+func balance(s store.Store, k store.Address) (store.Address, error) {
+	return wbb.Balance(s, store.TypeListNode, k)
+}
+
+func IsBalanced(s store.Store, root store.Address) (bool, error) {
+	return wbb.IsBalanced(s, store.TypeListNode, root)
+}
@@ -0,0 +1,99 @@
+package wbblist
+
+import (
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// Delete removes the value at the index, shifting all following elements back by one.
+// It returns NilAddress when the last element was removed.
+func Delete(s store.Store, root store.Address, index uint64) (store.Address, error) {
+	if root == store.NilAddress {
+		return store.NilAddress, ErrIndexOutOfRange
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return store.NilAddress, ErrIndexOutOfRange
+	}
+
+	lc := nr.leftCount()
+
+	switch {
+	case index < lc:
+		newLeft, err := Delete(s, nr.leftChild(), index)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		nm, err := newNodeModifier(s)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating node modifier")
+		}
+
+		nm.setRightChild(nr.rightChild())
+		nm.setRightCount(nr.rightCount())
+		nm.setValue(nr.value())
+
+		nm.setLeftChild(newLeft)
+		nm.setLeftCount(lc - 1)
+
+		return balance(s, nm.Address)
+
+	case index == lc:
+		if nr.leftChild() == store.NilAddress {
+			return nr.rightChild(), nil
+		}
+
+		if nr.rightChild() == store.NilAddress {
+			return nr.leftChild(), nil
+		}
+
+		succ, err := Get(s, nr.rightChild(), 0)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while finding successor")
+		}
+
+		newRight, err := Delete(s, nr.rightChild(), 0)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while deleting successor")
+		}
+
+		nm, err := newNodeModifier(s)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating node modifier")
+		}
+
+		nm.setLeftChild(nr.leftChild())
+		nm.setLeftCount(lc)
+		nm.setRightChild(newRight)
+		nm.setRightCount(nr.rightCount() - 1)
+		nm.setValue(succ)
+
+		return balance(s, nm.Address)
+
+	default:
+		newRight, err := Delete(s, nr.rightChild(), index-lc-1)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		nm, err := newNodeModifier(s)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating node modifier")
+		}
+
+		nm.setLeftChild(nr.leftChild())
+		nm.setLeftCount(lc)
+		nm.setValue(nr.value())
+
+		nm.setRightChild(newRight)
+		nm.setRightCount(nr.rightCount() - 1)
+
+		return balance(s, nm.Address)
+	}
+}
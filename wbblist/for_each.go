@@ -0,0 +1,40 @@
+package wbblist
+
+import (
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// ForEach calls f with the index and the value address of every element in order.
+func ForEach(s store.Store, root store.Address, f func(uint64, store.Address) error) error {
+	return forEach(s, root, 0, f)
+}
+
+func forEach(s store.Store, root store.Address, offset uint64, f func(uint64, store.Address) error) error {
+	if root == store.NilAddress {
+		return nil
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return nil
+	}
+
+	lc := nr.leftCount()
+
+	err = forEach(s, nr.leftChild(), offset, f)
+	if err != nil {
+		return err
+	}
+
+	err = f(offset+lc, nr.value())
+	if err != nil {
+		return err
+	}
+
+	return forEach(s, nr.rightChild(), offset+lc+1, f)
+}
@@ -0,0 +1,37 @@
+package wbblist
+
+import (
+	serrors "errors"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+var ErrIndexOutOfRange = serrors.New("index out of range")
+
+// Get returns the address of the value at the index.
+func Get(s store.Store, root store.Address, index uint64) (store.Address, error) {
+	if root == store.NilAddress {
+		return store.NilAddress, ErrIndexOutOfRange
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return store.NilAddress, ErrIndexOutOfRange
+	}
+
+	lc := nr.leftCount()
+
+	switch {
+	case index < lc:
+		return Get(s, nr.leftChild(), index)
+	case index == lc:
+		return nr.value(), nil
+	default:
+		return Get(s, nr.rightChild(), index-lc-1)
+	}
+}
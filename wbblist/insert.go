@@ -0,0 +1,88 @@
+package wbblist
+
+import (
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// Insert inserts the value at the index, shifting all following elements by one.
+// Index equal to the number of elements appends the value.
+func Insert(s store.Store, root store.Address, index uint64, value store.Address) (store.Address, error) {
+	cnt, err := Count(s, root)
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	if index > cnt {
+		return store.NilAddress, ErrIndexOutOfRange
+	}
+
+	return insert(s, root, index, value)
+}
+
+func insert(s store.Store, root store.Address, index uint64, value store.Address) (store.Address, error) {
+	if root == store.NilAddress {
+		nm, err := newNodeModifier(s)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating node modifier")
+		}
+
+		nm.setValue(value)
+		return nm.Address, nil
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		nm, err := newNodeModifier(s)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating node modifier")
+		}
+
+		nm.setValue(value)
+		return nm.Address, nil
+	}
+
+	if index <= nr.leftCount() {
+		newLeft, err := insert(s, nr.leftChild(), index, value)
+		if err != nil {
+			return store.NilAddress, err
+		}
+
+		nm, err := newNodeModifier(s)
+		if err != nil {
+			return store.NilAddress, errors.Wrap(err, "while creating node modifier")
+		}
+
+		nm.setRightChild(nr.rightChild())
+		nm.setRightCount(nr.rightCount())
+		nm.setValue(nr.value())
+
+		nm.setLeftChild(newLeft)
+		nm.setLeftCount(nr.leftCount() + 1)
+
+		return balance(s, nm.Address)
+	}
+
+	newRight, err := insert(s, nr.rightChild(), index-nr.leftCount()-1, value)
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	nm, err := newNodeModifier(s)
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
+	}
+
+	nm.setLeftChild(nr.leftChild())
+	nm.setLeftCount(nr.leftCount())
+	nm.setValue(nr.value())
+
+	nm.setRightChild(newRight)
+	nm.setRightCount(nr.rightCount() + 1)
+
+	return balance(s, nm.Address)
+}
@@ -0,0 +1,213 @@
+package wbblist_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/draganm/immersadb/data"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbblist"
+	"github.com/stretchr/testify/require"
+)
+
+func createTempDir(t *testing.T) (string, func() error) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	return td, func() error {
+		return os.RemoveAll(td)
+	}
+}
+
+func newTestStore(t *testing.T) (store.Store, func() error) {
+	td, cleanup := createTempDir(t)
+
+	l0, err := store.OpenOrCreateSegmentFile(filepath.Join(td, "l0"), 100*1024*1024)
+	require.NoError(t, err)
+
+	st := store.Store{l0}
+
+	return st, func() error {
+		err = l0.Close()
+		if err != nil {
+			return err
+		}
+		return cleanup()
+	}
+}
+
+type listTester struct {
+	st store.Store
+	rk store.Address
+}
+
+func (lt *listTester) insert(t *testing.T, i uint64, v byte) {
+	va, err := data.StoreData(lt.st, []byte{v}, 8129, 4)
+	require.NoError(t, err)
+	lt.rk, err = wbblist.Insert(lt.st, lt.rk, i, va)
+	require.NoError(t, err)
+}
+
+func (lt *listTester) delete(t *testing.T, i uint64) {
+	var err error
+	lt.rk, err = wbblist.Delete(lt.st, lt.rk, i)
+	require.NoError(t, err)
+}
+
+func (lt *listTester) get(t *testing.T, i uint64) byte {
+	va, err := wbblist.Get(lt.st, lt.rk, i)
+	require.NoError(t, err)
+	r, err := data.NewReader(va, lt.st)
+	require.NoError(t, err)
+	d, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return d[0]
+}
+
+func (lt *listTester) list(t *testing.T) []byte {
+	l := []byte{}
+	err := wbblist.ForEach(lt.st, lt.rk, func(i uint64, va store.Address) error {
+		require.Equal(t, uint64(len(l)), i)
+		r, err := data.NewReader(va, lt.st)
+		if err != nil {
+			return err
+		}
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		l = append(l, d[0])
+		return nil
+	})
+	require.NoError(t, err)
+	return l
+}
+
+func TestList(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	empty, err := wbblist.CreateEmpty(st)
+	require.NoError(t, err)
+
+	lt := &listTester{st: st, rk: empty}
+
+	t.Run("empty list should have count of 0", func(t *testing.T) {
+		cnt, err := wbblist.Count(st, lt.rk)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), cnt)
+	})
+
+	t.Run("getting an element of an empty list should fail", func(t *testing.T) {
+		_, err := wbblist.Get(st, lt.rk, 0)
+		require.Equal(t, wbblist.ErrIndexOutOfRange, err)
+	})
+
+	t.Run("inserting past the end should fail", func(t *testing.T) {
+		_, err := wbblist.Insert(st, lt.rk, 1, empty)
+		require.Equal(t, wbblist.ErrIndexOutOfRange, err)
+	})
+
+	t.Run("when I append, insert and delete elements", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		model := []byte{}
+
+		for i := 0; i < 500; i++ {
+			if len(model) > 0 && rnd.Intn(3) == 0 {
+				idx := rnd.Intn(len(model))
+				lt.delete(t, uint64(idx))
+				model = append(model[:idx], model[idx+1:]...)
+				continue
+			}
+
+			idx := rnd.Intn(len(model) + 1)
+			v := byte(rnd.Intn(256))
+			lt.insert(t, uint64(idx), v)
+			model = append(model[:idx], append([]byte{v}, model[idx:]...)...)
+		}
+
+		t.Run("then the elements should be in the expected order", func(t *testing.T) {
+			require.Equal(t, model, lt.list(t))
+		})
+
+		t.Run("then the count should match", func(t *testing.T) {
+			cnt, err := wbblist.Count(st, lt.rk)
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(model)), cnt)
+		})
+
+		t.Run("then getting elements by index should return them", func(t *testing.T) {
+			for i, v := range model {
+				require.Equal(t, v, lt.get(t, uint64(i)))
+			}
+		})
+
+		t.Run("then the list should be balanced", func(t *testing.T) {
+			bal, err := wbblist.IsBalanced(st, lt.rk)
+			require.NoError(t, err)
+			require.True(t, bal)
+		})
+	})
+}
+
+func TestListRangeDigest(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	newList := func() *listTester {
+		empty, err := wbblist.CreateEmpty(st)
+		require.NoError(t, err)
+		return &listTester{st: st, rk: empty}
+	}
+
+	appended := newList()
+	prepended := newList()
+
+	for i := 0; i < 50; i++ {
+		appended.insert(t, uint64(i), byte(i))
+		prepended.insert(t, 0, byte(49-i))
+	}
+
+	t.Run("when lists with the same elements were written in a different order", func(t *testing.T) {
+		t.Run("then digests of their ranges should be equal", func(t *testing.T) {
+			for _, r := range [][2]uint64{{0, 50}, {0, 100}, {10, 20}, {49, 50}, {20, 20}} {
+				da, na, err := wbblist.RangeDigest(st, appended.rk, r[0], r[1])
+				require.NoError(t, err)
+				dp, np, err := wbblist.RangeDigest(st, prepended.rk, r[0], r[1])
+				require.NoError(t, err)
+				require.Equal(t, da, dp)
+				require.Equal(t, na, np)
+			}
+		})
+	})
+
+	t.Run("when I get the digest of a range past the end", func(t *testing.T) {
+		_, n, err := wbblist.RangeDigest(st, appended.rk, 40, 100)
+		require.NoError(t, err)
+
+		t.Run("then it should count the existing elements", func(t *testing.T) {
+			require.Equal(t, uint64(10), n)
+		})
+	})
+
+	t.Run("when an element changes", func(t *testing.T) {
+		appended.delete(t, 15)
+		appended.insert(t, 15, 100)
+
+		t.Run("then only digests of ranges with the element should change", func(t *testing.T) {
+			da, _, err := wbblist.RangeDigest(st, appended.rk, 0, 15)
+			require.NoError(t, err)
+			dp, _, err := wbblist.RangeDigest(st, prepended.rk, 0, 15)
+			require.NoError(t, err)
+			require.Equal(t, da, dp)
+
+			da, _, err = wbblist.RangeDigest(st, appended.rk, 10, 20)
+			require.NoError(t, err)
+			dp, _, err = wbblist.RangeDigest(st, prepended.rk, 10, 20)
+			require.NoError(t, err)
+			require.NotEqual(t, da, dp)
+		})
+	})
+}
@@ -0,0 +1,43 @@
+package wbblist
+
+import (
+	"encoding/binary"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+type nodeModifier store.SegmentWriter
+
+func newNodeModifier(s store.Store) (nodeModifier, error) {
+	sw, err := s.CreateSegment(0, store.TypeListNode, 3, 16)
+	if err != nil {
+		return nodeModifier{}, errors.Wrap(err, "while creating segment")
+	}
+	return nodeModifier(sw), nil
+
+}
+
+func (n nodeModifier) setLeftCount(c uint64) {
+	binary.BigEndian.PutUint64(n.Data, c)
+}
+
+func (n nodeModifier) setRightCount(c uint64) {
+	binary.BigEndian.PutUint64(n.Data[8:], c)
+}
+
+func (n nodeModifier) segmentWriter() store.SegmentWriter {
+	return store.SegmentWriter(n)
+}
+
+func (n nodeModifier) setLeftChild(lck store.Address) {
+	n.segmentWriter().SetChild(0, lck)
+}
+
+func (n nodeModifier) setRightChild(rck store.Address) {
+	n.segmentWriter().SetChild(1, rck)
+}
+
+func (n nodeModifier) setValue(vk store.Address) {
+	n.segmentWriter().SetChild(2, vk)
+}
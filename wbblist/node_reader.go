@@ -0,0 +1,58 @@
+package wbblist
+
+import (
+	"encoding/binary"
+	serrors "errors"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+var ErrNotAList = serrors.New("not a list")
+
+type nodeReader store.SegmentReader
+
+func newNodeReader(st store.Store, a store.Address) (nodeReader, error) {
+	sr := st.GetSegment(a)
+	if sr.Type() != store.TypeListNode {
+		return nodeReader{}, errors.Wrapf(ErrNotAList, "segment %s is %s", a, sr.Type())
+	}
+
+	if sr.NumberOfChildren() != 3 {
+		return nodeReader{}, errors.New("segment does not have 3 children")
+	}
+
+	if len(sr.GetData()) < 16 {
+		return nodeReader{}, errors.New("segment must have at least 16 bytes")
+	}
+
+	return nodeReader(sr), nil
+}
+
+func (n nodeReader) segmentReader() store.SegmentReader {
+	return store.SegmentReader(n)
+}
+
+func (n nodeReader) leftChild() store.Address {
+	return n.segmentReader().GetChildAddress(0)
+}
+
+func (n nodeReader) rightChild() store.Address {
+	return n.segmentReader().GetChildAddress(1)
+}
+
+func (n nodeReader) value() store.Address {
+	return n.segmentReader().GetChildAddress(2)
+}
+
+func (n nodeReader) leftCount() uint64 {
+	return binary.BigEndian.Uint64(n.segmentReader().GetData())
+}
+
+func (n nodeReader) rightCount() uint64 {
+	return binary.BigEndian.Uint64(n.segmentReader().GetData()[8:])
+}
+
+func (n nodeReader) isEmpty() bool {
+	return n.leftChild() == store.NilAddress && n.rightChild() == store.NilAddress && n.value() == store.NilAddress
+}
@@ -0,0 +1,63 @@
+package wbblist
+
+import (
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// RangeDigest returns the digest of the elements with indexes from from (inclusive) to to (exclusive)
+// and their number, which is smaller than to-from if the list ends before to.
+// Lists with the same elements in the range have the same digest, whatever the shape of their trees.
+func RangeDigest(s store.Store, root store.Address, from, to uint64) (store.Hash, uint64, error) {
+	if root == store.NilAddress || from >= to {
+		return store.Hash{}, 0, nil
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return store.Hash{}, 0, errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return store.Hash{}, 0, nil
+	}
+
+	lc := nr.leftCount()
+	total := lc + nr.rightCount() + 1
+
+	if from == 0 && to >= total {
+		return s.Digest(root), total, nil
+	}
+
+	var d store.Hash
+	var n uint64
+
+	if from < lc {
+		d, n, err = RangeDigest(s, nr.leftChild(), from, to)
+		if err != nil {
+			return store.Hash{}, 0, err
+		}
+	}
+
+	if from <= lc && lc < to {
+		d = store.ConcatDigests(d, n, store.EntryDigest(nil, s.Hash(nr.value())))
+		n++
+	}
+
+	if to > lc+1 {
+		rf := uint64(0)
+		if from > lc+1 {
+			rf = from - lc - 1
+		}
+
+		rd, rn, err := RangeDigest(s, nr.rightChild(), rf, to-lc-1)
+		if err != nil {
+			return store.Hash{}, 0, err
+		}
+
+		d = store.ConcatDigests(d, n, rd)
+		n += rn
+	}
+
+	return d, n, nil
+}
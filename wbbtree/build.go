@@ -0,0 +1,104 @@
+package wbbtree
+
+import (
+	"bytes"
+	serrors "errors"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+var ErrNotSorted = serrors.New("keys are not in strictly ascending order")
+
+// BuildSorted creates a perfectly weight-balanced tree from keys in strictly ascending order.
+// Every node is written exactly once, without any rebalancing.
+func BuildSorted(s store.Store, keys [][]byte, values []store.Address) (store.Address, error) {
+	if len(keys) != len(values) {
+		return store.NilAddress, errors.Errorf("got %d keys and %d values", len(keys), len(values))
+	}
+
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			return store.NilAddress, ErrNotSorted
+		}
+	}
+
+	if len(keys) == 0 {
+		return CreateEmpty(s)
+	}
+
+	return buildSorted(s, keys, values)
+}
+
+func buildSorted(s store.Store, keys [][]byte, values []store.Address) (store.Address, error) {
+	if len(keys) == 0 {
+		return store.NilAddress, nil
+	}
+
+	mid := len(keys) / 2
+
+	left, err := buildSorted(s, keys[:mid], values[:mid])
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	right, err := buildSorted(s, keys[mid+1:], values[mid+1:])
+	if err != nil {
+		return store.NilAddress, err
+	}
+
+	nm, err := newNodeModifier(s, keys[mid])
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while creating node modifier")
+	}
+
+	nm.setLeftChild(left)
+	nm.setLeftCount(uint64(mid))
+	nm.setRightChild(right)
+	nm.setRightCount(uint64(len(keys) - mid - 1))
+	nm.setValue(values[mid])
+
+	return nm.Address, nil
+}
+
+// MergeSorted creates a new perfectly weight-balanced tree containing all entries
+// of the tree and the keys in strictly ascending order.
+// Values of keys that are already in the tree are replaced.
+func MergeSorted(s store.Store, root store.Address, keys [][]byte, values []store.Address) (store.Address, error) {
+	if len(keys) != len(values) {
+		return store.NilAddress, errors.Errorf("got %d keys and %d values", len(keys), len(values))
+	}
+
+	mergedKeys := [][]byte{}
+	mergedValues := []store.Address{}
+
+	i := 0
+
+	err := ForEach(s, root, func(k []byte, v store.Address) error {
+		for i < len(keys) && bytes.Compare(keys[i], k) < 0 {
+			mergedKeys = append(mergedKeys, keys[i])
+			mergedValues = append(mergedValues, values[i])
+			i++
+		}
+
+		if i < len(keys) && bytes.Equal(keys[i], k) {
+			mergedKeys = append(mergedKeys, keys[i])
+			mergedValues = append(mergedValues, values[i])
+			i++
+			return nil
+		}
+
+		mergedKeys = append(mergedKeys, append([]byte{}, k...))
+		mergedValues = append(mergedValues, v)
+		return nil
+	})
+
+	if err != nil {
+		return store.NilAddress, errors.Wrap(err, "while iterating over the tree")
+	}
+
+	mergedKeys = append(mergedKeys, keys[i:]...)
+	mergedValues = append(mergedValues, values[i:]...)
+
+	return BuildSorted(s, mergedKeys, mergedValues)
+}
@@ -0,0 +1,74 @@
+package wbbtree_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb/data"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildSorted(t *testing.T) {
+	tt, cleanup := newTreeTester(t)
+	defer cleanup()
+
+	keys := [][]byte{}
+	values := []store.Address{}
+	expected := []kv{}
+
+	for i := 0; i < 1000; i++ {
+		k := []byte{byte(i >> 8), byte(i)}
+		v := []byte{byte(i)}
+		va, err := data.StoreData(tt.st, v, 8129, 4)
+		require.NoError(t, err)
+		keys = append(keys, k)
+		values = append(values, va)
+		expected = append(expected, kv{k, v})
+	}
+
+	t.Run("when I build a tree from sorted keys", func(t *testing.T) {
+		var err error
+		tt.rk, err = wbbtree.BuildSorted(tt.st, keys, values)
+		require.NoError(t, err)
+
+		t.Run("then it should contain all the keys", func(t *testing.T) {
+			require.Equal(t, uint64(1000), tt.count(t))
+			require.Equal(t, expected, tt.list(t))
+		})
+
+		t.Run("then it should be balanced", func(t *testing.T) {
+			tt.ensureBalanced(t)
+		})
+
+		t.Run("then inserting into the tree should work", func(t *testing.T) {
+			tt.insert(t, []byte{0xff, 0xff}, []byte{1})
+			require.Equal(t, uint64(1001), tt.count(t))
+			tt.ensureBalanced(t)
+		})
+	})
+
+	t.Run("when I merge sorted keys into the tree", func(t *testing.T) {
+		va, err := data.StoreData(tt.st, []byte{42}, 8129, 4)
+		require.NoError(t, err)
+
+		tt.rk, err = wbbtree.MergeSorted(tt.st, tt.rk, [][]byte{{0, 1}, {0xff, 0xfe}}, []store.Address{va, va})
+		require.NoError(t, err)
+
+		t.Run("then it should replace existing and add new keys", func(t *testing.T) {
+			require.Equal(t, uint64(1002), tt.count(t))
+			list := tt.list(t)
+			require.Equal(t, kv{[]byte{0, 1}, []byte{42}}, list[1])
+			require.Equal(t, kv{[]byte{0xff, 0xfe}, []byte{42}}, list[1000])
+		})
+
+		t.Run("then it should be balanced", func(t *testing.T) {
+			tt.ensureBalanced(t)
+		})
+	})
+
+	t.Run("when I build a tree from unsorted keys", func(t *testing.T) {
+		_, err := wbbtree.BuildSorted(tt.st, [][]byte{{2}, {1}}, []store.Address{values[0], values[1]})
+		require.Equal(t, wbbtree.ErrNotSorted, err)
+	})
+}
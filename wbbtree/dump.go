@@ -6,18 +6,24 @@ import (
 	"github.com/draganm/immersadb/store"
 )
 
-func Dump(s store.Store, root store.Address, prefix string) {
+// Dump prints the tree for debugging.
+func Dump(s store.Store, root store.Address, prefix string) error {
 	if root == store.NilAddress {
 		fmt.Println(prefix, "NIL")
-		return
+		return nil
 	}
 
 	nr, err := newNodeReader(s, root)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("%sKey: %x  LC: %d RC: %d Value %s\n", prefix, nr.key(), nr.leftCount(), nr.rightCount(), nr.value())
-	Dump(s, nr.leftChild(), prefix+"L:  ")
-	Dump(s, nr.rightChild(), prefix+"R:  ")
+
+	err = Dump(s, nr.leftChild(), prefix+"L:  ")
+	if err != nil {
+		return err
+	}
+
+	return Dump(s, nr.rightChild(), prefix+"R:  ")
 }
@@ -0,0 +1,49 @@
+package wbbtree
+
+import (
+	"bytes"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// ForEachWithPrefix calls f for every key starting with prefix in ascending order.
+// Sub-trees that can't contain such keys are not visited.
+func ForEachWithPrefix(s store.Store, root store.Address, prefix []byte, f func([]byte, store.Address) error) error {
+	if root == store.NilAddress {
+		return nil
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return nil
+	}
+
+	k := nr.key()
+
+	if bytes.HasPrefix(k, prefix) {
+		err = ForEachWithPrefix(s, nr.leftChild(), prefix, f)
+		if err != nil {
+			return err
+		}
+
+		err = f(k, nr.value())
+		if err != nil {
+			return err
+		}
+
+		return ForEachWithPrefix(s, nr.rightChild(), prefix, f)
+	}
+
+	// a key that is neither a prefix match nor smaller than prefix
+	// is bigger than all keys starting with prefix
+	if bytes.Compare(k, prefix) < 0 {
+		return ForEachWithPrefix(s, nr.rightChild(), prefix, f)
+	}
+
+	return ForEachWithPrefix(s, nr.leftChild(), prefix, f)
+}
@@ -0,0 +1,48 @@
+package wbbtree_test
+
+import (
+	"testing"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEachWithPrefix(t *testing.T) {
+	tt, cleanup := newTreeTester(t)
+	defer cleanup()
+
+	for _, k := range []string{"a", "ab", "abc", "abd", "ac", "b", "ba", "aa"} {
+		tt.insert(t, []byte(k), []byte{1})
+	}
+
+	keysWithPrefix := func(t *testing.T, prefix string) []string {
+		keys := []string{}
+		err := wbbtree.ForEachWithPrefix(tt.st, tt.rk, []byte(prefix), func(k []byte, _ store.Address) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		require.NoError(t, err)
+		return keys
+	}
+
+	t.Run("when I iterate over keys with a prefix", func(t *testing.T) {
+		t.Run("then I should get only keys with the prefix in order", func(t *testing.T) {
+			require.Equal(t, []string{"ab", "abc", "abd"}, keysWithPrefix(t, "ab"))
+			require.Equal(t, []string{"b", "ba"}, keysWithPrefix(t, "b"))
+		})
+	})
+
+	t.Run("when I iterate over keys with an empty prefix", func(t *testing.T) {
+		t.Run("then I should get all keys", func(t *testing.T) {
+			require.Equal(t, []string{"a", "aa", "ab", "abc", "abd", "ac", "b", "ba"}, keysWithPrefix(t, ""))
+		})
+	})
+
+	t.Run("when no key has the prefix", func(t *testing.T) {
+		t.Run("then I should get no keys", func(t *testing.T) {
+			require.Empty(t, keysWithPrefix(t, "abe"))
+			require.Empty(t, keysWithPrefix(t, "c"))
+		})
+	})
+}
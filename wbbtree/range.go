@@ -0,0 +1,171 @@
+package wbbtree
+
+import (
+	"bytes"
+
+	"github.com/draganm/immersadb/store"
+	"github.com/pkg/errors"
+)
+
+// Ranges of keys include from and exclude to. Empty bounds are open.
+
+func afterFrom(key, from []byte) bool {
+	return len(from) == 0 || bytes.Compare(key, from) >= 0
+}
+
+func beforeTo(key, to []byte) bool {
+	return len(to) == 0 || bytes.Compare(key, to) < 0
+}
+
+// RangeDigest returns the digest and the number of entries with keys in the range.
+// Maps with the same entries in the range have the same digest, whatever the shape of their trees.
+func RangeDigest(s store.Store, root store.Address, from, to []byte) (store.Hash, uint64, error) {
+	if root == store.NilAddress {
+		return store.Hash{}, 0, nil
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return store.Hash{}, 0, errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return store.Hash{}, 0, nil
+	}
+
+	if len(from) == 0 && len(to) == 0 {
+		return s.Digest(root), nr.leftCount() + nr.rightCount() + 1, nil
+	}
+
+	k := nr.key()
+
+	var d store.Hash
+	var n uint64
+
+	if afterFrom(k, from) {
+		// all keys of the left sub-tree are before to if k is
+		lt := to
+		if beforeTo(k, to) {
+			lt = nil
+		}
+
+		d, n, err = RangeDigest(s, nr.leftChild(), from, lt)
+		if err != nil {
+			return store.Hash{}, 0, err
+		}
+
+		if beforeTo(k, to) {
+			d = store.ConcatDigests(d, n, store.EntryDigest(k, s.Hash(nr.value())))
+			n++
+		}
+	}
+
+	if beforeTo(k, to) {
+		rf := from
+		if afterFrom(k, from) {
+			rf = nil
+		}
+
+		rd, rn, err := RangeDigest(s, nr.rightChild(), rf, to)
+		if err != nil {
+			return store.Hash{}, 0, err
+		}
+
+		d = store.ConcatDigests(d, n, rd)
+		n += rn
+	}
+
+	return d, n, nil
+}
+
+// Rank returns the number of keys before the key.
+func Rank(s store.Store, root store.Address, key []byte) (uint64, error) {
+	if root == store.NilAddress {
+		return 0, nil
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return 0, errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return 0, nil
+	}
+
+	if bytes.Compare(key, nr.key()) <= 0 {
+		return Rank(s, nr.leftChild(), key)
+	}
+
+	r, err := Rank(s, nr.rightChild(), key)
+	if err != nil {
+		return 0, err
+	}
+
+	return nr.leftCount() + 1 + r, nil
+}
+
+// KeyAt returns the key with the index in key order.
+func KeyAt(s store.Store, root store.Address, index uint64) ([]byte, error) {
+	if root == store.NilAddress {
+		return nil, ErrNotFound
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return nil, errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return nil, ErrNotFound
+	}
+
+	lc := nr.leftCount()
+
+	switch {
+	case index < lc:
+		return KeyAt(s, nr.leftChild(), index)
+	case index == lc:
+		return nr.key(), nil
+	default:
+		return KeyAt(s, nr.rightChild(), index-lc-1)
+	}
+}
+
+// ForEachInRange calls f with every key in the range and its value in key order.
+func ForEachInRange(s store.Store, root store.Address, from, to []byte, f func([]byte, store.Address) error) error {
+	if root == store.NilAddress {
+		return nil
+	}
+
+	nr, err := newNodeReader(s, root)
+	if err != nil {
+		return errors.Wrap(err, "while creating node reader")
+	}
+
+	if nr.isEmpty() {
+		return nil
+	}
+
+	k := nr.key()
+
+	if afterFrom(k, from) {
+		err = ForEachInRange(s, nr.leftChild(), from, to, f)
+		if err != nil {
+			return err
+		}
+
+		if beforeTo(k, to) {
+			err = f(k, nr.value())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if beforeTo(k, to) {
+		return ForEachInRange(s, nr.rightChild(), from, to, f)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package wbbtree_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/draganm/immersadb/data"
+	"github.com/draganm/immersadb/store"
+	"github.com/draganm/immersadb/wbbtree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeDigest(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	st.SetFormat(store.Format{Hashes: true})
+
+	build := func(t *testing.T, keys []int) store.Address {
+		root := store.NilAddress
+		for _, k := range keys {
+			va, err := data.StoreData(st, []byte(fmt.Sprint(k)), 8129, 4)
+			require.NoError(t, err)
+			root, err = wbbtree.Insert(st, root, []byte(fmt.Sprintf("%03d", k)), va)
+			require.NoError(t, err)
+		}
+		return root
+	}
+
+	ascending := []int{}
+	descending := []int{}
+	for i := 0; i < 100; i++ {
+		ascending = append(ascending, i)
+		descending = append(descending, 99-i)
+	}
+
+	a := build(t, ascending)
+	d := build(t, descending)
+
+	t.Run("when maps with the same entries were written in a different order", func(t *testing.T) {
+		t.Run("then their hashes should be equal", func(t *testing.T) {
+			require.Equal(t, st.Hash(a), st.Hash(d))
+		})
+
+		t.Run("then digests of their ranges should be equal", func(t *testing.T) {
+			for _, r := range [][2]string{{"", ""}, {"010", "020"}, {"", "050"}, {"050", ""}, {"0105", "0995"}} {
+				da, na, err := wbbtree.RangeDigest(st, a, []byte(r[0]), []byte(r[1]))
+				require.NoError(t, err)
+				dd, nd, err := wbbtree.RangeDigest(st, d, []byte(r[0]), []byte(r[1]))
+				require.NoError(t, err)
+				require.Equal(t, da, dd)
+				require.Equal(t, na, nd)
+			}
+		})
+	})
+
+	t.Run("when I get the digest of a range", func(t *testing.T) {
+		dr, n, err := wbbtree.RangeDigest(st, a, []byte("010"), []byte("020"))
+		require.NoError(t, err)
+
+		t.Run("then it should count the keys in the range", func(t *testing.T) {
+			require.Equal(t, uint64(10), n)
+		})
+
+		t.Run("then it should be the digest of a map with only those keys", func(t *testing.T) {
+			keys := []int{}
+			for i := 10; i < 20; i++ {
+				keys = append(keys, i)
+			}
+			require.Equal(t, st.Digest(build(t, keys)), dr)
+		})
+	})
+
+	t.Run("when a value of the map changes", func(t *testing.T) {
+		va, err := data.StoreData(st, []byte("changed"), 8129, 4)
+		require.NoError(t, err)
+		c, err := wbbtree.Insert(st, a, []byte("015"), va)
+		require.NoError(t, err)
+
+		t.Run("then only digests of ranges with the key should change", func(t *testing.T) {
+			before, _, err := wbbtree.RangeDigest(st, a, []byte("010"), []byte("015"))
+			require.NoError(t, err)
+			after, _, err := wbbtree.RangeDigest(st, c, []byte("010"), []byte("015"))
+			require.NoError(t, err)
+			require.Equal(t, before, after)
+
+			before, _, err = wbbtree.RangeDigest(st, a, []byte("015"), []byte("016"))
+			require.NoError(t, err)
+			after, _, err = wbbtree.RangeDigest(st, c, []byte("015"), []byte("016"))
+			require.NoError(t, err)
+			require.NotEqual(t, before, after)
+		})
+	})
+
+	t.Run("when I get keys by index", func(t *testing.T) {
+		k, err := wbbtree.KeyAt(st, d, 42)
+		require.NoError(t, err)
+
+		t.Run("then the key should have the index as its rank", func(t *testing.T) {
+			require.Equal(t, []byte("042"), k)
+			r, err := wbbtree.Rank(st, d, k)
+			require.NoError(t, err)
+			require.Equal(t, uint64(42), r)
+		})
+	})
+
+	t.Run("when I iterate over a range", func(t *testing.T) {
+		keys := []string{}
+		err := wbbtree.ForEachInRange(st, d, []byte("095"), nil, func(k []byte, _ store.Address) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		require.NoError(t, err)
+
+		t.Run("then it should return the keys of the range in order", func(t *testing.T) {
+			require.Equal(t, []string{"095", "096", "097", "098", "099"}, keys)
+		})
+	})
+}